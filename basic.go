@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/************************************************************
+ *
+ * BASIC V2 Tokenizer
+ *
+ ************************************************************/
+
+/*
+ * BASIC programs kept as text (a .bas file) are turned into the
+ * tokenized program LOAD expects, and back, the way the ROM would: a
+ * line is crunched like one typed at the READY prompt, so keywords are
+ * found inside variable names (SCORE has OR in it), abbreviations work
+ * (a letter followed by a shifted letter, pO for POKE in the lower case
+ * set) and nothing is crunched in strings, after REM or in DATA.
+ * Characters are translated to PETSCII in the screen's character set,
+ * and control codes, which have no glyph, are written {clr}, {rvon},
+ * {3 down}, {$92} and so on, like other tools do. The result is plain
+ * BASIC V2, so DECK=5 stays a variable; -plugin-keywords crunches the
+ * plugin's keywords (LOCATE, QUIT, ...) too, as in a line typed after
+ * SYS 1, for programs that are only meant to run here.
+ *
+ * Lines may come in any order; a line replaces an earlier one with the
+ * same number and a number on its own deletes it, like typing them in.
+ *
+ * LOAD"PROG.BAS" (or LOAD"PROG" if there is only prog.bas) tokenizes
+ * the file on the way, and -tokenize and -detokenize convert files
+ * without running anything.
+ */
+const (
+	BASIC_START = 0x0801
+	BASIC_MAX_LINE = 63999
+	BASIC_LINE_SIZE = 255		// the most a tokenized line can have after its number
+
+	TOKEN_DATA = 0x83
+	TOKEN_IF = 0x8B
+	TOKEN_REM = 0x8F
+	TOKEN_PRINT = 0x99
+	TOKEN_ESCAPE = 0xFE		// the token of a plugin keyword follows (see plugin.go)
+	TOKEN_PI = 0xFF
+)
+
+var (
+	tokenize_flag = flag.Bool("tokenize", false, "convert the BASIC text files given (or standard input) to a program and write it to standard output, then quit")
+	detokenize_flag = flag.Bool("detokenize", false, "list the BASIC programs given (or standard input) as text on standard output, then quit")
+	plugin_keywords_flag = flag.Bool("plugin-keywords", false, "tokenize the plugin's keywords in BASIC text files too (-tokenize, -batch and LOAD of .bas files)")
+)
+
+// the ROM's keyword table, starting with token $80
+var basic_keywords = []string{
+	"END", "FOR", "NEXT", "DATA", "INPUT#", "INPUT", "DIM", "READ",
+	"LET", "GOTO", "RUN", "IF", "RESTORE", "GOSUB", "RETURN", "REM",
+	"STOP", "ON", "WAIT", "LOAD", "SAVE", "VERIFY", "DEF", "POKE",
+	"PRINT#", "PRINT", "CONT", "LIST", "CLR", "CMD", "SYS", "OPEN",
+	"CLOSE", "GET", "NEW", "TAB(", "TO", "FN", "SPC(", "THEN",
+	"NOT", "STEP", "+", "-", "*", "/", "^", "AND",
+	"OR", ">", "=", "<", "SGN", "INT", "ABS", "USR",
+	"FRE", "POS", "SQR", "RND", "LOG", "EXP", "COS", "SIN",
+	"TAN", "ATN", "PEEK", "LEN", "STR$", "VAL", "ASC", "CHR$",
+	"LEFT$", "RIGHT$", "MID$", "GO",
+}
+
+var basic_controls = map[byte]string{
+	0x03:	"stop",
+	0x05:	"wht",
+	0x08:	"dish",
+	0x09:	"ensh",
+	0x0D:	"return",
+	0x0E:	"swlc",
+	0x11:	"down",
+	0x12:	"rvon",
+	0x13:	"home",
+	0x14:	"del",
+	0x1C:	"red",
+	0x1D:	"rght",
+	0x1E:	"grn",
+	0x1F:	"blu",
+	0x81:	"orng",
+	0x85:	"f1",
+	0x86:	"f3",
+	0x87:	"f5",
+	0x88:	"f7",
+	0x89:	"f2",
+	0x8A:	"f4",
+	0x8B:	"f6",
+	0x8C:	"f8",
+	0x8D:	"sret",
+	0x8E:	"swuc",
+	0x90:	"blk",
+	0x91:	"up",
+	0x92:	"rvof",
+	0x93:	"clr",
+	0x94:	"inst",
+	0x95:	"brn",
+	0x96:	"lred",
+	0x97:	"gry1",
+	0x98:	"gry2",
+	0x99:	"lgrn",
+	0x9A:	"lblu",
+	0x9B:	"gry3",
+	0x9C:	"pur",
+	0x9D:	"left",
+	0x9E:	"yel",
+	0x9F:	"cyn",
+}
+
+// other names people write
+var basic_control_names = map[string]byte{
+	"white":		0x05,
+	"cr":			0x0D,
+	"rvs on":		0x12,
+	"reverse on":	0x12,
+	"right":		0x1D,
+	"green":		0x1E,
+	"blue":		0x1F,
+	"orange":		0x81,
+	"black":		0x90,
+	"rvs off":		0x92,
+	"reverse off":	0x92,
+	"clear":		0x93,
+	"insert":		0x94,
+	"brown":		0x95,
+	"purple":		0x9C,
+	"yellow":		0x9E,
+	"cyan":		0x9F,
+}
+
+func init() {
+	for c, name := range basic_controls {
+		basic_control_names[name] = c
+	}
+}
+
+/* parse_control returns the code of a {control} escape's contents, and how many times it's repeated */
+func parse_control(s string) (byte, int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	n := 1
+	// {3 down} and {down*3}
+	if i := strings.IndexByte(s, ' '); i > 0 {
+		if count, err := strconv.Atoi(s[:i]); err == nil {
+			n, s = count, strings.TrimSpace(s[i + 1:])
+		}
+	}
+	if i := strings.LastIndexByte(s, '*'); i > 0 {
+		if count, err := strconv.Atoi(s[i + 1:]); err == nil {
+			n, s = count, s[:i]
+		}
+	}
+	if n < 1 || n > BASIC_LINE_SIZE {
+		return 0, 0, fmt.Errorf("bad repeat count in {%s}", s)
+	}
+	if c, ok := basic_control_names[s]; ok {
+		return c, n, nil
+	}
+	var v uint64
+	var err error
+	if strings.HasPrefix(s, "$") {
+		v, err = strconv.ParseUint(s[1:], 16, 8)
+	} else {
+		v, err = strconv.ParseUint(s, 10, 8)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("unknown control code {%s}", s)
+	}
+	return byte(v), n, nil
+}
+
+/* petscii_line translates a line of text, with its {control} escapes, to PETSCII */
+func petscii_line(s string, cs charset) ([]byte, error) {
+	var b []byte
+
+	for len(s) > 0 {
+		if s[0] == '{' {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("no } after {")
+			}
+			c, n, err := parse_control(s[1:end])
+			if err != nil {
+				return nil, err
+			}
+			b = append(b, bytes.Repeat([]byte{ c }, n)...)
+			s = s[end + 1:]
+			continue
+		}
+		var c byte
+		if cs == CHARSET_NONE {
+			c, s = s[0], s[1:]
+		} else {
+			r, size := utf8.DecodeRuneInString(s)
+			c, s = unicode_to_petscii(r, cs), s[size:]
+		}
+		// the screen editor reads pi back as the token
+		if c == 0xDE && cs == CHARSET_UPPER {
+			c = TOKEN_PI
+		}
+		b = append(b, c)
+	}
+	return b, nil
+}
+
+/*
+ * match_keyword returns the tokens of the keyword at the start of b, and
+ * its length, or nil; the plugin's keywords only count if plugins is set
+ */
+func match_keyword(b []byte, plugins bool) ([]byte, int) {
+	if t := match_plugin_keyword(b); t != nil && plugins {
+		name, _ := plugin_keyword_name(t[1])
+		return t, len(name)
+	}
+	for i, kw := range basic_keywords {
+		n := 0
+		for ; n < len(kw) && n < len(b); n++ {
+			if b[n] == kw[n] {
+				continue
+			}
+			// a shifted letter ends an abbreviation
+			if b[n] == kw[n] | 0x80 && n > 0 {
+				return []byte{ byte(0x80 + i) }, n + 1
+			}
+			break
+		}
+		if n == len(kw) {
+			return []byte{ byte(0x80 + i) }, n
+		}
+	}
+	return nil, 0
+}
+
+/* crunch tokenizes the text of a line after its number, like the ROM's CRUNCH */
+func crunch(b []byte, plugins bool) []byte {
+	var out []byte
+	quote, data := false, false
+
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c == '"':
+			quote = !quote
+		case quote:
+		case c == ':':
+			data = false
+		case data, c >= 0x80, c == ' ', c >= '0' && c <= ';':
+		case c == '?':
+			out = append(out, TOKEN_PRINT)
+			i++
+			continue
+		default:
+			if tok, n := match_keyword(b[i:], plugins); tok != nil {
+				out = append(out, tok...)
+				i += n
+				switch tok[0] {
+				case TOKEN_REM:
+					return append(out, b[i:]...)
+				case TOKEN_DATA:
+					data = true
+				}
+				continue
+			}
+		}
+		out = append(out, c)
+		i++
+	}
+	return out
+}
+
+/* tokenize_basic turns BASIC text into a program, with the load address, starting at start */
+func tokenize_basic(text []byte, cs charset, start uint16) ([]byte, error) {
+	lines := map[int][]byte{}
+	sc := bufio.NewScanner(bytes.NewReader(text))
+	for n := 1; sc.Scan(); n++ {
+		s := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		b, err := petscii_line(s, cs)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		i := 0
+		for i < len(b) && b[i] == ' ' {
+			i++
+		}
+		num := -1
+		for ; i < len(b) && (b[i] >= '0' && b[i] <= '9' || b[i] == ' '); i++ {
+			if b[i] == ' ' {
+				continue
+			}
+			if num < 0 {
+				num = 0
+			}
+			num = num * 10 + int(b[i] - '0')
+			if num > BASIC_MAX_LINE {
+				return nil, fmt.Errorf("line %d: line number too big", n)
+			}
+		}
+		if num < 0 {
+			return nil, fmt.Errorf("line %d: no line number", n)
+		}
+		if i == len(b) {
+			delete(lines, num)
+			continue
+		}
+		tokens := crunch(b[i:], *plugin_keywords_flag)
+		if len(tokens) > BASIC_LINE_SIZE - 5 {
+			return nil, fmt.Errorf("line %d: line too long", n)
+		}
+		lines[num] = tokens
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	nums := make([]int, 0, len(lines))
+	for num := range lines {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	prg := []byte{ byte(start), byte(start >> 8) }
+	addr := int(start)
+	for _, num := range nums {
+		addr += 2 + 2 + len(lines[num]) + 1
+		if addr > 0xFFFF {
+			return nil, fmt.Errorf("program too big")
+		}
+		prg = append(prg, byte(addr), byte(addr >> 8), byte(num), byte(num >> 8))
+		prg = append(prg, lines[num]...)
+		prg = append(prg, 0)
+	}
+	return append(prg, 0, 0), nil
+}
+
+/* write_text writes PETSCII c as text, escaping control codes and whatever wouldn't read back the same */
+func write_text(w *bytes.Buffer, c byte, cs charset) {
+	r := petscii_to_unicode(c, cs)
+	back := unicode_to_petscii(r, cs)
+	if back == 0xDE && cs == CHARSET_UPPER {
+		back = TOKEN_PI
+	}
+	if c == '{' || r == 0 || back != c {
+		if name, ok := basic_controls[c]; ok {
+			fmt.Fprintf(w, "{%s}", name)
+		} else {
+			fmt.Fprintf(w, "{$%02x}", c)
+		}
+		return
+	}
+	write_petscii(w, c, cs)
+}
+
+/* detokenize_basic lists a program, with its load address, as text */
+func detokenize_basic(prg []byte, cs charset) ([]byte, error) {
+	var w bytes.Buffer
+
+	if len(prg) < 2 {
+		return nil, fmt.Errorf("no load address")
+	}
+	b := prg[2:]
+	for {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("program ends without an end marker")
+		}
+		if b[0] == 0 && b[1] == 0 {
+			break
+		}
+		if len(b) < 4 {
+			return nil, fmt.Errorf("program ends in a line number")
+		}
+		fmt.Fprintf(&w, "%d ", int(b[2]) | int(b[3]) << 8)
+		end := bytes.IndexByte(b[4:], 0)
+		if end < 0 {
+			return nil, fmt.Errorf("line %d does not end", int(b[2]) | int(b[3]) << 8)
+		}
+		quote, rem := false, false
+		text := b[4:4 + end]
+		for i := 0; i < len(text); i++ {
+			c := text[i]
+			if c == '"' {
+				quote = !quote
+			}
+			if c == TOKEN_ESCAPE && i + 1 < len(text) && !quote && !rem {
+				if name, ok := plugin_keyword_name(text[i + 1]); ok {
+					for _, k := range []byte(name) {
+						write_petscii(&w, k, cs)
+					}
+					i++
+					continue
+				}
+			}
+			if c >= 0x80 && c < 0x80 + byte(len(basic_keywords)) && !quote && !rem {
+				for _, k := range []byte(basic_keywords[c - 0x80]) {
+					write_petscii(&w, k, cs)
+				}
+				rem = c == TOKEN_REM
+				continue
+			}
+			write_text(&w, c, cs)
+		}
+		w.WriteByte('\n')
+		b = b[4 + end + 1:]
+	}
+	return w.Bytes(), nil
+}
+
+/************************************************************
+ * Host Files
+ ************************************************************/
+
+func is_basic_text(p string) bool {
+	return strings.EqualFold(path.Ext(p), ".bas")
+}
+
+// open_basic_text returns the program in the BASIC text read from r.
+func open_basic_text(r io.Reader) (io.Reader, error) {
+	text, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	prg, err := tokenize_basic(text, screen_charset, BASIC_START)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(prg), nil
+}
+
+/* convert_basic does -tokenize and -detokenize on the files given, or standard input */
+func convert_basic(files []string) {
+	if *tokenize_flag && *detokenize_flag {
+		fatalf("-tokenize and -detokenize don't go together")
+	}
+	screen_charset = must_charset(*screen_charset_flag)
+	if len(files) == 0 {
+		files = []string{ "-" }
+	}
+	for _, f := range files {
+		var in []byte
+		var err error
+
+		if f == "-" {
+			in, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			in, err = ioutil.ReadFile(f)
+		}
+		if err != nil {
+			fatalf("%v", err)
+		}
+		var out []byte
+		if *tokenize_flag {
+			out, err = tokenize_basic(in, screen_charset, BASIC_START)
+		} else {
+			out, err = detokenize_basic(in, screen_charset)
+		}
+		if err != nil {
+			fatalf("%s: %v", f, err)
+		}
+		if _, err := os.Stdout.Write(out); err != nil {
+			fatalf("%v", err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name		string
+		text		string
+		cs		charset
+		want		[]byte		// the first line's tokens
+	}{
+		{ "keywords", "10 PRINT\"HI\":GOTO10", CHARSET_UPPER, []byte{ 0x99, '"', 'H', 'I', '"', ':', 0x89, '1', '0' } },
+		{ "lower case", "10 print \"hi\"", CHARSET_UPPER, []byte{ 0x99, ' ', '"', 'H', 'I', '"' } },
+		{ "question mark", "10 ?A", CHARSET_UPPER, []byte{ 0x99, 'A' } },
+		{ "inside names", "10 SCORE=1", CHARSET_UPPER, []byte{ 'S', 'C', 0xB0, 'E', 0xB2, '1' } },
+		{ "abbreviation", "10 pO53280,0", CHARSET_LOWER, []byte{ 0x97, '5', '3', '2', '8', '0', ',', '0' } },
+		{ "rem", "10 REM PRINT \"", CHARSET_UPPER, []byte{ 0x8F, ' ', 'P', 'R', 'I', 'N', 'T', ' ', '"' } },
+		{ "data", "10 DATA TO,\"OR\":END", CHARSET_UPPER, []byte{ 0x83, ' ', 'T', 'O', ',', '"', 'O', 'R', '"', ':', 0x80 } },
+		{ "controls", "10 ?\"{clr}{2 down}{$41}{rvs on}\"", CHARSET_UPPER, []byte{ 0x99, '"', 0x93, 0x11, 0x11, 0x41, 0x12, '"' } },
+		{ "pi", "10 A=π", CHARSET_UPPER, []byte{ 'A', 0xB2, 0xFF } },
+		{ "no plugin keywords", "10 DECK=5:QUIT", CHARSET_UPPER, []byte{ 'D', 'E', 'C', 'K', 0xB2, '5', ':', 'Q', 'U', 'I', 'T' } },
+		{ "no plugin abbreviations", "10 lOcate", CHARSET_LOWER, []byte{ 0x93, 'C', 'A', 'T', 'E' } },
+	}
+
+	for _, tt := range tests {
+		prg, err := tokenize_basic([]byte(tt.text), tt.cs, BASIC_START)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		want := []byte{ 0x01, 0x08, 0, 0, 10, 0 }
+		want = append(want, tt.want...)
+		want = append(want, 0, 0, 0)
+		link := BASIC_START + len(want) - 4
+		want[2], want[3] = byte(link), byte(link >> 8)
+		if !bytes.Equal(prg, want) {
+			t.Errorf("%s: got % X, want % X", tt.name, prg, want)
+		}
+	}
+}
+
+func TestTokenizeLines(t *testing.T) {
+	prg, err := tokenize_basic([]byte("20 END\n\n10 A=1\r\n30 B=2\n20 STOP\n30\n"), CHARSET_UPPER, BASIC_START)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := []byte{
+		0x01, 0x08,
+		0x09, 0x08, 10, 0, 'A', 0xB2, '1', 0,
+		0x0F, 0x08, 20, 0, 0x90, 0,
+		0, 0,
+	}
+	if !bytes.Equal(prg, want) {
+		t.Errorf("got % X, want % X", prg, want)
+	}
+
+	for _, text := range []string{ "PRINT", "64000 END", "10 ?\"{nonsense}\"", "10 ?\"{clr\"" } {
+		if _, err := tokenize_basic([]byte(text), CHARSET_UPPER, BASIC_START); err == nil {
+			t.Errorf("%q: no error", text)
+		}
+	}
+}
+
+func TestDetokenize(t *testing.T) {
+	text := "10 PRINT \"{clr}HELLO{rvon}π\";π\n20 REM PRINT GOTO\n30 DATA 1,\"{$7b}\"\n40 GOTO 10\n"
+	for _, cs := range []charset{ CHARSET_UPPER, CHARSET_LOWER } {
+		prg, err := tokenize_basic([]byte(text), cs, BASIC_START)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		listing, err := detokenize_basic(prg, cs)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		again, err := tokenize_basic(listing, cs, BASIC_START)
+		if err != nil {
+			t.Fatalf("listing %q: unexpected error %v", listing, err)
+		}
+		if !bytes.Equal(again, prg) {
+			t.Errorf("listing %q tokenizes to % X, want % X", listing, again, prg)
+		}
+	}
+
+	prg, _ := tokenize_basic([]byte(text), CHARSET_UPPER, BASIC_START)
+	listing, _ := detokenize_basic(prg, CHARSET_UPPER)
+	if string(listing) != text {
+		t.Errorf("got %q, want %q", listing, text)
+	}
+
+	for _, prg := range [][]byte{ nil, { 0x01, 0x08 }, { 0x01, 0x08, 0x09, 0x08, 10 }, { 0x01, 0x08, 0x09, 0x08, 10, 0, 0x99 } } {
+		if _, err := detokenize_basic(prg, CHARSET_UPPER); err == nil {
+			t.Errorf("% X: no error", prg)
+		}
+	}
+}
+
+func TestTokenizePluginKeywords(t *testing.T) {
+	defer func() {
+		*plugin_keywords_flag = false
+	}()
+
+	// plain BASIC V2 by default, so it lists and tokenizes the same anywhere
+	text := "10 DECK=5:LOCATE=1\n"
+	prg, err := tokenize_basic([]byte(text), CHARSET_UPPER, BASIC_START)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := []byte{ 'D', 'E', 'C', 'K', 0xB2, '5', ':', 'L', 'O', 'C', 'A', 'T', 'E', 0xB2, '1', 0 }
+	if !bytes.Equal(prg[6:len(prg) - 2], want) {
+		t.Errorf("got % X, want % X", prg[6:len(prg) - 2], want)
+	}
+	if listing, _ := detokenize_basic(prg, CHARSET_UPPER); string(listing) != text {
+		t.Errorf("listed as %q", listing)
+	}
+
+	*plugin_keywords_flag = true
+	text = "50 LOCATE 1,2:QUIT\n"
+	prg, err = tokenize_basic([]byte(text), CHARSET_UPPER, BASIC_START)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want = []byte{ 0xFE, 0x80, ' ', '1', ',', '2', ':', 0xFE, 0x82, 0 }
+	if !bytes.Equal(prg[6:len(prg) - 2], want) {
+		t.Errorf("-plugin-keywords: got % X, want % X", prg[6:len(prg) - 2], want)
+	}
+	if listing, _ := detokenize_basic(prg, CHARSET_UPPER); string(listing) != text {
+		t.Errorf("-plugin-keywords: listed as %q", listing)
+	}
+}
+
+func TestLoadBasicText(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.bas"), []byte("10 PRINT\"HI\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := tokenize_basic([]byte("10 PRINT\"HI\"\n"), screen_charset, BASIC_START)
+	d := new_host_drive(new_dir_sandbox(dir))
+	d.charset = CHARSET_LOWER
+
+	for _, name := range []string{ "HELLO", "HELLO.BAS" } {
+		if err := d.open(name, 0); err != KERN_ERR_NONE {
+			t.Errorf("%s: open error %d", name, err)
+			continue
+		}
+		if got := read_channel(d, 0); !bytes.Equal(got, want) {
+			t.Errorf("%s: got % X, want % X", name, got, want)
+		}
+		d.close(0)
+	}
+}
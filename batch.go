@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/************************************************************
+ *
+ * Batch Mode
+ *
+ ************************************************************/
+
+/*
+ * cbmbasic -batch prog.bas runs a program the way a shell runs a
+ * script: the program is put into memory and RUN, without the banner or
+ * READY, and when BASIC is back at READY, cbmbasic quits. Standard
+ * output only gets what the program prints; INPUT reads standard input.
+ * A BASIC error (?SYNTAX  ERROR IN 10) goes to standard error instead,
+ * and makes the exit status 1, so programs can be used in pipelines and
+ * tests.
+ *
+ * The program can be BASIC text, with or without a #! line, or a PRG,
+ * P00 or T64 file.
+ */
+var batch_flag = flag.Bool("batch", false, "run the program given to completion and quit, without the banner or READY prompts, with BASIC errors on stderr; the exit status is 1 after an error")
+
+var (
+	batch			bool
+	batch_name		string
+	batch_program		[]byte		// without the load address
+	batch_input		[]byte		// typed at the READY prompt
+	batch_started		bool
+	batch_failed		bool
+	batch_error_text	[]byte		// the error message being printed, or nil
+	batch_errors		io.Writer = os.Stderr
+)
+
+func init_batch() {
+	if !*batch_flag {
+		return
+	}
+	args := flag.Args()
+	if len(args) != 1 {
+		fatalf("-batch needs the program to run")
+	}
+	batch = true
+	batch_name = args[0]
+	b, err := ioutil.ReadFile(batch_name)
+	if err != nil {
+		fatalf("error reading %s: %v", batch_name, err)
+	}
+	prg, err := batch_prg(batch_name, b)
+	if err != nil {
+		fatalf("%s: %v", batch_name, err)
+	}
+	if len(prg) < 2 {
+		fatalf("%s: no program", batch_name)
+	}
+	batch_program = prg[2:]
+}
+
+/* batch_prg returns the program in file name, with contents b */
+func batch_prg(name string, b []byte) ([]byte, error) {
+	if _, ok := container_extensions[strings.ToLower(filepath.Ext(name))]; ok {
+		r, err := open_container(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	if bytes.HasPrefix(b, []byte("#!")) {
+		// keep the line, empty, so error line numbers stay right
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			i = len(b)
+		}
+		b = b[i:]
+	}
+	return tokenize_basic(b, screen_charset, BASIC_START)
+}
+
+/*
+ * batch_chrin types RUN at the first READY prompt and quits at the next.
+ * It goes by the MAIN hook rather than CURLIN, which is still 0 at the
+ * first prompt after a cold start.
+ */
+func batch_chrin() byte {
+	if len(batch_input) == 0 {
+		if batch_started {
+			if batch_failed {
+				exit(1)
+			}
+			exit(0)
+		}
+		batch_started = true
+		if err := install_program(batch_program); err != nil {
+			fatalf("%s: %v", batch_name, err)
+		}
+		batch_input = []byte("RUN\r")
+	}
+	c := batch_input[0]
+	batch_input = batch_input[1:]
+	return c
+}
+
+/*
+ * install_program puts a program at the start of BASIC, links its lines
+ * for where it ended up, and sets the start of variables after it, like
+ * LOAD does. The links it came with are only looked at for the two zero
+ * bytes at the end, each line being found after the end of the one
+ * before, so the walk can only move forward; a program that doesn't fit
+ * below the end of BASIC's memory, or runs out before its end marker,
+ * is an error.
+ */
+func install_program(p []byte) error {
+	start := int(RAM[0x2B]) | int(RAM[0x2C]) << 8
+	end := start + len(p)
+	if end > RAM_TOP {
+		return fmt.Errorf("program of %d bytes does not fit in BASIC memory at $%04X", len(p), start)
+	}
+	copy(RAM[start:], p)
+	addr := start
+	for {
+		if addr + 2 > end {
+			return fmt.Errorf("program ends without an end marker after $%04X", addr)
+		}
+		if RAM[addr] == 0 && RAM[addr + 1] == 0 {
+			break
+		}
+		eol := addr + 4
+		for eol < end && RAM[eol] != 0 {
+			eol++
+		}
+		if eol >= end {
+			return fmt.Errorf("line at $%04X runs past the end of the program", addr)
+		}
+		RAM[addr] = byte(eol + 1)
+		RAM[addr + 1] = byte((eol + 1) >> 8)
+		addr = eol + 1
+	}
+	RAM[0x2D] = byte(addr + 2)
+	RAM[0x2E] = byte((addr + 2) >> 8)
+	return nil
+}
+
+func init() {
+	on_hook(HOOK_ERROR, func() {
+		if batch && X < 0x80 {
+			batch_failed = true
+			batch_error_text = []byte{}
+		}
+	})
+	on_hook(HOOK_READY, func() {
+		if batch_error_text != nil {
+			text := bytes.Trim(batch_error_text, "\r")
+			fmt.Fprintf(batch_errors, "%s: %s\n", batch_name, unicode_string(string(text), screen_charset))
+			batch_error_text = nil
+		}
+	})
+}
+
+/* batch_chrout takes what BASIC prints for an error, up to READY, for standard error; it returns whether it took A */
+func batch_chrout() bool {
+	if batch_error_text == nil {
+		return false
+	}
+	batch_error_text = append(batch_error_text, A)
+	return true
+}
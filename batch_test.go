@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBatchProgram(t *testing.T) {
+	want, _ := tokenize_basic([]byte("10 PRINT\"HI\"\n"), CHARSET_UPPER, BASIC_START)
+	tests := []struct {
+		name		string
+		in		[]byte
+	}{
+		{ "hello.bas", []byte("10 PRINT\"HI\"\n") },
+		{ "hello", []byte("#!/usr/bin/cbmbasic -batch\n10 PRINT\"HI\"\n") },
+		{ "hello.prg", want },
+		{ "hello.p00", make_p00("HELLO", want) },
+	}
+
+	for _, tt := range tests {
+		got, err := batch_prg(tt.name, tt.in)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got % X, want % X", tt.name, got, want)
+		}
+	}
+
+	// the #! line still counts
+	_, err := batch_prg("bad", []byte("#!/usr/bin/cbmbasic -batch\n10 END\nPRINT\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("got error %v, want one for line 3", err)
+	}
+}
+
+func TestInstallProgram(t *testing.T) {
+	prg, _ := tokenize_basic([]byte("10 A=1\n20 END\n"), CHARSET_UPPER, BASIC_START)
+	RAM[0x2B], RAM[0x2C] = 0x01, 0x10		// BASIC at $1001, like on a VIC-20
+
+	if err := install_program(prg[2:]); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x09, 0x10, 10, 0, 'A', 0xB2, '1', 0,
+		0x0F, 0x10, 20, 0, 0x80, 0,
+		0, 0,
+	}
+	if got := RAM[0x1001:0x1001 + len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("got % X, want % X", got, want)
+	}
+	if vartab := int(RAM[0x2D]) | int(RAM[0x2E]) << 8; vartab != 0x1001 + len(want) {
+		t.Errorf("variables start at $%04X, want $%04X", vartab, 0x1001 + len(want))
+	}
+}
+
+func TestBatchReady(t *testing.T) {
+	defer func() {
+		batch, batch_started, batch_program, batch_input = false, false, nil, nil
+		reading_line, quiet_output = false, false
+	}()
+	prg, _ := tokenize_basic([]byte("10 PRINT 1+1\n"), CHARSET_UPPER, BASIC_START)
+	batch, batch_program = true, prg[2:]
+	RAM[0x2B], RAM[0x2C] = 0x01, 0x08
+	RAM[0x39], RAM[0x3A] = 0, 0		// CURLIN after a cold start
+
+	// the first READY prompt gets RUN, with the program in the 6502's memory
+	fire_hook(HOOK_MAIN)
+	var typed []byte
+	for i := 0; i < 4; i++ {
+		typed = append(typed, keyboard_chrin())
+	}
+	if string(typed) != "RUN\r" {
+		t.Errorf("typed %q, want RUN", typed)
+	}
+	if !bytes.Equal(memory[0x0805:0x0805 + 4], prg[6:10]) {
+		t.Errorf("program at $0805 is % X, want % X", memory[0x0805:0x0805 + 4], prg[6:10])
+	}
+	fire_hook(HOOK_LINE)
+}
+
+func TestInstallCorruptProgram(t *testing.T) {
+	RAM[0x2B], RAM[0x2C] = 0x01, 0x08
+
+	tests := []struct {
+		name	string
+		p	[]byte
+	}{
+		{ "no end marker", []byte{ 0x09, 0x08, 10, 0, 0x80, 0 } },
+		{ "line without its zero", []byte{ 0x09, 0x08, 10, 0, 0x80, 0x80, 0x80 } },
+		{ "link back to itself", []byte{ 0x01, 0x08, 10, 0, 0x80 } },
+		{ "too short for a link", []byte{ 0x01 } },
+		{ "past the end of memory", bytes.Repeat([]byte{ 0xFF }, RAM_TOP - 0x0801 + 1) },
+	}
+	for _, tt := range tests {
+		if err := install_program(tt.p); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestBatchErrorText(t *testing.T) {
+	var errors bytes.Buffer
+
+	defer func(w io.Writer) {
+		batch_errors = w
+		batch, batch_failed = false, false
+	}(batch_errors)
+	batch_errors = &errors
+	batch, batch_name = true, "prog.bas"
+
+	A = 'X'
+	if batch_chrout() {
+		t.Errorf("program output taken")
+	}
+
+	// bit 7 means there is no error
+	X = 0x80
+	fire_hook(HOOK_ERROR)
+	if batch_failed || batch_chrout() {
+		t.Errorf("READY taken for an error")
+	}
+
+	X = ERROR_SYNTAX
+	fire_hook(HOOK_ERROR)
+	for _, c := range []byte("\r?SYNTAX  ERROR IN 10") {
+		A = c
+		if !batch_chrout() {
+			t.Errorf("%q not taken", c)
+		}
+	}
+	fire_hook(HOOK_READY)
+	A = 13
+	if batch_chrout() {
+		t.Errorf("READY taken")
+	}
+
+	if !batch_failed {
+		t.Errorf("error not noticed")
+	}
+	if got, want := errors.String(), "prog.bas: ?SYNTAX  ERROR IN 10\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
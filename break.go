@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+/************************************************************
+ *
+ * Breakpoints
+ *
+ ************************************************************/
+
+/*
+ * -break (or POST /api/break in the web UI) sets a breakpoint on an
+ * instruction, by symbol name or address: -break CHKCOM, -break '$A437'.
+ * When the 6502 fetches an instruction at one, the registers and the
+ * instruction are logged to the diagnostics, and if the web UI is
+ * running, the clock is stopped there so the chip can be looked at.
+ */
+var break_flags string_list
+
+func init() {
+	flag.Var(&break_flags, "break", "stop at `addr`, a symbol name or address (may be repeated)")
+}
+
+var (
+	break_mu		sync.Mutex
+	breakpoints	= map[uint16]bool{}
+)
+
+// after the label files are loaded, so their names can be used
+func init_breakpoints() {
+	for _, s := range break_flags {
+		if _, err := set_breakpoint(s); err != nil {
+			fatalf("error setting breakpoint: %v", err)
+		}
+	}
+}
+
+func set_breakpoint(s string) (uint16, error) {
+	addr, err := parse_address(s)
+	if err != nil {
+		return 0, err
+	}
+	break_mu.Lock()
+	breakpoints[addr] = true
+	break_mu.Unlock()
+	return addr, nil
+}
+
+func clear_breakpoint(s string) (uint16, error) {
+	addr, err := parse_address(s)
+	if err != nil {
+		return 0, err
+	}
+	break_mu.Lock()
+	delete(breakpoints, addr)
+	break_mu.Unlock()
+	return addr, nil
+}
+
+func is_breakpoint(addr uint16) bool {
+	break_mu.Lock()
+	defer break_mu.Unlock()
+	return breakpoints[addr]
+}
+
+// list_breakpoints returns the breakpoints, symbolized, in address order
+func list_breakpoints() []string {
+	break_mu.Lock()
+	addrs := make([]int, 0, len(breakpoints))
+	for addr := range breakpoints {
+		addrs = append(addrs, int(addr))
+	}
+	break_mu.Unlock()
+
+	sort.Ints(addrs)
+	l := make([]string, len(addrs))
+	for i, addr := range addrs {
+		l[i] = symbolize(uint16(addr))
+	}
+	return l
+}
+
+/* hit_breakpoint is called by the monitor with PC and the registers set */
+func hit_breakpoint() {
+	text, _ := disassemble(PC, func(addr uint16) byte {
+		return memory[addr]
+	})
+	fmt.Fprintf(diagnostics, "cbmbasic: break at %s: %s  A=%02X X=%02X Y=%02X S=%02X P=%02X\n",
+		symbolize(PC), text, A, X, Y, S, P)
+	if *http_addr != "" {
+		sim_command("stop", 0)
+	}
+}
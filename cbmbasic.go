@@ -1,6 +1,9 @@
 package main
 
 import (
+	"flag"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -19,9 +22,101 @@ func splitClock(c <-chan time.Time) (c1 <-chan time.Time, c2 <-chan time.Time) {
 	return dc1, dc2
 }
 
+/*
+ * gateClock passes the ticks of c on only while the simulation is
+ * running; clock_run starts (true) and stops (false) it, and clock_step
+ * lets the given number of half-cycles through and then stops. It
+ * never blocks, so the controls keep working even if the chip is stuck.
+ */
+var (
+	clock_run = make(chan bool)
+	clock_step = make(chan int)
+)
+
+func gateClock(c <-chan time.Time) <-chan time.Time {
+	dc := make(chan time.Time)
+	go func() {
+		running := true
+		steps := 0
+		for {
+			select {
+			case x := <-c:
+				if !running && steps == 0 {
+					break
+				}
+				// like time.Tick, drop ticks if the chip falls behind
+				select {
+				case dc <- x:
+					if steps > 0 {
+						steps--
+					}
+				default:
+				}
+			case running = <-clock_run:
+				steps = 0
+			case n := <-clock_step:
+				running = false
+				steps += n
+			}
+		}
+	}()
+	return dc
+}
+
+// string_list is a flag that can be given more than once
+type string_list []string
+
+func (l *string_list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *string_list) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var label_files string_list
+
+var broken_transistor_flag = flag.Int("broken-transistor", -1, "simulate a chip with transistor `n` stuck")
+
+func init() {
+	flag.Var(&label_files, "labels", "load symbols from a VICE, ld65 .dbg or name = $addr label `file` (may be repeated)")
+}
+
 func main() {
+	flag.Parse()
+	for _, f := range label_files {
+		if err := load_symbols(f); err != nil {
+			fatalf("error loading labels: %v", err)
+		}
+	}
+	if *broken_transistor_flag >= 0 {
+		broken_transistor = uint64(*broken_transistor_flag)
+	}
+	init_diagnostics()
+	init_hooks()
+	init_breakpoints()
+	if *tokenize_flag || *detokenize_flag {
+		convert_basic(flag.Args())
+		exit(0)
+	}
+	init_profile()
+	init_coverage()
+	init_die()
+	init_os(append([]string{ os.Args[0] }, flag.Args()...))
+	init_devices()
+	init_batch()
+	init_console()
+	init_keyboard()
+	init_clock()
+	init_editor()
+
 	// set up 6502 environment
 	chip_clock := time.Tick(C64Clock)
+	if *http_addr != "" {
+		chip_clock = gateClock(chip_clock)
+		start_webui(*http_addr)
+	}
 
 	// emulate the 6502!
 	go dochip(chip_clock)
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+/************************************************************
+ *
+ * Jiffy Clock
+ *
+ ************************************************************/
+
+/*
+ * TI counts jiffies, sixtieths of a second, and goes back to 0 after 24
+ * hours. The clock is ours, not the host's: SETTIM (TI$="...") sets it
+ * and RDTIM reads it, and the jiffies in between come either from the
+ * host's clock, starting at the time of day like cbmbasic always did, or
+ * from the simulated 6502's clock, starting at 0 like a C64 that was
+ * just switched on. The latter gives the same TI every run, however fast
+ * the host is.
+ */
+const JIFFIES_PER_DAY = 24 * 60 * 60 * 60
+
+var clock_flag = flag.String("clock", "host", "what TI counts: host (the host's time of day) or cycles (60 Hz of simulated 6502 time, from 0)")
+
+var (
+	clock_cycles	bool
+	clock_base		uint32		// jiffies at clock_since
+	clock_since		time.Time
+	clock_since_cycle	uint64
+	clock_start		time.Time		// when cbmbasic started, for TIMEMS()
+)
+
+func init_clock() {
+	switch *clock_flag {
+	case "host":
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		clock_base = uint32(now.Sub(midnight) * 60 / time.Second)
+		clock_since = now
+		clock_start = now
+	case "cycles":
+		clock_cycles = true
+	default:
+		fatalf("unknown -clock %q (want host or cycles)", *clock_flag)
+	}
+}
+
+// elapsed_jiffies returns how many jiffies passed since the clock was last set.
+func elapsed_jiffies() uint64 {
+	if clock_cycles {
+		// cycle counts half-cycles
+		return (uint64(cycle) - clock_since_cycle) * 60 / (2 * C64ClockHz)
+	}
+	return uint64(time.Since(clock_since) * 60 / time.Second)
+}
+
+// elapsed_ms returns how many milliseconds passed since cbmbasic started, on the same clock.
+func elapsed_ms() uint64 {
+	if clock_cycles {
+		return uint64(cycle) * 1000 / (2 * C64ClockHz)
+	}
+	return uint64(time.Since(clock_start) / time.Millisecond)
+}
+
+func read_jiffies() uint32 {
+	return uint32((uint64(clock_base) + elapsed_jiffies()) % JIFFIES_PER_DAY)
+}
+
+func set_jiffies(j uint32) {
+	clock_base = j % JIFFIES_PER_DAY
+	clock_since = time.Now()
+	clock_since_cycle = uint64(cycle)
+}
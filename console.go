@@ -1,5 +1,13 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
 const (
 	COLOR_WHITE = iota
 	COLOR_RED
@@ -19,11 +27,319 @@ const (
 	COLOR_GREY3
 )
 
-func clear_screen() {}
-func up_cursor() {}
-func down_cursor() {}
-func left_cursor() {}
-func right_cursor() {}
-func move_cursor(byte, byte) {}
-func get_cursor(*int, *int) {}
-func set_color(int) {}
+/************************************************************
+ *
+ * Console
+ *
+ ************************************************************/
+
+/*
+ * The console drives an ANSI terminal. It keeps track of the cursor
+ * itself, since asking the terminal would mean reading its answer from
+ * the same stdin BASIC reads from; the row is counted from where
+ * cbmbasic started until the first clear screen, which most programs
+ * that care about the cursor position do first anyway.
+ *
+ * If stdout is not a terminal, no escape sequences are written at
+ * all, but the cursor is still tracked for PLOT.
+ *
+ * The screen is as big as the terminal (80x25 if that isn't known, 40x25
+ * with -editor) unless -screen says otherwise; PLOT and LOCATE refuse to
+ * put the cursor outside it.
+ */
+var (
+	color_mode_flag = flag.String("color", "auto", "terminal `colors`: truecolor, 256, 16, none, or auto to pick from $COLORTERM and $NO_COLOR")
+	screen_size_flag = flag.String("screen", "", "`size` of the screen as columnsxrows, like 40x25 (default the terminal's size, or 40x25 with -editor)")
+)
+
+const (
+	COLORS_NONE = iota
+	COLORS_16
+	COLORS_256
+	COLORS_TRUE
+)
+
+var (
+	console_ansi		bool		// cursor movement and clearing
+	console_echo		bool		// the terminal echoes input
+	console_colors	int
+	console_reverse	bool
+	cursor_x, cursor_y	int		// from 0
+	screen_cols		= 80
+	screen_rows		= 25
+)
+
+type c64_color struct {
+	r, g, b	uint8
+	ansi		int		// closest of the 16 ANSI colors
+}
+
+// the colors in COLOR_ order
+var c64_palette = []c64_color{
+	COLOR_WHITE:	{ 0xFF, 0xFF, 0xFF, 97 },
+	COLOR_RED:		{ 0x88, 0x39, 0x32, 31 },
+	COLOR_GREEN:	{ 0x55, 0xA0, 0x49, 32 },
+	COLOR_BLUE:	{ 0x40, 0x31, 0x8D, 34 },
+	COLOR_BLACK:	{ 0x00, 0x00, 0x00, 30 },
+	COLOR_PURPLE:	{ 0x8B, 0x3F, 0x96, 35 },
+	COLOR_YELLOW:	{ 0xBF, 0xCE, 0x72, 93 },
+	COLOR_CYAN:	{ 0x67, 0xB6, 0xBD, 36 },
+	COLOR_ORANGE:	{ 0x8B, 0x54, 0x29, 33 },
+	COLOR_BROWN:	{ 0x57, 0x42, 0x00, 33 },
+	COLOR_LTRED:	{ 0xB8, 0x69, 0x62, 91 },
+	COLOR_GREY1:	{ 0x50, 0x50, 0x50, 90 },
+	COLOR_GREY2:	{ 0x78, 0x78, 0x78, 90 },
+	COLOR_LTGREEN:	{ 0x94, 0xE0, 0x89, 92 },
+	COLOR_LTBLUE:	{ 0x78, 0x69, 0xC4, 94 },
+	COLOR_GREY3:	{ 0x9F, 0x9F, 0x9F, 37 },
+}
+
+func init_console() {
+	console_ansi = is_terminal(os.Stdout)
+	console_echo = is_terminal(os.Stdin)
+	if *screen_size_flag != "" {
+		cols, rows, err := parse_screen_size(*screen_size_flag)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		screen_cols, screen_rows = cols, rows
+	} else if console_ansi {
+		if cols, rows, ok := terminal_size(os.Stdout); ok {
+			screen_cols, screen_rows = cols, rows
+		}
+	}
+
+	switch *color_mode_flag {
+	case "truecolor", "24bit":
+		console_colors = COLORS_TRUE
+	case "256":
+		console_colors = COLORS_256
+	case "16":
+		console_colors = COLORS_16
+	case "none":
+		console_colors = COLORS_NONE
+	case "auto":
+		ct := os.Getenv("COLORTERM")
+		switch {
+		case !console_ansi || os.Getenv("NO_COLOR") != "":
+			console_colors = COLORS_NONE
+		case ct == "truecolor" || ct == "24bit":
+			console_colors = COLORS_TRUE
+		case strings.Contains(os.Getenv("TERM"), "256color"):
+			console_colors = COLORS_256
+		default:
+			console_colors = COLORS_16
+		}
+	default:
+		fatalf("unknown -color %q (want truecolor, 256, 16, none or auto)", *color_mode_flag)
+	}
+	if console_colors != COLORS_NONE {
+		at_exit(func() {
+			os.Stdout.WriteString("\033[0m")
+		})
+	}
+}
+
+func parse_screen_size(s string) (int, int, error) {
+	parts := strings.Split(s, "x")
+	if len(parts) == 2 {
+		cols, err1 := strconv.Atoi(parts[0])
+		rows, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil && cols >= 2 && rows >= 2 && cols <= 255 && rows <= 255 {
+			return cols, rows, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("bad screen size %q (want columns x rows, like 40x25)", s)
+}
+
+// ansi writes an escape sequence, if the terminal takes them.
+func ansi(format string, args ...interface{}) {
+	if console_ansi {
+		fmt.Fprintf(os.Stdout, "\033[" + format, args...)
+	}
+}
+
+/* the cursor moves like on the C64: off either end of a line onto the next or previous one */
+func clamp_cursor() {
+	if cursor_x >= screen_cols {
+		cursor_x = 0
+		cursor_y++
+	}
+	if cursor_x < 0 {
+		cursor_x = screen_cols - 1
+		cursor_y--
+	}
+	if cursor_y < 0 {
+		cursor_y = 0
+		cursor_x = 0
+	}
+	if cursor_y >= screen_rows {
+		cursor_y = screen_rows - 1
+	}
+}
+
+// put_char writes a character and moves the cursor past it.
+func put_char(c byte) {
+	if petscii_to_unicode(c, screen_charset) == 0 {
+		return
+	}
+	write_petscii(os.Stdout, c, screen_charset)
+	cursor_x++
+	clamp_cursor()
+}
+
+// newline ends the line, which also ends reverse video, and scrolls at the bottom.
+func newline() {
+	if console_reverse {
+		reverse_video(false)
+	}
+	os.Stdout.WriteString("\r\n")
+	cursor_x = 0
+	cursor_y++
+	clamp_cursor()
+}
+
+/*
+ * The terminal echoes what is typed when it is not in raw mode; the
+ * cursor follows along.
+ */
+func echoed(c byte) {
+	if !console_echo {
+		return
+	}
+	if c == 13 {
+		cursor_x = 0
+		cursor_y++
+		clamp_cursor()
+	} else if petscii_to_unicode(c, screen_charset) != 0 {
+		cursor_x++
+		clamp_cursor()
+	}
+}
+
+func clear_screen() {
+	ansi("2J")
+	ansi("H")
+	cursor_x, cursor_y = 0, 0
+}
+
+func home_cursor() {
+	ansi("H")
+	cursor_x, cursor_y = 0, 0
+}
+
+func up_cursor() {
+	if cursor_y > 0 {
+		ansi("A")
+		cursor_y--
+	}
+}
+
+func down_cursor() {
+	if cursor_y < screen_rows - 1 {
+		ansi("B")
+		cursor_y++
+	}
+}
+
+func left_cursor() {
+	cursor_x--
+	clamp_cursor()
+	ansi("%d;%dH", cursor_y + 1, cursor_x + 1)
+}
+
+func right_cursor() {
+	cursor_x++
+	clamp_cursor()
+	ansi("%d;%dH", cursor_y + 1, cursor_x + 1)
+}
+
+// set_cursor moves to column x, row y, counting from 0 like PLOT does; it fails if that's off the screen.
+func set_cursor(x int, y int) bool {
+	if x < 0 || y < 0 || x >= screen_cols || y >= screen_rows {
+		return false
+	}
+	cursor_x, cursor_y = x, y
+	if editor_active {
+		editor.flush()
+	} else {
+		ansi("%d;%dH", cursor_y + 1, cursor_x + 1)
+	}
+	return true
+}
+
+// get_cursor returns the column and row, counting from 0 like PLOT does.
+func get_cursor(x *int, y *int) {
+	*x = cursor_x
+	*y = cursor_y
+}
+
+func set_color(c int) {
+	if console_ansi {
+		os.Stdout.WriteString(color_escape(c, false))
+	}
+}
+
+// color_escape returns the escape sequence for foreground or background color c, if colors are on.
+func color_escape(c int, background bool) string {
+	p := c64_palette[c]
+	layer := 38
+	if background {
+		layer = 48
+	}
+	switch console_colors {
+	case COLORS_TRUE:
+		return fmt.Sprintf("\033[%d;2;%d;%d;%dm", layer, p.r, p.g, p.b)
+	case COLORS_256:
+		return fmt.Sprintf("\033[%d;5;%dm", layer, xterm_color(p))
+	case COLORS_16:
+		if background {
+			return fmt.Sprintf("\033[%dm", p.ansi + 10)
+		}
+		return fmt.Sprintf("\033[%dm", p.ansi)
+	}
+	return ""
+}
+
+func reverse_video(on bool) {
+	console_reverse = on
+	if on {
+		ansi("7m")
+	} else {
+		ansi("27m")
+	}
+}
+
+// xterm_color returns the closest color in the xterm 256 color cube or grey ramp.
+func xterm_color(p c64_color) int {
+	level := func(v uint8) int {		// cube levels are 0, 95, 135, 175, 215, 255
+		if v < 48 {
+			return 0
+		}
+		if v < 115 {
+			return 1
+		}
+		return (int(v) - 35) / 40
+	}
+	value := func(l int) int {
+		if l == 0 {
+			return 0
+		}
+		return 55 + l * 40
+	}
+	dist := func(r, g, b int) int {
+		dr, dg, db := r - int(p.r), g - int(p.g), b - int(p.b)
+		return dr * dr + dg * dg + db * db
+	}
+
+	r, g, b := level(p.r), level(p.g), level(p.b)
+	best := 16 + 36 * r + 6 * g + b
+	bestd := dist(value(r), value(g), value(b))
+	for i := 0; i < 24; i++ {
+		v := 8 + 10 * i
+		if d := dist(v, v, v); d < bestd {
+			best, bestd = 232 + i, d
+		}
+	}
+	return best
+}
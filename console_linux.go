@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) bool {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	return errno == 0
+}
+
+func is_terminal(f *os.File) bool {
+	var t syscall.Termios
+
+	return ioctl(f, syscall.TCGETS, unsafe.Pointer(&t))
+}
+
+func terminal_size(f *os.File) (cols int, rows int, ok bool) {
+	var ws struct {
+		rows, cols		uint16
+		xpixel, ypixel	uint16
+	}
+
+	if !ioctl(f, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)) || ws.cols == 0 || ws.rows == 0 {
+		return 0, 0, false
+	}
+	return int(ws.cols), int(ws.rows), true
+}
+
+/*
+ * make_raw puts the terminal in raw mode, character at a time without
+ * echo, and returns a function to undo it. Output processing stays
+ * on, so everything that prints "\n" still starts a new line, and so
+ * do signals, unless keep_signals is false.
+ */
+func make_raw(f *os.File, keep_signals bool) (func(), error) {
+	var old syscall.Termios
+
+	if !ioctl(f, syscall.TCGETS, unsafe.Pointer(&old)) {
+		return nil, syscall.ENOTTY
+	}
+	t := old
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.IEXTEN
+	if !keep_signals {
+		t.Lflag &^= syscall.ISIG
+	}
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if !ioctl(f, syscall.TCSETS, unsafe.Pointer(&t)) {
+		return nil, syscall.ENOTTY
+	}
+	return func() {
+		ioctl(f, syscall.TCSETS, unsafe.Pointer(&old))
+	}, nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// elsewhere, the console acts as if stdout were never a terminal
+func is_terminal(f *os.File) bool {
+	return false
+}
+
+func terminal_size(f *os.File) (cols int, rows int, ok bool) {
+	return 0, 0, false
+}
+
+func make_raw(f *os.File, keep_signals bool) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this system")
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+/************************************************************
+ *
+ * File Containers
+ *
+ ************************************************************/
+
+/*
+ * C64 programs get passed around as plain PRG files (the load address
+ * and the program), as P00 files (the same behind a PC64 header with
+ * the C64 file name) and as T64 tape archives holding any number of
+ * programs. A host drive recognizes P00 and T64 files by their headers
+ * when reading, so LOAD"GAME.P00" gets the program inside, and a T64
+ * gets its first program; LOAD"GAME" also finds game.prg, game.p00 or
+ * game.t64. A T64 given to -disk8 is mounted like a (read-only) disk,
+ * so "$" lists what's on the tape.
+ *
+ * SAVE writes a P00 or T64 if the file name ends in .p00 or .t64, or
+ * whatever -save-format says.
+ */
+const (
+	CONTAINER_PRG = iota
+	CONTAINER_P00
+	CONTAINER_T64
+)
+
+var save_format_flag = flag.String("save-format", "ext", "`format` of saved files: prg, p00, t64, or ext to go by the file name's extension")
+
+var container_extensions = map[string]int{
+	".prg":	CONTAINER_PRG,
+	".p00":	CONTAINER_P00,
+	".t64":	CONTAINER_T64,
+}
+
+const (
+	P00_HEADER_SIZE = 26
+	T64_HEADER_SIZE = 64
+	T64_ENTRY_SIZE = 32
+)
+
+var p00_magic = []byte("C64File\x00")
+
+func is_p00(b []byte) bool {
+	return bytes.HasPrefix(b, p00_magic)
+}
+
+// "C64 tape image file", "C64S tape file", ...
+func is_t64(b []byte) bool {
+	return len(b) >= T64_HEADER_SIZE && bytes.HasPrefix(b, []byte("C64")) && bytes.Contains(b[:32], []byte("tape"))
+}
+
+/* make_p00 puts a PC64 header with the C64 file name name in front of data */
+func make_p00(name string, data []byte) []byte {
+	b := make([]byte, P00_HEADER_SIZE, P00_HEADER_SIZE + len(data))
+	copy(b, p00_magic)
+	if len(name) > 16 {
+		name = name[:16]
+	}
+	copy(b[8:24], name)
+	return append(b, data...)
+}
+
+type t64_file struct {
+	name		string		// PETSCII
+	data		[]byte		// with the load address, like a PRG
+}
+
+type t64 struct {
+	name		string		// of the tape
+	files	[]t64_file
+}
+
+/*
+ * parse_t64 returns the programs in a T64 archive. Lots of T64 files
+ * have the wrong end address (or number of used entries), so a file
+ * never runs into the next one or past the end of the archive, and
+ * unused entries are skipped by their type.
+ */
+func parse_t64(b []byte) (*t64, error) {
+	if !is_t64(b) {
+		return nil, fmt.Errorf("not a T64 archive")
+	}
+	le := binary.LittleEndian
+	tape := &t64{
+		name:	strings.TrimRight(string(b[0x28:0x40]), " \x00"),
+	}
+	var entries [][]byte
+	for i := 0; i < int(le.Uint16(b[0x22:])); i++ {
+		off := T64_HEADER_SIZE + i * T64_ENTRY_SIZE
+		if off + T64_ENTRY_SIZE > len(b) {
+			break
+		}
+		e := b[off:off + T64_ENTRY_SIZE]
+		if e[0] != 1 {		// only normal tape files; 0 is free, 3 a memory snapshot
+			continue
+		}
+		if int(le.Uint32(e[8:])) > len(b) {
+			return nil, fmt.Errorf("T64 entry %d is past the end of the archive", i)
+		}
+		entries = append(entries, e)
+	}
+	for _, e := range entries {
+		start := le.Uint16(e[2:])
+		end := le.Uint16(e[4:])
+		data_off := int(le.Uint32(e[8:]))
+		limit := len(b)
+		for _, next := range entries {
+			if n := int(le.Uint32(next[8:])); n > data_off && n < limit {
+				limit = n
+			}
+		}
+		size := int(end) - int(start)
+		if size <= 0 || data_off + size > limit {
+			size = limit - data_off
+		}
+		data := []byte{ byte(start), byte(start >> 8) }
+		tape.files = append(tape.files, t64_file{
+			name:	strings.TrimRight(string(e[16:32]), " \xA0\x00"),
+			data:	append(data, b[data_off:data_off + size]...),
+		})
+	}
+	return tape, nil
+}
+
+/* make_t64 makes a T64 archive of one program, given as a PRG */
+func make_t64(name string, prg []byte) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, T64_HEADER_SIZE + T64_ENTRY_SIZE, T64_HEADER_SIZE + T64_ENTRY_SIZE + len(prg))
+	copy(b, "C64 tape image file")
+	le.PutUint16(b[0x20:], 0x0101)
+	le.PutUint16(b[0x22:], 1)
+	le.PutUint16(b[0x24:], 1)
+	if len(name) > 16 {
+		name = name[:16]
+	}
+	copy(b[0x28:0x40], bytes.Repeat([]byte{ ' ' }, 24))
+	copy(b[0x28:], name)
+
+	e := b[T64_HEADER_SIZE:]
+	e[0] = 1
+	e[1] = 0x82		// PRG
+	if len(prg) >= 2 {
+		start := int(prg[0]) | int(prg[1]) << 8
+		le.PutUint16(e[2:], uint16(start))
+		le.PutUint16(e[4:], uint16(start + len(prg) - 2))
+		prg = prg[2:]
+	}
+	le.PutUint32(e[8:], uint32(len(b)))
+	copy(e[16:32], bytes.Repeat([]byte{ ' ' }, 16))
+	copy(e[16:], name)
+	return append(b, prg...)
+}
+
+// open_container returns the program in a P00 or T64 read from r, or r itself.
+func open_container(r io.Reader) (io.Reader, error) {
+	hdr := make([]byte, T64_HEADER_SIZE)
+	n, err := io.ReadFull(r, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	hdr = hdr[:n]
+	switch {
+	case is_p00(hdr) && len(hdr) >= P00_HEADER_SIZE:
+		return io.MultiReader(bytes.NewReader(hdr[P00_HEADER_SIZE:]), r), nil
+	case is_t64(hdr):
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		tape, err := parse_t64(append(hdr, rest...))
+		if err != nil {
+			return nil, err
+		}
+		if len(tape.files) == 0 {
+			return bytes.NewReader(nil), nil
+		}
+		return bytes.NewReader(tape.files[0].data), nil
+	}
+	return io.MultiReader(bytes.NewReader(hdr), r), nil
+}
+
+func check_save_format() {
+	if _, ok := container_extensions["." + *save_format_flag]; !ok && *save_format_flag != "ext" {
+		fatalf("unknown -save-format %q (want prg, p00, t64 or ext)", *save_format_flag)
+	}
+}
+
+/* save_container returns the container to save the file at path p in, and p with the extension -save-format asks for */
+func save_container(p string) (int, string) {
+	ext := strings.ToLower(path.Ext(p))
+	if *save_format_flag == "ext" {
+		return container_extensions[ext], p
+	}
+	kind := container_extensions["." + *save_format_flag]
+	if kind != CONTAINER_PRG && container_extensions[ext] != kind {
+		p += "." + *save_format_flag
+	}
+	return kind, p
+}
+
+// trim_extension removes a container extension from a PETSCII file name, for the name inside the container.
+func trim_extension(name string) string {
+	ext := path.Ext(name)
+	if _, ok := container_extensions[strings.ToLower(ext)]; ok {
+		return name[:len(name) - len(ext)]
+	}
+	return name
+}
+
+// stat_program finds the file at p or, failing that, at p with a container's extension or .bas.
+func stat_program(fsys fs.FS, p string) (string, fs.FileInfo, error) {
+	st, err := fs.Stat(fsys, p)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return p, st, err
+	}
+	for _, ext := range []string{ ".prg", ".p00", ".t64", ".bas" } {
+		if st, err := fs.Stat(fsys, p + ext); err == nil {
+			return p + ext, st, nil
+		}
+	}
+	return p, st, err
+}
+
+// container_writer collects a file and writes it out in its container on close.
+type container_writer struct {
+	w		io.WriteCloser
+	kind		int
+	name		string		// PETSCII, for the header
+	buf		bytes.Buffer
+}
+
+func (cw *container_writer) Write(p []byte) (int, error) {
+	return cw.buf.Write(p)
+}
+
+func (cw *container_writer) Close() error {
+	var b []byte
+
+	switch cw.kind {
+	case CONTAINER_P00:
+		b = make_p00(cw.name, cw.buf.Bytes())
+	case CONTAINER_T64:
+		b = make_t64(cw.name, cw.buf.Bytes())
+	default:
+		b = cw.buf.Bytes()
+	}
+	_, err := cw.w.Write(b)
+	if err2 := cw.w.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+/* new_t64_sandbox makes a read-only sandbox of the programs on a tape, with host names in charset cs */
+func new_t64_sandbox(b []byte, cs charset) (*sandbox, error) {
+	tape, err := parse_t64(b)
+	if err != nil {
+		return nil, err
+	}
+	files := map_fs{}
+	now := time.Now()
+	for _, f := range tape.files {
+		name := strings.Replace(unicode_string(f.name, cs), "/", "_", -1)
+		if !fs.ValidPath(name) || files[name] != nil {
+			continue
+		}
+		files[name] = &map_file{
+			data:		f.data,
+			mode:		0444,
+			mod_time:	now,
+		}
+	}
+	sb := new_sandbox(files, unicode_string(tape.name, cs))
+	sb.readonly = true
+	return sb, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var test_prg = []byte{ 0x01, 0x08, 0x0B, 0x08, 0x0A, 0x00, 0x99, 0x22, 0x48, 0x49, 0x22, 0x00, 0x00, 0x00 }
+
+// t64_fixture builds a T64 archive the way other tools write them, including unused entries and a wrong end address.
+func t64_fixture(files map[string][]byte, names []string) []byte {
+	le := binary.LittleEndian
+	entries := len(names) + 1
+	b := make([]byte, T64_HEADER_SIZE + entries * T64_ENTRY_SIZE)
+	copy(b, "C64S tape image file")
+	le.PutUint16(b[0x20:], 0x0100)
+	le.PutUint16(b[0x22:], uint16(entries))
+	le.PutUint16(b[0x24:], uint16(len(names)))
+	copy(b[0x28:], "TEST TAPE               ")
+	for i, name := range names {
+		prg := files[name]
+		e := b[T64_HEADER_SIZE + (i + 1) * T64_ENTRY_SIZE:]		// entry 0 is free
+		e[0] = 1
+		e[1] = 0x82
+		copy(e[2:4], prg[:2])
+		le.PutUint16(e[4:], 0xC3C6)		// the end address a popular converter wrote
+		le.PutUint32(e[8:], uint32(len(b)))
+		copy(e[16:32], name + strings.Repeat(" ", 16 - len(name)))
+		b = append(b, prg[2:]...)
+	}
+	return b
+}
+
+func TestParseT64(t *testing.T) {
+	second := []byte{ 0x00, 0xC0, 0xA9, 0x00, 0x60 }
+	fixture := t64_fixture(map[string][]byte{ "FIRST": test_prg, "SECOND": second }, []string{ "FIRST", "SECOND" })
+
+	tape, err := parse_t64(fixture)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if tape.name != "TEST TAPE" {
+		t.Errorf("tape name %q, want %q", tape.name, "TEST TAPE")
+	}
+	if len(tape.files) != 2 {
+		t.Fatalf("got %d files, want 2", len(tape.files))
+	}
+	// the wrong end addresses stop at the next file and at the end of the archive
+	if tape.files[0].name != "FIRST" || !bytes.Equal(tape.files[0].data, test_prg) {
+		t.Errorf("first file %q % X", tape.files[0].name, tape.files[0].data)
+	}
+	if tape.files[1].name != "SECOND" || !bytes.Equal(tape.files[1].data, second) {
+		t.Errorf("second file %q % X", tape.files[1].name, tape.files[1].data)
+	}
+
+	if _, err := parse_t64(test_prg); err == nil {
+		t.Errorf("PRG parsed as a T64")
+	}
+}
+
+func TestOpenContainer(t *testing.T) {
+	tests := []struct {
+		name	string
+		in	[]byte
+	}{
+		{ "prg", test_prg },
+		{ "p00", make_p00("HELLO", test_prg) },
+		{ "t64", make_t64("HELLO", test_prg) },
+		{ "foreign t64", t64_fixture(map[string][]byte{ "HELLO": test_prg }, []string{ "HELLO" }) },
+	}
+
+	for _, tt := range tests {
+		r, err := open_container(bytes.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		got, _ := io.ReadAll(r)
+		if !bytes.Equal(got, test_prg) {
+			t.Errorf("%s: got % X, want % X", tt.name, got, test_prg)
+		}
+	}
+}
+
+func read_channel(d device, sec byte) []byte {
+	var b []byte
+
+	for {
+		c := d.read(sec)
+		st := d.status(sec)
+		if st & KERN_ST_TIME_OUT_READ != 0 {
+			break
+		}
+		b = append(b, c)
+		if st & KERN_ST_EOF != 0 {
+			break
+		}
+	}
+	return b
+}
+
+func TestLoadContainers(t *testing.T) {
+	dir := t.TempDir()
+	fixtures := map[string][]byte{
+		"plain.prg":	test_prg,
+		"pc64.p00":	make_p00("PC64", test_prg),
+		"tape.t64":	t64_fixture(map[string][]byte{ "TAPE": test_prg }, []string{ "TAPE" }),
+	}
+	for name, b := range fixtures {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := new_host_drive(new_dir_sandbox(dir))
+	d.charset = CHARSET_LOWER
+
+	// with and without the extension
+	for _, name := range []string{ "PLAIN", "PLAIN.PRG", "PC64", "PC64.P00", "TAPE", "TAPE.T64" } {
+		if err := d.open(name, 0); err != KERN_ERR_NONE {
+			t.Errorf("%s: open error %d", name, err)
+			continue
+		}
+		if got := read_channel(d, 0); !bytes.Equal(got, test_prg) {
+			t.Errorf("%s: got % X, want % X", name, got, test_prg)
+		}
+		d.close(0)
+	}
+}
+
+func TestSaveContainers(t *testing.T) {
+	defer func(f string) {
+		*save_format_flag = f
+	}(*save_format_flag)
+
+	tests := []struct {
+		format	string
+		name		string		// given to SAVE
+		file		string		// on the host
+		want		[]byte
+	}{
+		{ "ext", "PLAIN", "plain", test_prg },
+		{ "ext", "GAME.P00", "game.p00", make_p00("GAME", test_prg) },
+		{ "ext", "GAME.T64", "game.t64", make_t64("GAME", test_prg) },
+		{ "p00", "GAME", "game.p00", make_p00("GAME", test_prg) },
+		{ "t64", "GAME", "game.t64", make_t64("GAME", test_prg) },
+		{ "t64", "GAME.T64", "game.t64", make_t64("GAME", test_prg) },
+		{ "prg", "GAME.P00", "game.p00", test_prg },
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		d := new_host_drive(new_dir_sandbox(dir))
+		d.charset = CHARSET_LOWER
+		*save_format_flag = tt.format
+
+		if err := d.open(tt.name, 1); err != KERN_ERR_NONE {
+			t.Errorf("%s %s: open error %d", tt.format, tt.name, err)
+			continue
+		}
+		for _, c := range test_prg {
+			d.write(1, c)
+		}
+		d.close(1)
+		got, err := os.ReadFile(filepath.Join(dir, tt.file))
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.format, tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s %s: got % X, want % X", tt.format, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestT64Listing(t *testing.T) {
+	fixture := t64_fixture(map[string][]byte{ "ONE": test_prg, "TWO": test_prg }, []string{ "ONE", "TWO" })
+	sb, err := new_t64_sandbox(fixture, CHARSET_LOWER)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	d := new_host_drive(sb)
+	d.charset = CHARSET_LOWER
+
+	if err := d.open("$", 0); err != KERN_ERR_NONE {
+		t.Fatalf("open error %d", err)
+	}
+	listing := string(read_channel(d, 0))
+	for _, want := range []string{ "\"TEST TAPE ", "\"ONE\"", "\"TWO\"" } {
+		if !strings.Contains(listing, want) {
+			t.Errorf("listing %q does not have %s", listing, want)
+		}
+	}
+
+	if err := d.open("TWO", 0); err != KERN_ERR_NONE {
+		t.Fatalf("open error %d", err)
+	}
+	if got := read_channel(d, 0); !bytes.Equal(got, test_prg) {
+		t.Errorf("got % X, want % X", got, test_prg)
+	}
+	d.close(0)
+
+	// tapes are read-only
+	d.open("NEW", 1)
+	if d.cmd.err != DOS_WRITE_PROTECT_ON {
+		t.Errorf("DOS status %d, want %d", d.cmd.err, DOS_WRITE_PROTECT_ON)
+	}
+}
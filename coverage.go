@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+/************************************************************
+ *
+ * Circuit Coverage
+ *
+ ************************************************************/
+
+/*
+ * Coverage is collected in recalcNode(): a node that changes has been
+ * seen at both levels, and a transistor that is switched has been both
+ * on and off. Once the chip has powered up, seed_coverage() records the
+ * level every node and transistor starts out at, so one that never
+ * changes still shows up as stuck at that level. A node is covered once
+ * it has been seen at both levels, and a transistor once it has been
+ * both on and off.
+ *
+ * recalcNode() only runs on the goroutine that drives the chip, so
+ * that goroutine records into its own chip_ bitmaps without locking,
+ * as the profiler does. The cov_ bitmaps hold the coverage of earlier
+ * runs loaded from files; collect_coverage() stops the chip and ORs
+ * its bitmaps into them before they are saved or reported.
+ *
+ * Coverage files are JSON dumps of these bitmaps. Loading a file ORs
+ * it into the current run, so pointing -coverage at the same file
+ * over a whole test suite accumulates coverage for the suite, and
+ * -coverage-merge combines the results of runs done in parallel.
+ */
+var (
+	covering		bool
+	coverage_mu	sync.Mutex		// guards the cov_ bitmaps
+	cov_node_high	= DECLARE_BITMAP(NODES)
+	cov_node_low	= DECLARE_BITMAP(NODES)
+	cov_trans_on	= DECLARE_BITMAP(TRANSISTORS)
+	cov_trans_off	= DECLARE_BITMAP(TRANSISTORS)
+
+	// only touched by the goroutine driving the chip
+	chip_node_high	= DECLARE_BITMAP(NODES)
+	chip_node_low	= DECLARE_BITMAP(NODES)
+	chip_trans_on	= DECLARE_BITMAP(TRANSISTORS)
+	chip_trans_off	= DECLARE_BITMAP(TRANSISTORS)
+)
+
+var (
+	coverage_file = flag.String("coverage", "", "accumulate node/transistor coverage in `file` (created if it does not exist)")
+	coverage_report = flag.String("coverage-report", "", "write a report of never-exercised circuitry to `file` on exit (- for stderr)")
+	coverage_merge string_list
+)
+
+func init() {
+	flag.Var(&coverage_merge, "coverage-merge", "merge the coverage `file` from another run (may be repeated)")
+}
+
+func init_coverage() {
+	if *coverage_file == "" && *coverage_report == "" {
+		return
+	}
+	if *coverage_file != "" {
+		err := load_coverage(*coverage_file)
+		if err != nil && !os.IsNotExist(err) {
+			fatalf("error loading coverage: %v", err)
+		}
+	}
+	for _, f := range coverage_merge {
+		if err := load_coverage(f); err != nil {
+			fatalf("error merging coverage: %v", err)
+		}
+	}
+	covering = true
+	at_exit(func() {
+		collect_coverage()
+		if *coverage_file != "" {
+			if err := save_coverage(*coverage_file); err != nil {
+				fmt.Fprintf(os.Stderr, "error saving coverage: %v\n", err)
+			}
+		}
+		if *coverage_report != "" {
+			if err := write_coverage_report_file(*coverage_report); err != nil {
+				fmt.Fprintf(os.Stderr, "error writing coverage report: %v\n", err)
+			}
+		}
+	})
+}
+
+// coverage_node records a change of node's level
+func coverage_node(node uint64) {
+	set_bitmap(chip_node_high, node, true)
+	set_bitmap(chip_node_low, node, true)
+}
+
+// coverage_transistor records that t was switched
+func coverage_transistor(t uint64) {
+	set_bitmap(chip_trans_on, t, true)
+	set_bitmap(chip_trans_off, t, true)
+}
+
+/* seed_coverage records the current level of every node and transistor; on the goroutine driving the chip */
+func seed_coverage() {
+	for nn := uint64(0); nn < NODES; nn++ {
+		if get_nodes_value(nn) == high {
+			set_bitmap(chip_node_high, nn, true)
+		} else {
+			set_bitmap(chip_node_low, nn, true)
+		}
+	}
+	for tn := uint64(0); tn < uint64(transistors); tn++ {
+		if transistor_state(tn) == on {
+			set_bitmap(chip_trans_on, tn, true)
+		} else {
+			set_bitmap(chip_trans_off, tn, true)
+		}
+	}
+}
+
+/* merge_chip_coverage ORs what the chip has recorded into the cov_ bitmaps */
+func merge_chip_coverage() {
+	coverage_mu.Lock()
+	defer coverage_mu.Unlock()
+	for i := range chip_node_high {
+		cov_node_high[i] |= chip_node_high[i]
+		cov_node_low[i] |= chip_node_low[i]
+	}
+	for i := range chip_trans_on {
+		cov_trans_on[i] |= chip_trans_on[i]
+		cov_trans_off[i] |= chip_trans_off[i]
+	}
+}
+
+/* collect_coverage stops the chip so its bitmaps can be merged from any goroutine */
+func collect_coverage() {
+	stop_chip()
+	merge_chip_coverage()
+}
+
+type coverage_json struct {
+	Nodes		uint64		`json:"nodes"`
+	Transistors	uint64		`json:"transistors"`
+	NodeHigh		[]bitmap_t	`json:"node_high"`
+	NodeLow		[]bitmap_t	`json:"node_low"`
+	TransOn		[]bitmap_t	`json:"transistor_on"`
+	TransOff		[]bitmap_t	`json:"transistor_off"`
+}
+
+func load_coverage(filename string) error {
+	var cj coverage_json
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(&cj); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if cj.Nodes != NODES || cj.Transistors != TRANSISTORS ||
+		len(cj.NodeHigh) != len(cov_node_high) || len(cj.NodeLow) != len(cov_node_low) ||
+		len(cj.TransOn) != len(cov_trans_on) || len(cj.TransOff) != len(cov_trans_off) {
+		return fmt.Errorf("%s: coverage is for a different netlist (%d nodes, %d transistors)",
+			filename, cj.Nodes, cj.Transistors)
+	}
+
+	coverage_mu.Lock()
+	defer coverage_mu.Unlock()
+	for i := range cj.NodeHigh {
+		cov_node_high[i] |= cj.NodeHigh[i]
+		cov_node_low[i] |= cj.NodeLow[i]
+	}
+	for i := range cj.TransOn {
+		cov_trans_on[i] |= cj.TransOn[i]
+		cov_trans_off[i] |= cj.TransOff[i]
+	}
+	return nil
+}
+
+func save_coverage(filename string) error {
+	coverage_mu.Lock()
+	cj := coverage_json{
+		Nodes:		NODES,
+		Transistors:	TRANSISTORS,
+		NodeHigh:		cov_node_high,
+		NodeLow:		cov_node_low,
+		TransOn:		cov_trans_on,
+		TransOff:		cov_trans_off,
+	}
+	b, err := json.Marshal(cj)
+	coverage_mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+// nodes that are not connected to any transistor are not part of the circuit
+func node_in_circuit(nn uint64) bool {
+	if nn == vss || nn == vcc {
+		return false
+	}
+	return nodes_gatecount[nn] != 0 || nodes_c1c2count[nn] != 0
+}
+
+func write_coverage_report_file(filename string) error {
+	if filename == "-" {
+		return write_coverage_report(os.Stderr)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write_coverage_report(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func write_coverage_report(w io.Writer) error {
+	var never_nodes, stuck_high, stuck_low []uint64
+	var never_trans, stuck_on, stuck_off []uint64
+	var total_nodes, covered_nodes uint64
+
+	coverage_mu.Lock()
+	for nn := uint64(0); nn < NODES; nn++ {
+		if !node_in_circuit(nn) {
+			continue
+		}
+		total_nodes++
+		hi := get_bitmap(cov_node_high, nn)
+		lo := get_bitmap(cov_node_low, nn)
+		switch {
+		case hi && lo:
+			covered_nodes++
+		case hi:
+			stuck_high = append(stuck_high, nn)
+		case lo:
+			stuck_low = append(stuck_low, nn)
+		default:
+			never_nodes = append(never_nodes, nn)
+		}
+	}
+	covered_trans := uint64(0)
+	for tn := uint64(0); tn < uint64(transistors); tn++ {
+		ton := get_bitmap(cov_trans_on, tn)
+		toff := get_bitmap(cov_trans_off, tn)
+		switch {
+		case ton && toff:
+			covered_trans++
+		case ton:
+			stuck_on = append(stuck_on, tn)
+		case toff:
+			stuck_off = append(stuck_off, tn)
+		default:
+			never_trans = append(never_trans, tn)
+		}
+	}
+	coverage_mu.Unlock()
+
+	percent := func(n, total uint64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(total)
+	}
+
+	ew := &err_writer{w: w}
+	ew.printf("nodes toggled:                %d/%d (%.1f%%)\n",
+		covered_nodes, total_nodes, percent(covered_nodes, total_nodes))
+	ew.printf("transistors switched on/off:  %d/%d (%.1f%%)\n",
+		covered_trans, uint64(transistors), percent(covered_trans, uint64(transistors)))
+
+	node_list := func(title string, list []uint64) {
+		ew.printf("\n%s (%d):\n", title, len(list))
+		for _, nn := range list {
+			ew.printf("\t%s\n", node_name(nn))
+		}
+	}
+	trans_list := func(title string, list []uint64) {
+		ew.printf("\n%s (%d):\n", title, len(list))
+		for _, tn := range list {
+			ew.printf("\tt%d\tgate %s\tc1 %s\tc2 %s\n", tn,
+				node_name(transistors_gate[tn]),
+				node_name(transistors_c1[tn]),
+				node_name(transistors_c2[tn]))
+		}
+	}
+	node_list("nodes never changed", never_nodes)
+	node_list("nodes never low", stuck_high)
+	node_list("nodes never high", stuck_low)
+	trans_list("transistors never switched", never_trans)
+	trans_list("transistors never off", stuck_on)
+	trans_list("transistors never on", stuck_off)
+	return ew.err
+}
+
+// err_writer remembers the first write error so a report can be written without checking every line
+type err_writer struct {
+	w	io.Writer
+	err	error
+}
+
+func (ew *err_writer) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
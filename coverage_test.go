@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// with_coverage runs f with empty coverage and the chip's state restored afterwards
+func with_coverage(f func()) {
+	saved := [][]bitmap_t{ nodes_value, transistors_on, cov_node_high, cov_node_low, cov_trans_on, cov_trans_off,
+		chip_node_high, chip_node_low, chip_trans_on, chip_trans_off }
+	copies := make([][]bitmap_t, len(saved))
+	for i := range saved {
+		copies[i] = append([]bitmap_t(nil), saved[i]...)
+	}
+	defer func() {
+		for i := range saved {
+			copy(saved[i], copies[i])
+		}
+		covering = false
+	}()
+	for _, b := range saved[2:] {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	f()
+}
+
+func TestCoverageSeed(t *testing.T) {
+	with_coverage(func() {
+		covering = true
+		power_up()
+		merge_chip_coverage()		// no chiploop to stop here
+
+		// RESET is held low at power-up; releasing it is a change
+		if !get_bitmap(cov_node_low, res) || get_bitmap(cov_node_high, res) {
+			t.Errorf("res after power-up: low %v, high %v", get_bitmap(cov_node_low, res), get_bitmap(cov_node_high, res))
+		}
+		if !get_bitmap(cov_node_high, irq) || get_bitmap(cov_node_low, irq) {
+			t.Errorf("irq is not seeded high only")
+		}
+		setNode(res, high)
+		if get_bitmap(cov_node_high, res) {
+			t.Errorf("res recorded outside the chip's bitmaps")
+		}
+		merge_chip_coverage()
+		if !get_bitmap(cov_node_low, res) || !get_bitmap(cov_node_high, res) {
+			t.Errorf("res after the change: low %v, high %v", get_bitmap(cov_node_low, res), get_bitmap(cov_node_high, res))
+		}
+		for tn := uint64(0); tn < nodes_gatecount[res]; tn++ {
+			tr := nodes_gates[res][tn]
+			if !get_bitmap(cov_trans_on, tr) || !get_bitmap(cov_trans_off, tr) {
+				t.Errorf("transistor %d at res's gate is not covered", tr)
+			}
+		}
+	})
+}
+
+func TestLoadCoverage(t *testing.T) {
+	with_coverage(func() {
+		set_bitmap(cov_node_high, 100, true)
+		set_bitmap(cov_trans_on, 7, true)
+
+		other := coverage_json{
+			Nodes:		NODES,
+			Transistors:	TRANSISTORS,
+			NodeHigh:		DECLARE_BITMAP(NODES),
+			NodeLow:		DECLARE_BITMAP(NODES),
+			TransOn:		DECLARE_BITMAP(TRANSISTORS),
+			TransOff:		DECLARE_BITMAP(TRANSISTORS),
+		}
+		set_bitmap(other.NodeLow, 100, true)
+		set_bitmap(other.NodeHigh, 200, true)
+		set_bitmap(other.TransOff, 7, true)
+		b, _ := json.Marshal(other)
+		name := filepath.Join(t.TempDir(), "cov.json")
+		if err := ioutil.WriteFile(name, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := load_coverage(name); err != nil {
+			t.Fatal(err)
+		}
+		if !get_bitmap(cov_node_high, 100) || !get_bitmap(cov_node_low, 100) || !get_bitmap(cov_node_high, 200) ||
+			get_bitmap(cov_node_low, 200) || !get_bitmap(cov_trans_on, 7) || !get_bitmap(cov_trans_off, 7) {
+			t.Errorf("coverage was not merged")
+		}
+
+		other.Nodes = 42
+		b, _ = json.Marshal(other)
+		ioutil.WriteFile(name, b, 0644)
+		if err := load_coverage(name); err == nil {
+			t.Errorf("coverage of another netlist loaded")
+		}
+		if err := load_coverage(filepath.Join(t.TempDir(), "none")); !os.IsNotExist(err) {
+			t.Errorf("missing file: got %v", err)
+		}
+	})
+}
+
+func TestCoverageReport(t *testing.T) {
+	with_coverage(func() {
+		setupNodesAndTransistors()
+		var in_circuit []uint64
+		for nn := uint64(0); nn < NODES; nn++ {
+			if node_in_circuit(nn) {
+				in_circuit = append(in_circuit, nn)
+			}
+		}
+		a, b := in_circuit[0], in_circuit[1]
+		set_bitmap(cov_node_high, a, true)
+		set_bitmap(cov_node_low, a, true)
+		set_bitmap(cov_node_high, b, true)
+		set_bitmap(cov_trans_on, 0, true)
+		set_bitmap(cov_trans_off, 0, true)
+		set_bitmap(cov_trans_off, 1, true)
+
+		var buf bytes.Buffer
+		if err := write_coverage_report(&buf); err != nil {
+			t.Fatal(err)
+		}
+		report := buf.String()
+		for _, want := range []string{
+			fmt.Sprintf("nodes toggled:                1/%d (", len(in_circuit)),
+			fmt.Sprintf("transistors switched on/off:  1/%d (", transistors),
+			fmt.Sprintf("nodes never low (1):\n\t%s\n", node_name(b)),
+			"nodes never high (0):\n",
+			fmt.Sprintf("transistors never on (1):\n\tt1\tgate %s\t", node_name(transistors_gate[1])),
+			"transistors never off (0):\n",
+		} {
+			if !strings.Contains(report, want) {
+				t.Errorf("report lacks %q", want)
+			}
+		}
+		if strings.Contains(report, "\t" + node_name(a) + "\n") {
+			t.Errorf("covered node %s is listed", node_name(a))
+		}
+	})
+}
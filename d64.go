@@ -0,0 +1,959 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+/************************************************************
+ *
+ * Disk Images
+ *
+ ************************************************************/
+
+/*
+ * D64 (1541), D71 (1571) and D81 (1581) images are the disk's sectors
+ * in order, 256 bytes each, starting with sector 0 of track 1; tracks
+ * and sectors are numbered like the drive does. Some images have a byte
+ * per sector of read error codes after the sectors; it is kept as is.
+ *
+ * Every file is a chain of sectors: the first two bytes of a sector
+ * are the track and sector of the next one, or 0 and the index of the
+ * last byte used in the last sector. The directory is such a chain on
+ * the directory track, with eight 32-byte entries per sector, and the
+ * header sector (the first directory sector on the 1581) holds the disk
+ * name and ID and the BAM, which has a free count and a bitmap per track.
+ */
+type image_format struct {
+	ext			string
+	tracks		int
+	sectors		func(track int) int
+	dir_track		int
+	header_sector	int		// disk name and ID
+	name_offset	int
+	id_offset		int		// ID, a shifted space and the DOS type
+	dir_sector		int		// first directory sector
+	interleave		int
+}
+
+func d64_sectors(track int) int {
+	switch {
+	case track <= 17:
+		return 21
+	case track <= 24:
+		return 19
+	case track <= 30:
+		return 18
+	}
+	return 17
+}
+
+var (
+	format_d64 = &image_format{
+		ext:			"d64",
+		tracks:		35,
+		sectors:		d64_sectors,
+		dir_track:		18,
+		header_sector:	0,
+		name_offset:	0x90,
+		id_offset:		0xA2,
+		dir_sector:		1,
+		interleave:		10,
+	}
+	format_d64_40 = &image_format{		// only tracks 1 to 35 are in the BAM
+		ext:			"d64",
+		tracks:		40,
+		sectors:		d64_sectors,
+		dir_track:		18,
+		header_sector:	0,
+		name_offset:	0x90,
+		id_offset:		0xA2,
+		dir_sector:		1,
+		interleave:		10,
+	}
+	format_d71 = &image_format{
+		ext:			"d71",
+		tracks:		70,
+		sectors:		func(track int) int {
+			if track > 35 {
+				track -= 35
+			}
+			return d64_sectors(track)
+		},
+		dir_track:		18,
+		header_sector:	0,
+		name_offset:	0x90,
+		id_offset:		0xA2,
+		dir_sector:		1,
+		interleave:		6,
+	}
+	format_d81 = &image_format{
+		ext:			"d81",
+		tracks:		80,
+		sectors:		func(track int) int {
+			return 40
+		},
+		dir_track:		40,
+		header_sector:	0,
+		name_offset:	0x04,
+		id_offset:		0x16,
+		dir_sector:		3,
+		interleave:		1,
+	}
+)
+
+// image sizes, with and without error bytes
+var image_sizes = map[int]*image_format{
+	174848:	format_d64,
+	175531:	format_d64,
+	196608:	format_d64_40,
+	197376:	format_d64_40,
+	349696:	format_d71,
+	351062:	format_d71,
+	819200:	format_d81,
+}
+
+type disk_image struct {
+	filename	string
+	format	*image_format
+	data		[]byte
+	offsets	[]int		// of the first sector of each track, indexed from 1
+	readonly	bool
+}
+
+func open_disk_image(filename string) (*disk_image, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	format := image_sizes[len(data)]
+	if format == nil {
+		return nil, fmt.Errorf("%s: not a D64, D71 or D81 image (%d bytes)", filename, len(data))
+	}
+	img := &disk_image{
+		filename:	filename,
+		format:	format,
+		data:		data,
+		offsets:	make([]int, format.tracks + 2),
+	}
+	for t := 1; t <= format.tracks; t++ {
+		img.offsets[t + 1] = img.offsets[t] + format.sectors(t) * 256
+	}
+	// a read-only image can still be read
+	if f, err := os.OpenFile(filename, os.O_WRONLY, 0); err != nil {
+		img.readonly = true
+	} else {
+		f.Close()
+	}
+	return img, nil
+}
+
+func (img *disk_image) flush() error {
+	return ioutil.WriteFile(img.filename, img.data, 0644)
+}
+
+// sector returns the 256 bytes of track t, sector s, or nil if there is no such sector.
+func (img *disk_image) sector(t int, s int) []byte {
+	if t < 1 || t > img.format.tracks || s < 0 || s >= img.format.sectors(t) {
+		return nil
+	}
+	off := img.offsets[t] + s * 256
+	return img.data[off:off + 256]
+}
+
+func (img *disk_image) total_sectors() int {
+	return img.offsets[img.format.tracks + 1] / 256
+}
+
+func (img *disk_image) header() []byte {
+	return img.sector(img.format.dir_track, img.format.header_sector)
+}
+
+/************************************************************
+ * Block Availability Map
+ ************************************************************/
+
+// bam returns the free sector count and bitmap of track t, or nil if the track is not in the BAM.
+func (img *disk_image) bam(t int) (free *byte, bits []byte) {
+	switch img.format {
+	case format_d64, format_d64_40:
+		if t > 35 {
+			return nil, nil
+		}
+		b := img.sector(18, 0)
+		return &b[4 * t], b[4 * t + 1:4 * t + 4]
+	case format_d71:
+		if t <= 35 {
+			b := img.sector(18, 0)
+			return &b[4 * t], b[4 * t + 1:4 * t + 4]
+		}
+		b := img.sector(18, 0)
+		b2 := img.sector(53, 0)
+		return &b[0xDD + t - 36], b2[3 * (t - 36):3 * (t - 36) + 3]
+	case format_d81:
+		b := img.sector(40, 1)
+		if t > 40 {
+			b = img.sector(40, 2)
+			t -= 40
+		}
+		off := 0x10 + 6 * (t - 1)
+		return &b[off], b[off + 1:off + 6]
+	}
+	return nil, nil
+}
+
+func (img *disk_image) is_free(t int, s int) bool {
+	_, bits := img.bam(t)
+	if bits == nil {
+		return false
+	}
+	return bits[s / 8] & (1 << uint(s % 8)) != 0
+}
+
+func (img *disk_image) allocate(t int, s int) {
+	free, bits := img.bam(t)
+	if bits != nil && img.is_free(t, s) {
+		bits[s / 8] &^= 1 << uint(s % 8)
+		*free--
+	}
+}
+
+func (img *disk_image) release(t int, s int) {
+	free, bits := img.bam(t)
+	if bits != nil && !img.is_free(t, s) {
+		bits[s / 8] |= 1 << uint(s % 8)
+		*free++
+	}
+}
+
+// blocks free, as the directory shows it: the directory track does not count
+func (img *disk_image) blocks_free() int {
+	n := 0
+	for t := 1; t <= img.format.tracks; t++ {
+		if t == img.format.dir_track || (img.format == format_d71 && t == 53) {
+			continue
+		}
+		if free, _ := img.bam(t); free != nil {
+			n += int(*free)
+		}
+	}
+	return n
+}
+
+func (img *disk_image) free_on_track(t int, from int, interleave int) (int, bool) {
+	n := img.format.sectors(t)
+	for i := 0; i < n; i++ {
+		s := (from + interleave + i) % n
+		if img.is_free(t, s) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ * next_free finds the sector to put after track t, sector s of a file
+ * (t is 0 for the first sector): on the same track if there's room,
+ * otherwise on the free track closest to the directory, like the drive.
+ */
+func (img *disk_image) next_free(t int, s int) (int, int, bool) {
+	if t != 0 {
+		if s, ok := img.free_on_track(t, s, img.format.interleave); ok {
+			return t, s, true
+		}
+	}
+	dir := img.format.dir_track
+	for dist := 1; dist < img.format.tracks; dist++ {
+		for _, t := range []int{ dir - dist, dir + dist } {
+			if t < 1 || t > img.format.tracks || (img.format == format_d71 && t == 53) {
+				continue
+			}
+			if s, ok := img.free_on_track(t, 0, 0); ok {
+				return t, s, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+/************************************************************
+ * Directory
+ ************************************************************/
+
+const (
+	DIR_ENTRY_SIZE = 32
+
+	FTYPE_DEL = 0
+	FTYPE_SEQ = 1
+	FTYPE_PRG = 2
+	FTYPE_USR = 3
+	FTYPE_REL = 4
+	FTYPE_CBM = 5		// 1581 partitions
+	FTYPE_LOCKED = 0x40
+	FTYPE_CLOSED = 0x80
+)
+
+var ftype_names = []string{ "DEL", "SEQ", "PRG", "USR", "REL", "CBM", "???", "???" }
+
+// the letters a file name can use to ask for a type, as in "NAME,S"
+var ftype_letters = map[byte]byte{
+	'S':	FTYPE_SEQ,
+	'P':	FTYPE_PRG,
+	'U':	FTYPE_USR,
+	'L':	FTYPE_REL,
+}
+
+// names are padded with shifted spaces
+func pad_name(name string) []byte {
+	b := bytes.Repeat([]byte{ 0xA0 }, 16)
+	copy(b, name)
+	return b
+}
+
+func unpad_name(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0xA0); i != -1 {
+		return b[:i]
+	}
+	return b
+}
+
+/* Commodore DOS wildcards: ? matches any character, * the rest of the name */
+func dos_match(pattern []byte, name []byte) bool {
+	for i, c := range pattern {
+		if c == '*' {
+			return true
+		}
+		if i >= len(name) || (c != '?' && c != name[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(name)
+}
+
+/*
+ * walk_dir calls f with every directory entry, used or not, until f
+ * returns false; it returns the track and sector of the last directory
+ * sector, so a new one can be linked in. Chains are followed at most
+ * once around the disk so a broken image can't hang us.
+ */
+func (img *disk_image) walk_dir(f func(e []byte) bool) (int, int) {
+	t, s := img.format.dir_track, img.format.dir_sector
+	for n := 0; n < img.total_sectors(); n++ {
+		b := img.sector(t, s)
+		if b == nil {
+			break
+		}
+		for i := 0; i < 256; i += DIR_ENTRY_SIZE {
+			if !f(b[i:i + DIR_ENTRY_SIZE]) {
+				return t, s
+			}
+		}
+		if b[0] == 0 {
+			break
+		}
+		t, s = int(b[0]), int(b[1])
+	}
+	return t, s
+}
+
+// find_file returns the directory entry of the first closed file matching pattern and, if not 0, ftype.
+func (img *disk_image) find_file(pattern string, ftype byte) []byte {
+	var found []byte
+
+	img.walk_dir(func(e []byte) bool {
+		if e[2] & FTYPE_CLOSED == 0 || (ftype != 0 && e[2] & 7 != ftype) {
+			return true
+		}
+		if dos_match([]byte(pattern), unpad_name(e[5:21])) {
+			found = e
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func (img *disk_image) listing(pattern string) []byte {
+	h := img.header()
+	l := new_listing()
+	id := h[img.format.id_offset:img.format.id_offset + 5]
+	l.header(string(unpad_name(h[img.format.name_offset:img.format.name_offset + 16])),
+		string(bytes.Replace(id, []byte{ 0xA0 }, []byte{ ' ' }, -1)))
+	img.walk_dir(func(e []byte) bool {
+		if e[2] == 0 {
+			return true
+		}
+		name := unpad_name(e[5:21])
+		if pattern != "" && !dos_match([]byte(pattern), name) {
+			return true
+		}
+		ftype := ftype_names[e[2] & 7]
+		if e[2] & FTYPE_CLOSED == 0 {
+			ftype = "*" + ftype
+		}
+		if e[2] & FTYPE_LOCKED != 0 {
+			ftype += "<"
+		}
+		l.entry(int(e[28]) | int(e[29]) << 8, string(name), ftype)
+		return true
+	})
+	l.blocks_free(img.blocks_free())
+	return l.bytes()
+}
+
+/************************************************************
+ * Files
+ ************************************************************/
+
+func (img *disk_image) read_file(e []byte) ([]byte, error) {
+	var data []byte
+
+	t, s := int(e[3]), int(e[4])
+	for n := 0; n < img.total_sectors(); n++ {
+		b := img.sector(t, s)
+		if b == nil {
+			return nil, fmt.Errorf("illegal track or sector %d/%d", t, s)
+		}
+		if b[0] == 0 {
+			last := int(b[1])
+			if last < 1 {
+				last = 1
+			}
+			return append(data, b[2:last + 1]...), nil
+		}
+		data = append(data, b[2:]...)
+		t, s = int(b[0]), int(b[1])
+	}
+	return nil, fmt.Errorf("sector chain loops")
+}
+
+// delete_file frees the sectors of a file and marks its entry unused.
+func (img *disk_image) delete_file(e []byte) {
+	t, s := int(e[3]), int(e[4])
+	for n := 0; n < img.total_sectors(); n++ {
+		b := img.sector(t, s)
+		if b == nil || img.is_free(t, s) {
+			break
+		}
+		img.release(t, s)
+		if b[0] == 0 {
+			break
+		}
+		t, s = int(b[0]), int(b[1])
+	}
+	e[2] = FTYPE_DEL
+}
+
+// free_entry returns an unused directory entry, adding a directory sector if necessary.
+func (img *disk_image) free_entry() []byte {
+	var found []byte
+
+	t, s := img.walk_dir(func(e []byte) bool {
+		if e[2] == 0 {
+			found = e
+			return false
+		}
+		return true
+	})
+	if found != nil {
+		return found
+	}
+	ns, ok := img.free_on_track(img.format.dir_track, s, 3)
+	if !ok {
+		return nil
+	}
+	img.allocate(img.format.dir_track, ns)
+	last := img.sector(t, s)
+	last[0], last[1] = byte(img.format.dir_track), byte(ns)
+	b := img.sector(img.format.dir_track, ns)
+	for i := range b {
+		b[i] = 0
+	}
+	b[1] = 0xFF
+	return b[:DIR_ENTRY_SIZE]
+}
+
+/*
+ * write_file stores data as a new file, replacing the file in e if
+ * that isn't nil. If the disk is full, it is left as it was.
+ */
+func (img *disk_image) write_file(name string, ftype byte, data []byte, e []byte) byte {
+	saved := append([]byte(nil), img.data...)
+	if e != nil {
+		img.delete_file(e)
+	} else if e = img.free_entry(); e == nil {
+		copy(img.data, saved)
+		return DOS_DISK_FULL
+	}
+
+	t, s := 0, 0
+	first_t, first_s := 0, 0
+	blocks := 0
+	var prev []byte
+	for len(data) > 0 || blocks == 0 {
+		var ok bool
+
+		t, s, ok = img.next_free(t, s)
+		if !ok {
+			copy(img.data, saved)
+			return DOS_DISK_FULL
+		}
+		img.allocate(t, s)
+		if prev == nil {
+			first_t, first_s = t, s
+		} else {
+			prev[0], prev[1] = byte(t), byte(s)
+		}
+		b := img.sector(t, s)
+		n := copy(b[2:], data)
+		data = data[n:]
+		b[0], b[1] = 0, byte(n + 1)
+		for i := n + 2; i < 256; i++ {
+			b[i] = 0
+		}
+		prev = b
+		blocks++
+	}
+
+	e[2] = FTYPE_CLOSED | ftype
+	e[3], e[4] = byte(first_t), byte(first_s)
+	copy(e[5:21], pad_name(name))
+	for i := 21; i < 28; i++ {
+		e[i] = 0
+	}
+	e[28], e[29] = byte(blocks & 0xFF), byte(blocks >> 8)
+	return DOS_OK
+}
+
+/************************************************************
+ * Formatting and Validating
+ ************************************************************/
+
+// system_sectors are the header and BAM sectors, which are always in use.
+func (img *disk_image) system_sectors() [][2]int {
+	switch img.format {
+	case format_d71:
+		s := [][2]int{ { 18, 0 } }
+		for i := 0; i < img.format.sectors(53); i++ {
+			s = append(s, [2]int{ 53, i })
+		}
+		return s
+	case format_d81:
+		return [][2]int{ { 40, 0 }, { 40, 1 }, { 40, 2 } }
+	}
+	return [][2]int{ { 18, 0 } }
+}
+
+// clear_bam marks everything but the system sectors free.
+func (img *disk_image) clear_bam() {
+	for t := 1; t <= img.format.tracks; t++ {
+		free, bits := img.bam(t)
+		if bits == nil {
+			continue
+		}
+		for i := range bits {
+			bits[i] = 0
+		}
+		*free = 0
+		for s := 0; s < img.format.sectors(t); s++ {
+			img.release(t, s)
+		}
+	}
+	for _, ts := range img.system_sectors() {
+		img.allocate(ts[0], ts[1])
+	}
+}
+
+/*
+ * format_disk is the N command: it gives the disk a new name and
+ * empties it. With an ID, the whole disk is cleared first, like a
+ * full format; without, the old ID is kept.
+ */
+func (img *disk_image) format_disk(name string, id string) {
+	f := img.format
+	h := img.header()
+	oldid := append([]byte(nil), h[f.id_offset:f.id_offset + 2]...)
+	if id != "" {
+		size := img.offsets[f.tracks + 1]
+		for i := range img.data[:size] {
+			img.data[i] = 0
+		}
+		oldid = []byte{ 0xA0, 0xA0 }
+		copy(oldid, id)
+	}
+
+	// header: link to the directory, DOS version, name, ID and DOS type
+	for i := range h {
+		h[i] = 0
+	}
+	h[0], h[1] = byte(f.dir_track), byte(f.dir_sector)
+	dostype := "2A"
+	h[2] = 'A'
+	switch f {
+	case format_d71:
+		h[3] = 0x80		// double-sided
+	case format_d81:
+		h[2] = 'D'
+		dostype = "3D"
+	}
+	copy(h[f.name_offset:], pad_name(name))
+	copy(h[f.name_offset + 16:f.name_offset + 27], bytes.Repeat([]byte{ 0xA0 }, 11))
+	copy(h[f.id_offset:], oldid)
+	copy(h[f.id_offset + 3:], dostype)
+	switch f {
+	case format_d71:
+		b := img.sector(53, 0)
+		for i := range b {
+			b[i] = 0
+		}
+	case format_d81:
+		for _, s := range []int{ 1, 2 } {
+			b := img.sector(40, s)
+			for i := range b {
+				b[i] = 0
+			}
+			b[2], b[3] = 'D', 'D' ^ 0xFF
+			copy(b[4:6], oldid)
+			b[6] = 0xC0
+		}
+		img.sector(40, 1)[0], img.sector(40, 1)[1] = 40, 2
+		img.sector(40, 2)[1] = 0xFF
+	}
+	img.clear_bam()
+
+	// and an empty directory
+	d := img.sector(f.dir_track, f.dir_sector)
+	for i := range d {
+		d[i] = 0
+	}
+	d[1] = 0xFF
+	img.allocate(f.dir_track, f.dir_sector)
+}
+
+/*
+ * validate is the V command: it rebuilds the BAM from the files in
+ * the directory, dropping files that were never closed.
+ */
+func (img *disk_image) validate() byte {
+	img.clear_bam()
+	t, s := img.format.dir_track, img.format.dir_sector
+	for n := 0; n < img.total_sectors(); n++ {
+		b := img.sector(t, s)
+		if b == nil {
+			return DOS_READ_ERROR
+		}
+		img.allocate(t, s)
+		if b[0] == 0 {
+			break
+		}
+		t, s = int(b[0]), int(b[1])
+	}
+	err := byte(DOS_OK)
+	img.walk_dir(func(e []byte) bool {
+		if e[2] == 0 {
+			return true
+		}
+		if e[2] & FTYPE_CLOSED == 0 {
+			e[2] = FTYPE_DEL
+			return true
+		}
+		t, s := int(e[3]), int(e[4])
+		for n := 0; n < img.total_sectors(); n++ {
+			b := img.sector(t, s)
+			if b == nil {
+				err = DOS_READ_ERROR
+				return false
+			}
+			img.allocate(t, s)
+			if b[0] == 0 {
+				break
+			}
+			t, s = int(b[0]), int(b[1])
+		}
+		return true
+	})
+	return err
+}
+
+/************************************************************
+ * Disk Image Drive
+ ************************************************************/
+
+/*
+ * An image drive serves the files of a disk image. Files are read
+ * whole when opened and written whole when closed, so a full disk
+ * leaves the image untouched instead of a half-written file. Like the
+ * real drive, opening a file that exists for writing (without @) or
+ * writing to a write-protected image does not fail the OPEN; the data
+ * goes nowhere and the drive's error status says what happened.
+ * Without a mode, only secondary address 1 (SAVE's) writes.
+ */
+type image_drive struct {
+	img		*disk_image
+	channels	map[byte]*disk_channel
+	cmd		command_channel
+}
+
+func new_image_drive(filename string) (*image_drive, error) {
+	img, err := open_disk_image(filename)
+	if err != nil {
+		return nil, err
+	}
+	d := &image_drive{
+		img:		img,
+		channels:	map[byte]*disk_channel{},
+	}
+	d.cmd = new_command_channel(d)
+	return d, nil
+}
+
+// image_writer collects what is written to a channel and stores it in the image on close.
+type image_writer struct {
+	d		*image_drive
+	name		string
+	ftype	byte
+	e		[]byte		// file to replace, if any
+	buf		bytes.Buffer
+}
+
+func (w *image_writer) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// a full disk is the drive's business, on the command channel; failing to write the image is ours
+func (w *image_writer) Close() error {
+	w.d.cmd.set(w.d.img.write_file(w.name, w.ftype, w.buf.Bytes(), w.e))
+	if w.d.cmd.err != DOS_OK {
+		return nil
+	}
+	return w.d.img.flush()
+}
+
+func (d *image_drive) open(name string, sec byte) byte {
+	if sec == DOS_COMMAND_CHANNEL {
+		d.cmd.open(name)
+		return KERN_ERR_NONE
+	}
+	d.close(sec)		// the drive reuses the channel
+
+	if name == "" {
+		return KERN_ERR_MISSING_FILE_NAME
+	}
+	d.cmd.set(DOS_OK)
+	if name[0] == '$' && sec == 0 {
+		pattern := ""
+		if i := bytes.IndexByte([]byte(name), ':'); i != -1 {
+			pattern = name[i+1:]
+		}
+		d.channels[sec] = new_read_channel(bytes.NewReader(d.img.listing(pattern)), nil)
+		return KERN_ERR_NONE
+	}
+
+	dn := parse_dos_name(name)
+	ftype := ftype_letters[dn.ftype]
+	mode := dn.mode
+	if mode == 0 {
+		mode = 'R'
+		if sec == 1 {
+			mode = 'W'
+		}
+	}
+
+	switch mode {
+	case 'R':
+		e := d.img.find_file(dn.name, ftype)
+		if e == nil {
+			d.cmd.set(DOS_FILE_NOT_FOUND)
+			return KERN_ERR_FILE_NOT_FOUND
+		}
+		data, err := d.img.read_file(e)
+		if err != nil {
+			d.cmd.set(DOS_READ_ERROR)
+			return KERN_ERR_FILE_NOT_FOUND
+		}
+		d.channels[sec] = new_read_channel(bytes.NewReader(data), nil)
+	case 'W', 'A':
+		if ftype == 0 {
+			ftype = FTYPE_SEQ
+			if sec <= 1 {
+				ftype = FTYPE_PRG
+			}
+		}
+		w := &image_writer{
+			d:		d,
+			name:	dn.name,
+			ftype:	ftype,
+		}
+		e := d.img.find_file(dn.name, 0)
+		switch {
+		case d.img.readonly:		// as on the host drive
+			d.cmd.set(DOS_WRITE_PROTECT_ON)
+			return KERN_ERR_DEVICE_NOT_PRESENT
+		case mode == 'A' && e == nil:
+			d.cmd.set(DOS_FILE_NOT_FOUND)
+		case mode == 'A':
+			data, err := d.img.read_file(e)
+			if err != nil {
+				d.cmd.set(DOS_READ_ERROR)
+				break
+			}
+			w.buf.Write(data)
+			w.ftype = e[2] & 7
+			w.e = e
+		case e != nil && !dn.replace:
+			d.cmd.set(DOS_FILE_EXISTS)
+		default:
+			w.e = e
+		}
+		if d.cmd.err != DOS_OK {
+			d.channels[sec] = new_write_channel(ioutil.Discard, nil)
+			return KERN_ERR_NONE
+		}
+		d.channels[sec] = new_write_channel(w, w)
+	}
+	return KERN_ERR_NONE
+}
+
+func (d *image_drive) close(sec byte) byte {
+	if sec == DOS_COMMAND_CHANNEL {
+		d.cmd.close()
+		return close_channels(d.channels)
+	}
+	return close_channel(d.channels, sec)
+}
+
+func (d *image_drive) read(sec byte) byte {
+	if sec == DOS_COMMAND_CHANNEL {
+		return d.cmd.read()
+	}
+	ch := d.channels[sec]
+	if ch == nil {
+		return 0
+	}
+	return ch.read()
+}
+
+func (d *image_drive) write(sec byte, c byte) {
+	if sec == DOS_COMMAND_CHANNEL {
+		d.cmd.write(c)
+		return
+	}
+	if ch := d.channels[sec]; ch != nil {
+		ch.write(c)
+	}
+}
+
+func (d *image_drive) status(sec byte) byte {
+	if sec == DOS_COMMAND_CHANNEL {
+		return d.cmd.st
+	}
+	ch := d.channels[sec]
+	if ch == nil {
+		return KERN_ST_EOF | KERN_ST_TIME_OUT_READ
+	}
+	return ch.st
+}
+
+func (d *image_drive) scratch(pattern string) (int, byte) {
+	if d.img.readonly {
+		return 0, DOS_WRITE_PROTECT_ON
+	}
+	n := 0
+	d.img.walk_dir(func(e []byte) bool {
+		if e[2] != 0 && e[2] & FTYPE_LOCKED == 0 && dos_match([]byte(pattern), unpad_name(e[5:21])) {
+			d.img.delete_file(e)
+			n++
+		}
+		return true
+	})
+	if n != 0 {
+		if d.img.flush() != nil {
+			return n, DOS_WRITE_PROTECT_ON
+		}
+	}
+	return n, DOS_OK
+}
+
+func (d *image_drive) rename(to string, from string) byte {
+	if d.img.readonly {
+		return DOS_WRITE_PROTECT_ON
+	}
+	if d.img.find_file(to, 0) != nil {
+		return DOS_FILE_EXISTS
+	}
+	e := d.img.find_file(from, 0)
+	if e == nil {
+		return DOS_FILE_NOT_FOUND
+	}
+	copy(e[5:21], pad_name(to))
+	return d.flush()
+}
+
+func (d *image_drive) copy_files(to string, from []string) byte {
+	var data []byte
+	var ftype byte
+
+	if d.img.readonly {
+		return DOS_WRITE_PROTECT_ON
+	}
+	if d.img.find_file(to, 0) != nil {
+		return DOS_FILE_EXISTS
+	}
+	for _, name := range from {
+		e := d.img.find_file(name, 0)
+		if e == nil {
+			return DOS_FILE_NOT_FOUND
+		}
+		if ftype == 0 {
+			ftype = e[2] & 7
+		}
+		b, err := d.img.read_file(e)
+		if err != nil {
+			return DOS_READ_ERROR
+		}
+		data = append(data, b...)
+	}
+	if err := d.img.write_file(to, ftype, data, nil); err != DOS_OK {
+		return err
+	}
+	return d.flush()
+}
+
+// initializing rereads the image, in case something else changed it; a read-only drive stays read-only
+func (d *image_drive) initialize() byte {
+	img, err := open_disk_image(d.img.filename)
+	if err != nil {
+		return DOS_READ_ERROR
+	}
+	img.readonly = img.readonly || d.img.readonly
+	d.img = img
+	return DOS_OK
+}
+
+func (d *image_drive) validate() byte {
+	if d.img.readonly {
+		return DOS_WRITE_PROTECT_ON
+	}
+	if err := d.img.validate(); err != DOS_OK {
+		return err
+	}
+	return d.flush()
+}
+
+func (d *image_drive) format(name string, id string) byte {
+	if d.img.readonly {
+		return DOS_WRITE_PROTECT_ON
+	}
+	d.img.format_disk(name, id)
+	return d.flush()
+}
+
+func (d *image_drive) flush() byte {
+	if err := d.img.flush(); err != nil {
+		host_error(err)
+		return DOS_WRITE_PROTECT_ON
+	}
+	return DOS_OK
+}
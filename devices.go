@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/************************************************************
+ *
+ * Devices
+ *
+ ************************************************************/
+
+/*
+ * Every KERNAL logical file is opened on a device, selected by its
+ * Commodore device number, and a secondary address, which the device
+ * can use to tell several open channels apart (like the disk drive
+ * does) or ignore (like the screen does).
+ *
+ * open returns KERN_ERR_NONE or the KERNAL error to return in A.
+ * read and write transfer one byte; afterwards, status returns the
+ * KERN_ST_ bits the KERNAL ORs into ST for that channel, so a read
+ * that returns the last byte of a file has KERN_ST_EOF set, and a
+ * read with nothing left to read has KERN_ST_EOF | KERN_ST_TIME_OUT_READ.
+ * close returns the KERN_ST_ bits of writing out what was left.
+ *
+ * Host I/O errors are logged with host_error and show up as
+ * KERN_ST_READ_ERROR on reads and KERN_ST_DEVICE_NOT_PRESENT on writes;
+ * if the host can't open a file for some other reason than it not
+ * being there, open returns KERN_ERR_DEVICE_NOT_PRESENT.
+ */
+type device interface {
+	open(name string, sec byte) byte
+	close(sec byte) byte
+	read(sec byte) byte
+	write(sec byte, c byte)
+	status(sec byte) byte
+}
+
+const (
+	DEV_KEYBOARD = 0
+	DEV_DATASETTE = 1
+	DEV_RS232 = 2
+	DEV_SCREEN = 3
+	DEV_PRINTER = 4
+	DEV_DISK = 8
+	DEV_MAX = 30		// serial bus devices go up to 30
+)
+
+var devices = map[byte]device{}
+
+func register_device(num byte, dev device) {
+	devices[num] = dev
+}
+
+// find_device returns the device with number num, or the KERNAL error if there is none.
+func find_device(num byte) (device, byte) {
+	if num > DEV_MAX {
+		return nil, KERN_ERR_ILLEGAL_DEVICE_NUMBER
+	}
+	dev := devices[num]
+	if dev == nil {
+		return nil, KERN_ERR_DEVICE_NOT_PRESENT
+	}
+	return dev, KERN_ERR_NONE
+}
+
+var (
+	printer_file = flag.String("printer", "printer.txt", "append output to printer device 4 to `file` (empty for no printer)")
+	disk_dirs [4]*string
+
+	screen_charset_flag = flag.String("charset", "upper", "screen and keyboard `charset`: upper (upper case and graphics), lower (lower and upper case) or none (raw bytes)")
+	printer_charset_flag = flag.String("printer-charset", "upper", "`charset` of printer output; secondary address 7 selects lower case, like on the MPS 801")
+	filename_charset_flag = flag.String("filename-charset", "lower", "`charset` for host file names on host directory drives, so \"FOO\" is foo")
+)
+
+// the character set of the screen, which CHR$(14) and CHR$(142) switch
+var screen_charset = CHARSET_UPPER
+
+func must_charset(s string) charset {
+	cs, err := parse_charset(s)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return cs
+}
+
+func init() {
+	for i := range disk_dirs {
+		def := ""
+		if i == 0 {
+			def = "."
+		}
+		disk_dirs[i] = flag.String(fmt.Sprintf("disk%d", DEV_DISK + i), def,
+			fmt.Sprintf("host `directory`, D64/D71/D81 image, T64 archive or mem: (an empty in-memory directory) for disk drive %d (empty for none); BASIC can't get out of the directory", DEV_DISK + i))
+	}
+}
+
+/*
+ * The default device setup: the keyboard and screen, a printer, and a
+ * disk drive showing the current directory (or a disk image, with
+ * -disk8 game.d64). cbmbasic has always loaded
+ * and saved host files without a device number, so the datasette
+ * (device 1, BASIC's default) is the first disk drive as well.
+ */
+func init_devices() {
+	screen_charset = must_charset(*screen_charset_flag)
+	check_save_format()
+	console := new(console_device)
+	register_device(DEV_KEYBOARD, console)
+	register_device(DEV_SCREEN, console)
+
+	if *printer_file != "" {
+		dir, name := filepath.Split(*printer_file)
+		if dir == "" {
+			dir = "."
+		}
+		register_device(DEV_PRINTER, &printer_device{
+			sb:		new_dir_sandbox(dir),
+			name:	name,
+			charset:	must_charset(*printer_charset_flag),
+		})
+	} else {
+		register_device(DEV_PRINTER, new(null_device))
+	}
+
+	for i, path := range disk_dirs {
+		if *path == "" {
+			continue
+		}
+		dev, err := new_drive(*path)
+		if err != nil {
+			fatalf("error mounting drive %d: %v", DEV_DISK + i, err)
+		}
+		register_device(byte(DEV_DISK + i), dev)
+	}
+	if devices[DEV_DISK] != nil {
+		register_device(DEV_DATASETTE, devices[DEV_DISK])
+	}
+}
+
+/* a drive for a host directory, an empty in-memory one for mem:, or, if path is a file, a disk image */
+func new_drive(path string) (device, error) {
+	if path == MEMORY_DRIVE {
+		d := new_host_drive(new_memory_sandbox())
+		d.charset = must_charset(*filename_charset_flag)
+		return d, nil
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".t64" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sb, err := new_t64_sandbox(b, must_charset(*filename_charset_flag))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		d := new_host_drive(sb)
+		d.charset = must_charset(*filename_charset_flag)
+		return d, nil
+	}
+	if st.IsDir() {
+		d := new_host_drive(new_dir_sandbox(path))
+		d.charset = must_charset(*filename_charset_flag)
+		return d, nil
+	}
+	d, err := new_image_drive(path)
+	if err != nil {
+		return nil, err
+	}
+	if *read_only_flag {
+		d.img.readonly = true
+	}
+	return d, nil
+}
+
+/************************************************************
+ * Console (Keyboard and Screen)
+ ************************************************************/
+
+/*
+ * Device 0 is the keyboard and device 3 is the screen, but like on the
+ * real machine, reading from the screen reads what the user typed and
+ * writing to the keyboard writes to the screen.
+ */
+type console_device struct {
+	st	byte
+}
+
+func (d *console_device) open(name string, sec byte) byte {
+	return KERN_ERR_NONE
+}
+
+func (d *console_device) close(sec byte) byte {
+	return 0
+}
+
+func (d *console_device) read(sec byte) byte {
+	d.st = 0
+	return keyboard_chrin()
+}
+
+func (d *console_device) write(sec byte, c byte) {
+	d.st = 0
+	screen_chrout(c)
+}
+
+func (d *console_device) status(sec byte) byte {
+	return d.st
+}
+
+/************************************************************
+ * Printer
+ ************************************************************/
+
+/*
+ * The printer appends everything to a host text file, which is only
+ * created once something is printed. The file is in a sandbox of its
+ * directory, like a drive's files, so -read-only keeps it from being
+ * written too. The printer's carriage return becomes a newline, and
+ * PETSCII is translated like on the screen, in lower case for files
+ * opened with secondary address 7.
+ */
+type printer_device struct {
+	sb		*sandbox
+	name		string
+	charset	charset
+	f		io.WriteCloser
+	w		*bufio.Writer
+	st		byte
+	lower	bool
+	err		error		// once writing fails, the printer is gone
+}
+
+func (d *printer_device) open(name string, sec byte) byte {
+	d.lower = sec == 7
+	return KERN_ERR_NONE
+}
+
+func (d *printer_device) close(sec byte) byte {
+	if d.w != nil && d.err == nil {
+		if err := d.w.Flush(); err != nil {
+			d.fail(err)
+			return d.st
+		}
+	}
+	return 0
+}
+
+func (d *printer_device) read(sec byte) byte {
+	d.st = KERN_ST_TIME_OUT_READ		// printers don't talk back
+	return 0
+}
+
+func (d *printer_device) write(sec byte, c byte) {
+	d.st = 0
+	if d.err != nil {
+		d.st = KERN_ST_TIME_OUT_WRITE | KERN_ST_DEVICE_NOT_PRESENT
+		return
+	}
+	if d.f == nil {
+		f, err := d.sb.create(d.name, true)
+		if errors.Is(err, fs.ErrNotExist) {
+			f, err = d.sb.create(d.name, false)
+		}
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		d.f = f
+		d.w = bufio.NewWriter(f)
+		at_exit(func() {
+			d.w.Flush()
+			d.f.Close()
+		})
+	}
+	var err error
+	if c == 13 {
+		err = d.w.WriteByte('\n')
+	} else {
+		cs := d.charset
+		if d.lower && cs != CHARSET_NONE {
+			cs = CHARSET_LOWER
+		}
+		err = write_petscii(d.w, c, cs)
+	}
+	if err != nil {
+		d.fail(err)
+	}
+}
+
+func (d *printer_device) fail(err error) {
+	host_error(err)
+	d.err = err
+	d.st = KERN_ST_TIME_OUT_WRITE | KERN_ST_DEVICE_NOT_PRESENT
+}
+
+func (d *printer_device) status(sec byte) byte {
+	return d.st
+}
+
+/************************************************************
+ * Null Device
+ ************************************************************/
+
+/* the null device swallows everything and never has anything to read */
+type null_device struct{}
+
+func (d *null_device) open(name string, sec byte) byte {
+	return KERN_ERR_NONE
+}
+
+func (d *null_device) close(sec byte) byte {
+	return 0
+}
+
+func (d *null_device) read(sec byte) byte {
+	return 0
+}
+
+func (d *null_device) write(sec byte, c byte) {
+}
+
+func (d *null_device) status(sec byte) byte {
+	return KERN_ST_EOF | KERN_ST_TIME_OUT_READ
+}
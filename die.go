@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/************************************************************
+ *
+ * Die Rendering
+ *
+ ************************************************************/
+
+/*
+ * segdefs.go only keeps the pull-up state of each node; the polygons
+ * that make up the nodes on the die come from visual6502's segdefs.js,
+ * which has one line per polygon:
+ *
+ *	[ 0,'+',1,5391,8260,5391,8216,5357,8216,5357,8260],
+ *
+ * that is, node number, pull-up, layer and the x,y pairs of the outline
+ * in a 10000x10000 coordinate space with the origin at the bottom left.
+ * We don't ship that file; point -segdefs at a local copy.
+ */
+const die_size = 10000
+
+type die_point struct {
+	x, y	float64
+}
+
+type die_segment struct {
+	node		uint64
+	pullup	bool
+	layer	int
+	points	[]die_point
+}
+
+var die_segments []die_segment
+
+/* the layers and their colors, bottom to top, as in visual6502 */
+const (
+	LAYER_METAL = iota
+	LAYER_SWITCHED_DIFFUSION
+	LAYER_INPUT_DIODE
+	LAYER_GROUNDED_DIFFUSION
+	LAYER_POWERED_DIFFUSION
+	LAYER_POLYSILICON
+	NUM_LAYERS
+)
+
+var layer_colors = [NUM_LAYERS]color.NRGBA{
+	LAYER_METAL:				{ 128, 128, 192, 102 },
+	LAYER_SWITCHED_DIFFUSION:	{ 255, 255, 0, 255 },
+	LAYER_INPUT_DIODE:		{ 255, 0, 255, 255 },
+	LAYER_GROUNDED_DIFFUSION:	{ 77, 255, 77, 255 },
+	LAYER_POWERED_DIFFUSION:	{ 255, 77, 77, 255 },
+	LAYER_POLYSILICON:		{ 128, 26, 192, 255 },
+}
+
+// metal is drawn last so it doesn't hide what's underneath
+var layer_order = []int{
+	LAYER_SWITCHED_DIFFUSION,
+	LAYER_INPUT_DIODE,
+	LAYER_GROUNDED_DIFFUSION,
+	LAYER_POWERED_DIFFUSION,
+	LAYER_POLYSILICON,
+	LAYER_METAL,
+}
+
+func load_segments(filename string) ([]die_segment, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	segs, err := parse_segments(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return segs, nil
+}
+
+func parse_segments(r io.Reader) ([]die_segment, error) {
+	var segs []die_segment
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024 * 1024)		// some polygons are very long
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, "[") || strings.HasPrefix(line, "[]") {
+			continue			// var segdefs = [, ], comments, ...
+		}
+		line = strings.TrimSuffix(line, ",")
+		line = strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+		fields := strings.Split(line, ",")
+		if len(fields) < 3 + 6 || (len(fields) - 3) % 2 != 0 {
+			return nil, fmt.Errorf("line %d: bad segment", lineno)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		var seg die_segment
+		n, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil || n >= NODES {
+			return nil, fmt.Errorf("line %d: bad node number %q", lineno, fields[0])
+		}
+		seg.node = n
+		seg.pullup = strings.Trim(fields[1], "'\"") == "+"
+		seg.layer, err = strconv.Atoi(fields[2])
+		if err != nil || seg.layer < 0 || seg.layer >= NUM_LAYERS {
+			return nil, fmt.Errorf("line %d: bad layer %q", lineno, fields[2])
+		}
+		for i := 3; i < len(fields); i += 2 {
+			x, errx := strconv.ParseFloat(fields[i], 64)
+			y, erry := strconv.ParseFloat(fields[i+1], 64)
+			if errx != nil || erry != nil {
+				return nil, fmt.Errorf("line %d: bad coordinate %s,%s", lineno, fields[i], fields[i+1])
+			}
+			seg.points = append(seg.points, die_point{ x, die_size - y })		// flip to screen coordinates
+		}
+		segs = append(segs, seg)
+	}
+	return segs, s.Err()
+}
+
+/*
+ * What the overlay on top of the layers shows:
+ * - DIE_VALUE: nodes that are currently high, like visual6502
+ * - DIE_ACTIVITY: how often each node changed state (from the profiler)
+ * - DIE_FAULT: the nodes around broken_transistor
+ */
+const (
+	DIE_VALUE = iota
+	DIE_ACTIVITY
+	DIE_FAULT
+)
+
+var (
+	die_file = flag.String("die", "", "render the die to `file` (.svg or .png) on exit (needs -segdefs)")
+	die_segdefs = flag.String("segdefs", "", "visual6502 segdefs.js `file` to load the die geometry from")
+	die_color = flag.String("die-color", "value", "what to color nodes by: value, activity or fault")
+	die_pixels = flag.Int("die-size", 1000, "width and height of rendered PNG images in pixels")
+	die_frames = flag.String("die-frames", "", "also render one frame per half-cycle into `dir`")
+	die_frame_format = flag.String("die-frame-format", "svg", "image `format` of the -die-frames frames: svg or png")
+	die_max_frames = flag.Uint("die-max-frames", 1000, "stop rendering frames after this many half-cycles")
+
+	die_mode		int
+	die_animating	bool
+	die_frame_count	uint
+	die_frame_chan	chan *die_snapshot
+)
+
+func init_die() {
+	if *die_file == "" && *die_frames == "" {
+		return
+	}
+	if *die_segdefs == "" {
+		fatalf("-die and -die-frames need -segdefs")
+	}
+	segs, err := load_segments(*die_segdefs)
+	if err != nil {
+		fatalf("error loading die geometry: %v", err)
+	}
+	die_segments = segs
+
+	switch *die_color {
+	case "value":
+		die_mode = DIE_VALUE
+	case "activity":
+		die_mode = DIE_ACTIVITY
+		profiling = true		// we need the counts, even if nobody asked for a profile file
+	case "fault":
+		die_mode = DIE_FAULT
+	default:
+		fatalf("unknown -die-color %q", *die_color)
+	}
+
+	if *die_frame_format != "svg" && *die_frame_format != "png" {
+		fatalf("unknown -die-frame-format %q", *die_frame_format)
+	}
+	if *die_frames != "" {
+		if err := os.MkdirAll(*die_frames, 0755); err != nil {
+			fatalf("error creating frame directory: %v", err)
+		}
+		die_animating = true
+	}
+	rendered := make(chan struct{})
+	if die_animating {
+		die_frame_chan = make(chan *die_snapshot, 16)
+		go render_die_frames(*die_frames, *die_frame_format, rendered)
+	} else {
+		close(rendered)
+	}
+	at_exit(func() {
+		stop_chip()
+		if die_animating {
+			close(die_frame_chan)
+		}
+		<-rendered
+		if *die_file != "" {
+			if err := write_die_file(*die_file, take_die_snapshot()); err != nil {
+				fmt.Fprintf(os.Stderr, "error rendering die: %v\n", err)
+			}
+		}
+	})
+}
+
+/*
+ * A die_snapshot holds what rendering needs of the chip: the node
+ * levels and activity counts after a half-cycle. Frames are taken on
+ * chiploop and rendered on a goroutine of their own, so the chip goes
+ * on while they are drawn and doesn't change under the drawing. A few
+ * frames can queue up; past that, the chip waits for the renderer.
+ */
+type die_snapshot struct {
+	values		[]bitmap_t
+	activity		[]uint64
+	max_activity	uint64
+}
+
+// on the goroutine driving the chip, or with the chip stopped
+func take_die_snapshot() *die_snapshot {
+	snap := &die_snapshot{
+		values:	append([]bitmap_t(nil), nodes_value...),
+	}
+	snap.activity, snap.max_activity = node_activity()
+	return snap
+}
+
+func (snap *die_snapshot) high(nn uint64) bool {
+	return get_bitmap(snap.values, nn)
+}
+
+/* called by chiploop after each clock edge */
+func die_frame() {
+	if die_frame_count >= *die_max_frames {
+		return
+	}
+	die_frame_chan <- take_die_snapshot()
+	die_frame_count++
+}
+
+/* render_die_frames writes the frames from die_frame_chan into dir as frameNNNNNN.svg or .png, by format */
+func render_die_frames(dir string, format string, done chan struct{}) {
+	n := 0
+	for snap := range die_frame_chan {
+		name := filepath.Join(dir, fmt.Sprintf("frame%06d.%s", n, format))
+		if err := write_die_file(name, snap); err != nil {
+			fmt.Fprintf(os.Stderr, "error rendering frame: %v\n", err)
+		}
+		n++
+	}
+	close(done)
+}
+
+func write_die_file(filename string, snap *die_snapshot) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(filename, ".png") {
+		err = png.Encode(f, render_die_png(*die_pixels, snap))
+	} else {
+		w := bufio.NewWriter(f)
+		err = render_die_svg(w, snap)
+		if err == nil {
+			err = w.Flush()
+		}
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+/*
+ * node_overlay returns the color to draw over node nn's polygons in
+ * the current mode, or ok == false if the node is drawn as is.
+ */
+func node_overlay(nn uint64, snap *die_snapshot) (c color.NRGBA, ok bool) {
+	activity, max_activity := snap.activity, snap.max_activity
+
+	switch die_mode {
+	case DIE_VALUE:
+		if snap.high(nn) {
+			return color.NRGBA{ 255, 0, 64, 102 }, true
+		}
+	case DIE_ACTIVITY:
+		if activity[nn] == 0 || max_activity == 0 {
+			break
+		}
+		// log scale from blue (cold) to red (hot)
+		heat := math.Log(float64(activity[nn]) + 1) / math.Log(float64(max_activity) + 1)
+		return color.NRGBA{ byte(255 * heat), 0, byte(255 * (1 - heat)), 192 }, true
+	case DIE_FAULT:
+		if broken_transistor >= uint64(transistors) {
+			break
+		}
+		if nn == transistors_gate[broken_transistor] {
+			return color.NRGBA{ 255, 255, 255, 224 }, true
+		}
+		if nn == transistors_c1[broken_transistor] || nn == transistors_c2[broken_transistor] {
+			return color.NRGBA{ 255, 0, 0, 224 }, true
+		}
+	}
+	return color.NRGBA{}, false
+}
+
+// total state changes per node over all opcodes, for DIE_ACTIVITY; on the goroutine driving the chip
+func node_activity() ([]uint64, uint64) {
+	activity := make([]uint64, NODES)
+	max := uint64(0)
+
+	if die_mode != DIE_ACTIVITY {
+		return activity, 0
+	}
+	for _, pc := range chip_profile.data {
+		for nn, count := range pc.nodes {
+			activity[nn] += uint64(count)
+		}
+	}
+	for nn := range activity {
+		if nn != vss && nn != vcc && activity[nn] > max {
+			max = activity[nn]
+		}
+	}
+	return activity, max
+}
+
+// the segments in drawing order: layer by layer, then the overlay
+func die_draw_list(snap *die_snapshot) (segs []*die_segment, colors []color.NRGBA) {
+	for _, layer := range layer_order {
+		for i := range die_segments {
+			if die_segments[i].layer == layer {
+				segs = append(segs, &die_segments[i])
+				colors = append(colors, layer_colors[layer])
+			}
+		}
+	}
+	for i := range die_segments {
+		if c, ok := node_overlay(die_segments[i].node, snap); ok {
+			segs = append(segs, &die_segments[i])
+			colors = append(colors, c)
+		}
+	}
+	return segs, colors
+}
+
+func render_die_svg(w io.Writer, snap *die_snapshot) error {
+	segs, colors := die_draw_list(snap)
+
+	ew := &err_writer{w: w}
+	ew.printf("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	ew.printf("<svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"0 0 %d %d\" width=\"%d\" height=\"%d\">\n",
+		die_size, die_size, *die_pixels, *die_pixels)
+	ew.printf("<rect width=\"%d\" height=\"%d\" fill=\"black\"/>\n", die_size, die_size)
+	for i, seg := range segs {
+		c := colors[i]
+		ew.printf("<polygon fill=\"#%02x%02x%02x\" fill-opacity=\"%.2f\" points=\"", c.R, c.G, c.B, float64(c.A) / 255)
+		for j, p := range seg.points {
+			if j != 0 {
+				ew.printf(" ")
+			}
+			ew.printf("%g,%g", p.x, p.y)
+		}
+		ew.printf("\"><title>%s</title></polygon>\n", node_name(seg.node))
+	}
+	ew.printf("</svg>\n")
+	return ew.err
+}
+
+func render_die_png(pixels int, snap *die_snapshot) *image.RGBA {
+	segs, colors := die_draw_list(snap)
+
+	img := image.NewRGBA(image.Rect(0, 0, pixels, pixels))
+	for i := range img.Pix {
+		if i % 4 == 3 {
+			img.Pix[i] = 255		// opaque black background
+		}
+	}
+	scale := float64(pixels) / die_size
+	for i, seg := range segs {
+		fill_polygon(img, seg.points, scale, colors[i])
+	}
+	return img
+}
+
+/*
+ * fill_polygon does an even-odd scanline fill, sampling each row of
+ * pixels at its center and blending c over what's already there.
+ */
+func fill_polygon(img *image.RGBA, points []die_point, scale float64, c color.NRGBA) {
+	miny, maxy := math.Inf(1), math.Inf(-1)
+	for _, p := range points {
+		miny = math.Min(miny, p.y * scale)
+		maxy = math.Max(maxy, p.y * scale)
+	}
+	bounds := img.Bounds()
+	y0 := int(math.Max(math.Floor(miny), float64(bounds.Min.Y)))
+	y1 := int(math.Min(math.Ceil(maxy), float64(bounds.Max.Y - 1)))
+
+	var xs []float64
+	for y := y0; y <= y1; y++ {
+		sy := float64(y) + 0.5
+		xs = xs[:0]
+		for i := range points {
+			a := points[i]
+			b := points[(i + 1) % len(points)]
+			ay, by := a.y * scale, b.y * scale
+			if (ay <= sy && by > sy) || (by <= sy && ay > sy) {
+				xs = append(xs, (a.x + (sy - ay) / (by - ay) * (b.x - a.x)) * scale)
+			}
+		}
+		sort.Float64s(xs)
+		for i := 0; i + 1 < len(xs); i += 2 {
+			x0 := int(math.Max(math.Floor(xs[i] + 0.5), float64(bounds.Min.X)))
+			x1 := int(math.Min(math.Floor(xs[i+1] + 0.5), float64(bounds.Max.X)))
+			for x := x0; x < x1; x++ {
+				blend_pixel(img, x, y, c)
+			}
+		}
+	}
+}
+
+func blend_pixel(img *image.RGBA, x, y int, c color.NRGBA) {
+	i := img.PixOffset(x, y)
+	a := uint32(c.A)
+	for j, v := range []uint8{ c.R, c.G, c.B } {
+		img.Pix[i+j] = uint8((uint32(v) * a + uint32(img.Pix[i+j]) * (255 - a)) / 255)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const test_segdefs = `var segdefs = [
+[ 1,'+',1,0,10000,5000,10000,5000,5000,0,5000],
+[ 2,'-',5,5000,5000,10000,5000,10000,0,5000,0],
+]`
+
+func TestParseSegments(t *testing.T) {
+	segs, err := parse_segments(strings.NewReader(test_segdefs))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(segs) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segs))
+	}
+	if segs[0].node != 1 || !segs[0].pullup || segs[0].layer != LAYER_SWITCHED_DIFFUSION || len(segs[0].points) != 4 {
+		t.Errorf("bad first segment %+v", segs[0])
+	}
+	if segs[1].pullup || segs[1].layer != LAYER_POLYSILICON {
+		t.Errorf("bad second segment %+v", segs[1])
+	}
+	// y is flipped so the top of the die is at the top of the image
+	if p := segs[0].points[0]; p.x != 0 || p.y != 0 {
+		t.Errorf("first point is %v, want {0 0}", p)
+	}
+
+	for _, bad := range []string{
+		"[ 1,'+',1,0,0,1,1],",
+		"[ 99999,'+',1,0,0,1,1,2,2],",
+		"[ 1,'+',9,0,0,1,1,2,2],",
+	} {
+		if _, err := parse_segments(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestRenderDiePNG(t *testing.T) {
+	segs, err := parse_segments(strings.NewReader(test_segdefs))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	die_segments = segs
+	die_mode = DIE_FAULT		// no overlay without a broken transistor
+	defer func() {
+		die_segments = nil
+		die_mode = DIE_VALUE
+	}()
+
+	img := render_die_png(100, take_die_snapshot())
+	if c := img.RGBAAt(25, 25); c.R != 255 || c.G != 255 || c.B != 0 {
+		t.Errorf("top left quadrant is %v, want switched diffusion yellow", c)
+	}
+	if c := img.RGBAAt(75, 75); c.R != 128 || c.G != 26 || c.B != 192 {
+		t.Errorf("bottom right quadrant is %v, want polysilicon purple", c)
+	}
+	if c := img.RGBAAt(75, 25); c.R != 0 || c.G != 0 || c.B != 0 {
+		t.Errorf("top right quadrant is %v, want black", c)
+	}
+}
+
+func TestRenderDieSnapshot(t *testing.T) {
+	segs, err := parse_segments(strings.NewReader(test_segdefs))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	die_segments = segs
+	saved := append([]bitmap_t(nil), nodes_value...)
+	defer func() {
+		die_segments = nil
+		copy(nodes_value, saved)
+	}()
+
+	// the picture is of the chip when the snapshot was taken, not when it is drawn
+	set_bitmap(nodes_value, 1, true)
+	snap := take_die_snapshot()
+	set_bitmap(nodes_value, 1, false)
+
+	img := render_die_png(100, snap)
+	if c := img.RGBAAt(25, 25); c.R != 255 || c.G != 153 || c.B != 25 {
+		t.Errorf("top left quadrant is %v, want switched diffusion with the high overlay", c)
+	}
+	img = render_die_png(100, take_die_snapshot())
+	if c := img.RGBAAt(25, 25); c.R != 255 || c.G != 255 || c.B != 0 {
+		t.Errorf("top left quadrant is %v, want plain switched diffusion", c)
+	}
+}
+
+func TestRenderDieFrames(t *testing.T) {
+	segs, err := parse_segments(strings.NewReader(test_segdefs))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	die_segments = segs
+	saved_file, saved_pixels := *die_file, *die_pixels
+	*die_file = "die.png"		// the frames don't follow -die
+	*die_pixels = 10
+	defer func() {
+		die_segments = nil
+		die_frame_chan = nil
+		*die_file, *die_pixels = saved_file, saved_pixels
+	}()
+
+	for _, tt := range []struct {
+		format	string
+		magic	string
+	}{
+		{ "svg", "<svg" },
+		{ "png", "\x89PNG" },
+	} {
+		dir := t.TempDir()
+		die_frame_chan = make(chan *die_snapshot, 2)
+		die_frame_chan <- take_die_snapshot()
+		die_frame_chan <- take_die_snapshot()
+		close(die_frame_chan)
+		done := make(chan struct{})
+		render_die_frames(dir, tt.format, done)
+		<-done
+
+		names, _ := filepath.Glob(filepath.Join(dir, "*"))
+		if len(names) != 2 || filepath.Base(names[1]) != "frame000001." + tt.format {
+			t.Fatalf("%s: got frames %v", tt.format, names)
+		}
+		b, err := ioutil.ReadFile(names[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(b[:64], []byte(tt.magic)) {
+			t.Errorf("%s: frame starts with %q", tt.format, b[:16])
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+)
+
+/************************************************************
+ *
+ * Disassembler
+ *
+ ************************************************************/
+
+/*
+ * disassemble decodes the instruction at addr, reading memory through
+ * read, and returns it as text and its length in bytes. Jump, call and
+ * branch targets and absolute operands are written as their symbol
+ * names if they have one ("JSR CHKCOM", "LDA TXTTAB+1"); zero page
+ * operands are left as numbers, since the names there are mostly
+ * about code. Undocumented opcodes come out as ".BYTE $xx".
+ */
+func disassemble(addr uint16, read func(uint16) byte) (string, int) {
+	op, ok := opcodes[read(addr)]
+	if !ok {
+		return fmt.Sprintf(".BYTE $%02X", read(addr)), 1
+	}
+	b := read(addr + 1)
+	w := uint16(b) | (uint16(read(addr + 2)) << 8)
+
+	switch op.mode {
+	case IMP:
+		return op.name, 1
+	case ACC:
+		return op.name + " A", 1
+	case IMM:
+		return fmt.Sprintf("%s #$%02X", op.name, b), 2
+	case ZP:
+		return fmt.Sprintf("%s $%02X", op.name, b), 2
+	case ZPX:
+		return fmt.Sprintf("%s $%02X,X", op.name, b), 2
+	case ZPY:
+		return fmt.Sprintf("%s $%02X,Y", op.name, b), 2
+	case IZX:
+		return fmt.Sprintf("%s ($%02X,X)", op.name, b), 2
+	case IZY:
+		return fmt.Sprintf("%s ($%02X),Y", op.name, b), 2
+	case REL:
+		return op.name + " " + operand_name(addr + 2 + uint16(int8(b))), 2
+	case ABS:
+		return op.name + " " + operand_name(w), 3
+	case ABX:
+		return op.name + " " + operand_name(w) + ",X", 3
+	case ABY:
+		return op.name + " " + operand_name(w) + ",Y", 3
+	case IND:
+		return op.name + " (" + operand_name(w) + ")", 3
+	}
+	panic("bad addressing mode")
+}
+
+/* operand_name writes addr as a symbol, or a symbol plus one for the high byte of a vector */
+func operand_name(addr uint16) string {
+	if name := symbol_name(addr); name != "" {
+		return name
+	}
+	if name := symbol_name(addr - 1); name != "" && addr != 0 {
+		return name + "+1"
+	}
+	return fmt.Sprintf("$%04X", addr)
+}
+
+/* disassemble_range returns n lines of "$addr  bytes  instruction" from addr on */
+func disassemble_range(addr uint16, n int, read func(uint16) byte) []string {
+	var lines []string
+
+	for i := 0; i < n; i++ {
+		text, length := disassemble(addr, read)
+		bytes := ""
+		for j := 0; j < 3; j++ {
+			if j < length {
+				bytes += fmt.Sprintf("%02X ", read(addr + uint16(j)))
+			} else {
+				bytes += "   "
+			}
+		}
+		label := ""
+		if name := symbol_name(addr); name != "" {
+			label = name + ":"
+		}
+		lines = append(lines, fmt.Sprintf("$%04X  %s %-12s %s", addr, bytes, label, text))
+		addr += uint16(length)
+	}
+	return lines
+}
+
+type addr_mode int
+
+const (
+	IMP addr_mode = iota
+	ACC
+	IMM
+	ZP
+	ZPX
+	ZPY
+	IZX
+	IZY
+	REL
+	ABS
+	ABX
+	ABY
+	IND
+)
+
+type opcode struct {
+	name	string
+	mode	addr_mode
+}
+
+/* the documented NMOS 6502 instructions */
+var opcodes = map[byte]opcode{
+	0x00: { "BRK", IMP }, 0x01: { "ORA", IZX }, 0x05: { "ORA", ZP }, 0x06: { "ASL", ZP },
+	0x08: { "PHP", IMP }, 0x09: { "ORA", IMM }, 0x0A: { "ASL", ACC }, 0x0D: { "ORA", ABS },
+	0x0E: { "ASL", ABS }, 0x10: { "BPL", REL }, 0x11: { "ORA", IZY }, 0x15: { "ORA", ZPX },
+	0x16: { "ASL", ZPX }, 0x18: { "CLC", IMP }, 0x19: { "ORA", ABY }, 0x1D: { "ORA", ABX },
+	0x1E: { "ASL", ABX }, 0x20: { "JSR", ABS }, 0x21: { "AND", IZX }, 0x24: { "BIT", ZP },
+	0x25: { "AND", ZP }, 0x26: { "ROL", ZP }, 0x28: { "PLP", IMP }, 0x29: { "AND", IMM },
+	0x2A: { "ROL", ACC }, 0x2C: { "BIT", ABS }, 0x2D: { "AND", ABS }, 0x2E: { "ROL", ABS },
+	0x30: { "BMI", REL }, 0x31: { "AND", IZY }, 0x35: { "AND", ZPX }, 0x36: { "ROL", ZPX },
+	0x38: { "SEC", IMP }, 0x39: { "AND", ABY }, 0x3D: { "AND", ABX }, 0x3E: { "ROL", ABX },
+	0x40: { "RTI", IMP }, 0x41: { "EOR", IZX }, 0x45: { "EOR", ZP }, 0x46: { "LSR", ZP },
+	0x48: { "PHA", IMP }, 0x49: { "EOR", IMM }, 0x4A: { "LSR", ACC }, 0x4C: { "JMP", ABS },
+	0x4D: { "EOR", ABS }, 0x4E: { "LSR", ABS }, 0x50: { "BVC", REL }, 0x51: { "EOR", IZY },
+	0x55: { "EOR", ZPX }, 0x56: { "LSR", ZPX }, 0x58: { "CLI", IMP }, 0x59: { "EOR", ABY },
+	0x5D: { "EOR", ABX }, 0x5E: { "LSR", ABX }, 0x60: { "RTS", IMP }, 0x61: { "ADC", IZX },
+	0x65: { "ADC", ZP }, 0x66: { "ROR", ZP }, 0x68: { "PLA", IMP }, 0x69: { "ADC", IMM },
+	0x6A: { "ROR", ACC }, 0x6C: { "JMP", IND }, 0x6D: { "ADC", ABS }, 0x6E: { "ROR", ABS },
+	0x70: { "BVS", REL }, 0x71: { "ADC", IZY }, 0x75: { "ADC", ZPX }, 0x76: { "ROR", ZPX },
+	0x78: { "SEI", IMP }, 0x79: { "ADC", ABY }, 0x7D: { "ADC", ABX }, 0x7E: { "ROR", ABX },
+	0x81: { "STA", IZX }, 0x84: { "STY", ZP }, 0x85: { "STA", ZP }, 0x86: { "STX", ZP },
+	0x88: { "DEY", IMP }, 0x8A: { "TXA", IMP }, 0x8C: { "STY", ABS }, 0x8D: { "STA", ABS },
+	0x8E: { "STX", ABS }, 0x90: { "BCC", REL }, 0x91: { "STA", IZY }, 0x94: { "STY", ZPX },
+	0x95: { "STA", ZPX }, 0x96: { "STX", ZPY }, 0x98: { "TYA", IMP }, 0x99: { "STA", ABY },
+	0x9A: { "TXS", IMP }, 0x9D: { "STA", ABX }, 0xA0: { "LDY", IMM }, 0xA1: { "LDA", IZX },
+	0xA2: { "LDX", IMM }, 0xA4: { "LDY", ZP }, 0xA5: { "LDA", ZP }, 0xA6: { "LDX", ZP },
+	0xA8: { "TAY", IMP }, 0xA9: { "LDA", IMM }, 0xAA: { "TAX", IMP }, 0xAC: { "LDY", ABS },
+	0xAD: { "LDA", ABS }, 0xAE: { "LDX", ABS }, 0xB0: { "BCS", REL }, 0xB1: { "LDA", IZY },
+	0xB4: { "LDY", ZPX }, 0xB5: { "LDA", ZPX }, 0xB6: { "LDX", ZPY }, 0xB8: { "CLV", IMP },
+	0xB9: { "LDA", ABY }, 0xBA: { "TSX", IMP }, 0xBC: { "LDY", ABX }, 0xBD: { "LDA", ABX },
+	0xBE: { "LDX", ABY }, 0xC0: { "CPY", IMM }, 0xC1: { "CMP", IZX }, 0xC4: { "CPY", ZP },
+	0xC5: { "CMP", ZP }, 0xC6: { "DEC", ZP }, 0xC8: { "INY", IMP }, 0xC9: { "CMP", IMM },
+	0xCA: { "DEX", IMP }, 0xCC: { "CPY", ABS }, 0xCD: { "CMP", ABS }, 0xCE: { "DEC", ABS },
+	0xD0: { "BNE", REL }, 0xD1: { "CMP", IZY }, 0xD5: { "CMP", ZPX }, 0xD6: { "DEC", ZPX },
+	0xD8: { "CLD", IMP }, 0xD9: { "CMP", ABY }, 0xDD: { "CMP", ABX }, 0xDE: { "DEC", ABX },
+	0xE0: { "CPX", IMM }, 0xE1: { "SBC", IZX }, 0xE4: { "CPX", ZP }, 0xE5: { "SBC", ZP },
+	0xE6: { "INC", ZP }, 0xE8: { "INX", IMP }, 0xE9: { "SBC", IMM }, 0xEA: { "NOP", IMP },
+	0xEC: { "CPX", ABS }, 0xED: { "SBC", ABS }, 0xEE: { "INC", ABS }, 0xF0: { "BEQ", REL },
+	0xF1: { "SBC", IZY }, 0xF5: { "SBC", ZPX }, 0xF6: { "INC", ZPX }, 0xF8: { "SED", IMP },
+	0xF9: { "SBC", ABY }, 0xFD: { "SBC", ABX }, 0xFE: { "INC", ABX },
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	tests := []struct {
+		addr		uint16
+		code		[]byte
+		want		string
+		length	int
+	}{
+		{ 0x1000, []byte{ 0x20, 0xFD, 0xAE }, "JSR CHKCOM", 3 },
+		{ 0x1000, []byte{ 0x4C, 0x37, 0xA4 }, "JMP ERROR", 3 },
+		{ 0x1000, []byte{ 0x4C, 0x00, 0x30 }, "JMP $3000", 3 },
+		{ 0x1000, []byte{ 0x6C, 0x01, 0xA0 }, "JMP (BASIC_COLD_VECTOR+1)", 3 },
+		{ 0x1000, []byte{ 0xBD, 0x00, 0x02 }, "LDA $0200,X", 3 },
+		{ 0x1000, []byte{ 0xB1, 0x7A }, "LDA ($7A),Y", 2 },
+		{ 0x1000, []byte{ 0xA9, 0x0D }, "LDA #$0D", 2 },
+		{ 0x1000, []byte{ 0x0A }, "ASL A", 1 },
+		{ 0x1000, []byte{ 0xD0, 0xFE }, "BNE $1000", 2 },
+		{ ROM_ERROR - 4, []byte{ 0xF0, 0x02 }, "BEQ ERROR", 2 },
+		{ 0x1000, []byte{ 0x02 }, ".BYTE $02", 1 },
+	}
+
+	for _, tt := range tests {
+		mem := map[uint16]byte{}
+		for i, b := range tt.code {
+			mem[tt.addr + uint16(i)] = b
+		}
+		got, n := disassemble(tt.addr, func(addr uint16) byte {
+			return mem[addr]
+		})
+		if got != tt.want || n != tt.length {
+			t.Errorf("% X: got %q (%d bytes), want %q (%d bytes)", tt.code, got, n, tt.want, tt.length)
+		}
+	}
+}
+
+func TestDisassembleRange(t *testing.T) {
+	code := []byte{ 0x20, 0xFD, 0xAE, 0x60, 0, 0 }		// at CHKCOM itself, so it gets a label
+	got := disassemble_range(ROM_CHKCOM, 2, func(addr uint16) byte {
+		return code[addr - ROM_CHKCOM]
+	})
+	want := []string{
+		"$AEFD  20 FD AE  CHKCOM:      JSR CHKCOM",
+		"$AF00  60                     RTS",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	defer func() {
+		breakpoints = map[uint16]bool{}
+	}()
+
+	if addr, err := set_breakpoint("CHKCOM"); err != nil || addr != ROM_CHKCOM {
+		t.Errorf("CHKCOM: got $%04X, %v", addr, err)
+	}
+	if _, err := set_breakpoint("$A437"); err != nil {
+		t.Errorf("$A437: %v", err)
+	}
+	if _, err := set_breakpoint("NO_SUCH_LABEL"); err == nil {
+		t.Errorf("NO_SUCH_LABEL: expected error")
+	}
+	if !is_breakpoint(ROM_ERROR) || is_breakpoint(ROM_FRMNUM) {
+		t.Errorf("is_breakpoint is wrong")
+	}
+	got := list_breakpoints()
+	if len(got) != 2 || got[0] != "$A437 <ERROR>" || got[1] != "$AEFD <CHKCOM>" {
+		t.Errorf("got %q", got)
+	}
+	clear_breakpoint("ERROR")
+	if is_breakpoint(ROM_ERROR) {
+		t.Errorf("ERROR not cleared")
+	}
+}
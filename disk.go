@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+/************************************************************
+ *
+ * Disk Drives
+ *
+ ************************************************************/
+
+/* Commodore DOS error numbers, as read from the command channel */
+const (
+	DOS_OK = 0
+	DOS_READ_ERROR = 20
+	DOS_WRITE_PROTECT_ON = 26
+	DOS_FILE_NOT_FOUND = 62
+	DOS_FILE_EXISTS = 63
+	DOS_DISK_FULL = 72
+)
+
+/*
+ * Commodore DOS file names can carry more than the name:
+ *	[@][drive:]name[,type[,mode]]
+ * where @ means replace an existing file, type is P(RG), S(EQ), U(SR)
+ * or R(EL), and mode is R(ead), W(rite) or A(ppend).
+ */
+type dos_name struct {
+	name		string
+	ftype	byte		// 0 if not given
+	mode		byte		// 0 if not given
+	replace	bool
+}
+
+func parse_dos_name(s string) dos_name {
+	var dn dos_name
+
+	if strings.HasPrefix(s, "@") {
+		dn.replace = true
+		s = s[1:]
+	}
+	s = strip_drive(s)
+	parts := strings.Split(s, ",")
+	dn.name = parts[0]
+	for _, p := range parts[1:] {
+		if p == "" {
+			continue
+		}
+		switch p[0] {
+		case 'P', 'S', 'U', 'L':
+			if dn.ftype == 0 {
+				dn.ftype = p[0]
+				continue
+			}
+		}
+		switch p[0] {
+		case 'R', 'W', 'A':
+			dn.mode = p[0]
+		}
+	}
+	return dn
+}
+
+// strip_drive removes the drive number from a name like "0:NAME" or ":NAME".
+func strip_drive(s string) string {
+	if i := strings.IndexByte(s, ':'); i != -1 && i <= 1 {
+		return s[i+1:]
+	}
+	return s
+}
+
+/*
+ * An open channel on a disk drive reads from and/or writes to a
+ * byte stream; reads look one byte ahead so the last byte of a file
+ * can be flagged with KERN_ST_EOF, like the real drive does.
+ */
+type disk_channel struct {
+	r	*bufio.Reader		// nil if not open for reading
+	w	*bufio.Writer		// nil if not open for writing
+	c	io.Closer			// may be nil
+	st	byte
+	err	error			// the write error, once writing failed
+}
+
+func new_read_channel(r io.Reader, c io.Closer) *disk_channel {
+	return &disk_channel{
+		r:	bufio.NewReader(r),
+		c:	c,
+	}
+}
+
+func new_write_channel(w io.Writer, c io.Closer) *disk_channel {
+	return &disk_channel{
+		w:	bufio.NewWriter(w),
+		c:	c,
+	}
+}
+
+func (ch *disk_channel) read() byte {
+	ch.st = 0
+	if ch.r == nil {
+		ch.st = KERN_ST_EOF | KERN_ST_TIME_OUT_READ
+		return 0
+	}
+	c, err := ch.r.ReadByte()
+	if err != nil {
+		ch.st = KERN_ST_EOF | KERN_ST_TIME_OUT_READ
+		if err != io.EOF {
+			host_error(err)
+			ch.st |= KERN_ST_READ_ERROR
+		}
+		return 0
+	}
+	// an error reading ahead means this byte is the last one we'll get
+	if _, err = ch.r.Peek(1); err != nil {
+		ch.st = KERN_ST_EOF
+		if err != io.EOF {
+			host_error(err)
+			ch.st |= KERN_ST_READ_ERROR
+		}
+	}
+	return c
+}
+
+func (ch *disk_channel) write(c byte) {
+	ch.st = 0
+	if ch.w == nil {
+		ch.st = KERN_ST_TIME_OUT_WRITE
+		return
+	}
+	if ch.err == nil {
+		if ch.err = ch.w.WriteByte(c); ch.err != nil {
+			host_error(ch.err)
+		}
+	}
+	if ch.err != nil {
+		ch.st = KERN_ST_TIME_OUT_WRITE | KERN_ST_DEVICE_NOT_PRESENT
+	}
+}
+
+// close returns the error writing out the rest of the file, unless it was already reported by write
+func (ch *disk_channel) close() error {
+	var err error
+
+	if ch.w != nil && ch.err == nil {
+		err = ch.w.Flush()
+	}
+	if ch.c != nil {
+		if err2 := ch.c.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func close_channel(channels map[byte]*disk_channel, sec byte) byte {
+	ch := channels[sec]
+	if ch == nil {
+		return 0
+	}
+	delete(channels, sec)
+	if err := ch.close(); err != nil {
+		host_error(err)
+		return KERN_ST_TIME_OUT_WRITE | KERN_ST_DEVICE_NOT_PRESENT
+	}
+	return 0
+}
+
+func close_channels(channels map[byte]*disk_channel) byte {
+	var st byte
+
+	for sec := range channels {
+		st |= close_channel(channels, sec)
+	}
+	return st
+}
+
+/************************************************************
+ * Directory Listings
+ ************************************************************/
+
+/*
+ * LOAD"$" gets the directory as a BASIC program, one line per file,
+ * where the line number is the size in blocks. The line links assume
+ * the program is loaded to $0801; BASIC relinks it after loading anyway.
+ */
+type listing struct {
+	b	[]byte
+}
+
+func new_listing() *listing {
+	return &listing{
+		b:	[]byte{ 0x01, 0x08 },		// load address
+	}
+}
+
+func (l *listing) line(num uint16, text string) {
+	addr := 0x0801 + len(l.b) - 2
+	next := addr + 2 + 2 + len(text) + 1
+	l.b = append(l.b, byte(next & 0xFF), byte(next >> 8), byte(num & 0xFF), byte(num >> 8))
+	l.b = append(l.b, text...)
+	l.b = append(l.b, 0)
+}
+
+func (l *listing) bytes() []byte {
+	return append(l.b, 0, 0)
+}
+
+// the reversed header line: "DISK NAME       " ID 2A
+func (l *listing) header(name string, id string) {
+	if len(name) > 16 {
+		name = name[:16]
+	}
+	l.line(0, fmt.Sprintf("\x12\"%-16s\" %s", name, id))
+}
+
+// a file line: 12   "NAME"            PRG; an unclosed file's type is *PRG, which takes the space before it
+func (l *listing) entry(blocks int, name string, ftype string) {
+	if blocks > 0xFFFF {
+		blocks = 0xFFFF
+	}
+	pad := ""
+	if blocks < 1000 {
+		pad = " "
+		if blocks < 100 {
+			pad += " "
+			if blocks < 10 {
+				pad += " "
+			}
+		}
+	}
+	if len(name) > 16 {
+		name = name[:16]
+	}
+	quoted := "\"" + name + "\""
+	sep := " "
+	if strings.HasPrefix(ftype, "*") {
+		sep = ""
+	}
+	l.line(uint16(blocks), fmt.Sprintf("%s%-18s%s%s  ", pad, quoted, sep, ftype))
+}
+
+func (l *listing) blocks_free(blocks int) {
+	l.line(uint16(blocks), "BLOCKS FREE.")
+}
+
+/************************************************************
+ * Host Directory Drive
+ ************************************************************/
+
+/*
+ * A host drive serves the files of a sandbox, usually a host
+ * directory. Without a mode in the file name, secondary address 0
+ * (which LOAD uses) reads and everything else (including SAVE's 1)
+ * writes, as cbmbasic always did. Loading a directory name changes
+ * into that directory, as far as the sandbox lets it.
+ */
+type host_drive struct {
+	sb		*sandbox
+	dir		string		// in the sandbox
+	channels	map[byte]*disk_channel
+	cmd		command_channel
+	charset	charset		// of host file names
+}
+
+func new_host_drive(sb *sandbox) *host_drive {
+	d := &host_drive{
+		sb:		sb,
+		dir:		".",
+		channels:	map[byte]*disk_channel{},
+	}
+	d.cmd = new_command_channel(d)
+	return d
+}
+
+func (d *host_drive) open(name string, sec byte) byte {
+	if sec == DOS_COMMAND_CHANNEL {
+		d.cmd.open(name)
+		return KERN_ERR_NONE
+	}
+	d.close(sec)		// the drive reuses the channel
+
+	if name == "" {
+		return KERN_ERR_MISSING_FILE_NAME
+	}
+	if name[0] == '$' && sec == 0 {
+		b, err := host_directory(d.sb, d.dir, d.charset)
+		if err != nil {
+			host_error(err)
+			return KERN_ERR_DEVICE_NOT_PRESENT
+		}
+		d.channels[sec] = new_read_channel(bytes.NewReader(b), nil)
+		return KERN_ERR_NONE
+	}
+
+	dn := parse_dos_name(name)
+	path, err := d.path(dn.name)
+	if err != nil {
+		// as far as BASIC can tell, there is no such file
+		host_error(err)
+		d.cmd.set(DOS_FILE_NOT_FOUND)
+		return KERN_ERR_FILE_NOT_FOUND
+	}
+	mode := dn.mode
+	if mode == 0 {
+		mode = 'W'
+		if sec == 0 {
+			mode = 'R'
+		}
+	}
+
+	switch mode {
+	case 'R':
+		path, st, err := stat_program(d.sb.fsys, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			d.cmd.set(DOS_FILE_NOT_FOUND)
+			return KERN_ERR_FILE_NOT_FOUND
+		} else if err != nil {
+			host_error(err)
+			d.cmd.set(DOS_READ_ERROR)
+			return KERN_ERR_DEVICE_NOT_PRESENT
+		}
+		if st.IsDir() && sec == 0 {
+			d.dir = path
+			d.channels[sec] = new_read_channel(bytes.NewReader([]byte{ 0x01, 0x08, 0x00, 0x00 }), nil)
+			return KERN_ERR_NONE
+		}
+		f, err := d.sb.fsys.Open(path)
+		if err != nil {
+			host_error(err)
+			d.cmd.set(DOS_READ_ERROR)
+			return KERN_ERR_DEVICE_NOT_PRESENT
+		}
+		var r io.Reader
+		if is_basic_text(path) {
+			r, err = open_basic_text(f)
+		} else {
+			r, err = open_container(f)
+		}
+		if err != nil {
+			host_error(err)
+			f.Close()
+			d.cmd.set(DOS_READ_ERROR)
+			return KERN_ERR_DEVICE_NOT_PRESENT
+		}
+		d.channels[sec] = new_read_channel(r, f)
+	case 'W', 'A':
+		if d.sb.readonly {
+			// like a write-protected disk, but BASIC gets to know, rather than losing the data
+			d.cmd.set(DOS_WRITE_PROTECT_ON)
+			return KERN_ERR_DEVICE_NOT_PRESENT
+		}
+		kind := CONTAINER_PRG
+		if mode == 'W' {
+			kind, path = save_container(path)
+		}
+		f, err := d.sb.create(path, mode == 'A')
+		if errors.Is(err, fs.ErrNotExist) {
+			d.cmd.set(DOS_FILE_NOT_FOUND)
+			return KERN_ERR_FILE_NOT_FOUND
+		} else if err != nil {
+			host_error(err)
+			d.cmd.set(DOS_WRITE_PROTECT_ON)
+			return KERN_ERR_DEVICE_NOT_PRESENT
+		}
+		if kind != CONTAINER_PRG {
+			f = &container_writer{
+				w:		f,
+				kind:	kind,
+				name:	trim_extension(dn.name),
+			}
+		}
+		d.channels[sec] = new_write_channel(f, f)
+	}
+	return KERN_ERR_NONE
+}
+
+// path returns the path in the sandbox of the file with the given PETSCII name.
+func (d *host_drive) path(name string) (string, error) {
+	return d.sb.resolve(d.dir, unicode_string(name, d.charset))
+}
+
+// closing the command channel closes every channel, like on the real drive
+func (d *host_drive) close(sec byte) byte {
+	if sec == DOS_COMMAND_CHANNEL {
+		d.cmd.close()
+		return close_channels(d.channels)
+	}
+	return close_channel(d.channels, sec)
+}
+
+func (d *host_drive) read(sec byte) byte {
+	if sec == DOS_COMMAND_CHANNEL {
+		return d.cmd.read()
+	}
+	ch := d.channels[sec]
+	if ch == nil {
+		return 0
+	}
+	return ch.read()
+}
+
+func (d *host_drive) write(sec byte, c byte) {
+	if sec == DOS_COMMAND_CHANNEL {
+		d.cmd.write(c)
+		return
+	}
+	if ch := d.channels[sec]; ch != nil {
+		ch.write(c)
+	}
+}
+
+func (d *host_drive) status(sec byte) byte {
+	if sec == DOS_COMMAND_CHANNEL {
+		return d.cmd.st
+	}
+	ch := d.channels[sec]
+	if ch == nil {
+		return KERN_ST_EOF | KERN_ST_TIME_OUT_READ
+	}
+	return ch.st
+}
+
+func (d *host_drive) scratch(pattern string) (int, byte) {
+	entries, err := fs.ReadDir(d.sb.fsys, d.dir)
+	if err != nil {
+		host_error(err)
+		return 0, DOS_READ_ERROR
+	}
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() || !dos_match([]byte(pattern), []byte(petscii_string(e.Name(), d.charset))) {
+			continue
+		}
+		if d.sb.remove(path.Join(d.dir, e.Name())) != nil {
+			return n, DOS_WRITE_PROTECT_ON
+		}
+		n++
+	}
+	return n, DOS_OK
+}
+
+func (d *host_drive) rename(to string, from string) byte {
+	to_path, err1 := d.path(to)
+	from_path, err2 := d.path(from)
+	if err1 != nil || err2 != nil {
+		return DOS_INVALID_FILE_NAME
+	}
+	if _, err := fs.Stat(d.sb.fsys, to_path); err == nil {
+		return DOS_FILE_EXISTS
+	}
+	if _, err := fs.Stat(d.sb.fsys, from_path); err != nil {
+		return DOS_FILE_NOT_FOUND
+	}
+	if d.sb.rename(from_path, to_path) != nil {
+		return DOS_WRITE_PROTECT_ON
+	}
+	return DOS_OK
+}
+
+func (d *host_drive) copy_files(to string, from []string) byte {
+	var data []byte
+
+	to_path, err := d.path(to)
+	if err != nil {
+		return DOS_INVALID_FILE_NAME
+	}
+	if _, err := fs.Stat(d.sb.fsys, to_path); err == nil {
+		return DOS_FILE_EXISTS
+	}
+	for _, name := range from {
+		p, err := d.path(name)
+		if err != nil {
+			return DOS_INVALID_FILE_NAME
+		}
+		b, err := fs.ReadFile(d.sb.fsys, p)
+		if err != nil {
+			return DOS_FILE_NOT_FOUND
+		}
+		data = append(data, b...)
+	}
+	w, err := d.sb.create(to_path, false)
+	if err != nil {
+		return DOS_WRITE_PROTECT_ON
+	}
+	_, err = w.Write(data)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		host_error(err)
+		return DOS_WRITE_PROTECT_ON
+	}
+	return DOS_OK
+}
+
+// there is nothing to initialize or validate on a host directory
+func (d *host_drive) initialize() byte {
+	return DOS_OK
+}
+
+func (d *host_drive) validate() byte {
+	return DOS_OK
+}
+
+// and it can't be formatted
+func (d *host_drive) format(name string, id string) byte {
+	return DOS_UNKNOWN_COMMAND
+}
+
+/* the directory of a directory in a sandbox, as a BASIC program with names in PETSCII */
+func host_directory(sb *sandbox, dir string, cs charset) ([]byte, error) {
+	entries, err := fs.ReadDir(sb.fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	var fis []fs.FileInfo
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	name := sb.name
+	if dir != "." {
+		name = path.Base(dir)
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		return fis[i].Name() < fis[j].Name()
+	})
+
+	l := new_listing()
+	l.header(petscii_string(name, cs), "00 2A")
+	for _, fi := range fis {
+		ftype := "PRG"
+		if fi.IsDir() {
+			ftype = "DIR"
+		}
+		// convert file size from num of bytes to num of blocks (254 bytes)
+		l.entry(int((fi.Size() + 253) / 254), petscii_string(fi.Name(), cs), ftype)
+	}
+	return l.bytes(), nil
+}
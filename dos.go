@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/************************************************************
+ *
+ * DOS Command Channel
+ *
+ ************************************************************/
+
+/*
+ * Secondary address 15 of a disk drive is its command channel: what
+ * is written to it (or given as the file name when it is opened) is a
+ * DOS command, run at each carriage return, and reading it returns the
+ * drive's error status, such as "62,FILE NOT FOUND,00,00" and a
+ * carriage return. Reading the status resets it to "00, OK,00,00".
+ */
+const DOS_COMMAND_CHANNEL = 15
+
+const (
+	DOS_FILES_SCRATCHED = 1
+	DOS_SYNTAX_ERROR = 30
+	DOS_UNKNOWN_COMMAND = 31
+	DOS_INVALID_FILE_NAME = 33
+	DOS_NO_FILE_NAME = 34
+	DOS_FILE_NOT_OPEN = 61
+	DOS_DRIVE_VERSION = 73
+)
+
+var dos_messages = map[byte]string{
+	DOS_OK:				" OK",
+	DOS_FILES_SCRATCHED:	"FILES SCRATCHED",
+	DOS_READ_ERROR:		"READ ERROR",
+	DOS_WRITE_PROTECT_ON:	"WRITE PROTECT ON",
+	DOS_SYNTAX_ERROR:		"SYNTAX ERROR",
+	DOS_UNKNOWN_COMMAND:	"SYNTAX ERROR",
+	DOS_INVALID_FILE_NAME:	"SYNTAX ERROR",
+	DOS_NO_FILE_NAME:		"SYNTAX ERROR",
+	DOS_FILE_NOT_OPEN:		"FILE NOT OPEN",
+	DOS_FILE_NOT_FOUND:	"FILE NOT FOUND",
+	DOS_FILE_EXISTS:		"FILE EXISTS",
+	DOS_DISK_FULL:		"DISK FULL",
+	DOS_DRIVE_VERSION:	"CBM DOS V2.6 1541",
+}
+
+type command_channel struct {
+	err		byte
+	track	byte		// or the number of files scratched
+	sector	byte
+	cmd		[]byte
+	msg		[]byte		// the rest of the status being read
+	st		byte
+	drive	dos_drive
+}
+
+/*
+ * What a drive does for each command; each returns the resulting DOS
+ * error number. scratch also returns how many files it scratched.
+ */
+type dos_drive interface {
+	scratch(pattern string) (int, byte)
+	rename(to string, from string) byte
+	copy_files(to string, from []string) byte
+	initialize() byte
+	validate() byte
+	format(name string, id string) byte
+}
+
+// like the real drive, a freshly mounted drive reports its DOS version
+func new_command_channel(drive dos_drive) command_channel {
+	return command_channel{
+		err:		DOS_DRIVE_VERSION,
+		drive:	drive,
+	}
+}
+
+func (c *command_channel) set(err byte) {
+	c.err = err
+	c.track = 0
+	c.sector = 0
+}
+
+func (c *command_channel) message() string {
+	text, ok := dos_messages[c.err]
+	if !ok {
+		text = "UNKNOWN ERROR"
+	}
+	return fmt.Sprintf("%02d,%s,%02d,%02d\r", c.err, text, c.track, c.sector)
+}
+
+func (c *command_channel) open(name string) {
+	c.cmd = c.cmd[:0]
+	if name != "" {
+		c.run(name)
+	}
+}
+
+func (c *command_channel) run(cmd string) {
+	c.msg = nil
+	c.set(DOS_OK)
+
+	dc, err := parse_dos_command(strings.TrimRight(cmd, "\r"))
+	if err != DOS_OK {
+		c.set(err)
+		return
+	}
+	switch dc.op {
+	case 'S':
+		n := 0
+		for _, pattern := range dc.names {
+			scratched, err := c.drive.scratch(strip_drive(pattern))
+			n += scratched
+			if err != DOS_OK {
+				c.set(err)
+				return
+			}
+		}
+		c.set(DOS_FILES_SCRATCHED)
+		c.track = byte(n)
+	case 'R':
+		c.set(c.drive.rename(strip_drive(dc.names[0]), dc.sources[0]))
+	case 'C':
+		c.set(c.drive.copy_files(strip_drive(dc.names[0]), dc.sources))
+	case 'N':
+		id := ""
+		if len(dc.names) > 1 {
+			id = dc.names[1]
+		}
+		c.set(c.drive.format(strip_drive(dc.names[0]), id))
+	case 'I':
+		c.set(c.drive.initialize())
+	case 'V':
+		c.set(c.drive.validate())
+	case 'U':
+		// only the resets; block reads and writes (U1, U2) are not supported
+		if len(cmd) > 1 && (cmd[1] == 'J' || cmd[1] == 'I' || cmd[1] == ':' || cmd[1] == ';') {
+			c.set(DOS_DRIVE_VERSION)
+		} else {
+			c.set(DOS_UNKNOWN_COMMAND)
+		}
+	}
+}
+
+func (c *command_channel) write(b byte) {
+	c.st = 0
+	if b == 13 {
+		c.run(string(c.cmd))
+		c.cmd = c.cmd[:0]
+		return
+	}
+	c.cmd = append(c.cmd, b)
+}
+
+// a command without a carriage return runs when the channel is closed
+func (c *command_channel) close() {
+	if len(c.cmd) != 0 {
+		c.run(string(c.cmd))
+		c.cmd = c.cmd[:0]
+	}
+}
+
+func (c *command_channel) read() byte {
+	if c.msg == nil {
+		c.msg = []byte(c.message())
+		c.set(DOS_OK)
+	}
+	b := c.msg[0]
+	c.msg = c.msg[1:]
+	c.st = 0
+	if len(c.msg) == 0 {
+		c.st = KERN_ST_EOF
+		c.msg = nil
+	}
+	return b
+}
+
+/*
+ * A command is a letter (or two, for U1 and friends) and arguments
+ * after an optional drive number and colon:
+ *	S:NAME,NAME2		scratch
+ *	R:NEW=OLD			rename
+ *	C:NEW=OLD,OLD2		copy (and concatenate)
+ *	N:NAME,ID			new (format)
+ *	I, V, UJ			initialize, validate, reset
+ */
+type dos_command struct {
+	op		byte
+	names	[]string		// before =
+	sources	[]string		// after =
+}
+
+func parse_dos_command(s string) (dos_command, byte) {
+	var cmd dos_command
+
+	if s == "" {
+		return cmd, DOS_UNKNOWN_COMMAND
+	}
+	cmd.op = s[0]
+	args := ""
+	if i := strings.IndexByte(s, ':'); i != -1 {
+		args = s[i+1:]
+	}
+	if i := strings.IndexByte(args, '='); i != -1 {
+		cmd.sources = strings.Split(args[i+1:], ",")
+		for i := range cmd.sources {
+			cmd.sources[i] = strip_drive(cmd.sources[i])
+		}
+		args = args[:i]
+	}
+	if args != "" {
+		cmd.names = strings.Split(args, ",")
+	}
+
+	switch cmd.op {
+	case 'S':
+		if len(cmd.names) == 0 {
+			return cmd, DOS_NO_FILE_NAME
+		}
+	case 'R', 'C':
+		if len(cmd.names) != 1 || len(cmd.sources) == 0 || (cmd.op == 'R' && len(cmd.sources) != 1) {
+			return cmd, DOS_SYNTAX_ERROR
+		}
+		for _, n := range append(cmd.names, cmd.sources...) {
+			if n == "" {
+				return cmd, DOS_NO_FILE_NAME
+			}
+			if strings.ContainsAny(n, "*?") {
+				return cmd, DOS_INVALID_FILE_NAME
+			}
+		}
+	case 'N':
+		if len(cmd.names) == 0 || cmd.names[0] == "" {
+			return cmd, DOS_NO_FILE_NAME
+		}
+	case 'I', 'V', 'U':
+	default:
+		return cmd, DOS_UNKNOWN_COMMAND
+	}
+	return cmd, DOS_OK
+}
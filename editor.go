@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+/************************************************************
+ *
+ * Screen Editor
+ *
+ ************************************************************/
+
+/*
+ * With -editor, cbmbasic takes over the terminal and does what the
+ * C64's screen editor does: everything printed goes into a screen
+ * buffer, the cursor keys move around it, and RETURN hands BASIC
+ * whichever line the cursor is on, so a listed program can be edited
+ * in place. Like on the C64, a logical line is one row, or two if
+ * typing ran past the end of the first; INSERT and DELETE work within
+ * it. In quote mode (after an odd number of quotes) and for as many
+ * characters as were inserted, control keys are put on the screen as
+ * reversed characters instead of being carried out, so they can be
+ * typed into strings.
+ */
+var (
+	editor_flag = flag.Bool("editor", false, "emulate the C64 full-screen editor in the terminal")
+)
+
+type screen_cell struct {
+	c		byte		// PETSCII
+	color	int
+	rev		bool
+}
+
+type screen_editor struct {
+	cols, rows	int
+	cells		[][]screen_cell
+	linked		[]bool		// row continues the logical line of the row above
+	color		int
+	rev			bool
+	quote		bool
+	inserts		int
+	bg			int
+
+	input		[]byte		// the rest of the line RETURN was pressed on
+	out			*bufio.Writer
+}
+
+var (
+	editor_active	bool
+	editor		*screen_editor
+)
+
+func init_editor() {
+	if !*editor_flag {
+		return
+	}
+	if !keyboard_raw || !is_terminal(os.Stdout) {
+		fatalf("-editor needs a terminal in raw mode")
+	}
+	cols, rows := 40, 25
+	if *screen_size_flag != "" {
+		cols, rows = screen_cols, screen_rows
+	}
+	e := &screen_editor{
+		cols:	cols,
+		rows:	rows,
+		cells:	make([][]screen_cell, rows),
+		linked:	make([]bool, rows),
+		color:	COLOR_LTBLUE,
+		bg:		COLOR_BLUE,
+		out:		bufio.NewWriter(os.Stdout),
+	}
+	for y := range e.cells {
+		e.cells[y] = make([]screen_cell, cols)
+	}
+	editor = e
+	editor_active = true
+	screen_cols, screen_rows = cols, rows
+
+	// alternate screen, so the shell's screen comes back afterwards
+	os.Stdout.WriteString("\033[?1049h")
+	at_exit(func() {
+		os.Stdout.WriteString("\033[0m\033[?1049l")
+	})
+	e.clear()
+	e.flush()
+}
+
+/************************************************************
+ * Drawing
+ ************************************************************/
+
+func (e *screen_editor) draw_cell(x int, y int) {
+	cell := e.cells[y][x]
+	c := cell.c
+	rev := cell.rev
+	// control characters are shown as the reversed letter with the same code
+	switch {
+	case c < 0x20:
+		c += 0x40
+		rev = !rev
+	case c >= 0x80 && c < 0xA0:
+		c -= 0x20
+		rev = !rev
+	}
+	fmt.Fprintf(e.out, "\033[%d;%dH", y + 1, x + 1)
+	e.out.WriteString(color_escape(cell.color, false))
+	e.out.WriteString(color_escape(e.bg, true))
+	if rev {
+		e.out.WriteString("\033[7m")
+	}
+	write_petscii(e.out, c, screen_charset)
+	if rev {
+		e.out.WriteString("\033[27m")
+	}
+}
+
+func (e *screen_editor) draw_row(y int) {
+	for x := 0; x < e.cols; x++ {
+		e.draw_cell(x, y)
+	}
+}
+
+func (e *screen_editor) draw() {
+	for y := 0; y < e.rows; y++ {
+		e.draw_row(y)
+	}
+}
+
+// flush puts the terminal's cursor where ours is and sends everything out.
+func (e *screen_editor) flush() {
+	fmt.Fprintf(e.out, "\033[%d;%dH", cursor_y + 1, cursor_x + 1)
+	e.out.Flush()
+}
+
+/************************************************************
+ * Lines
+ ************************************************************/
+
+func (e *screen_editor) blank_row(y int) {
+	for x := range e.cells[y] {
+		e.cells[y][x] = screen_cell{ c: ' ', color: e.color }
+	}
+	e.linked[y] = false
+}
+
+func (e *screen_editor) clear() {
+	for y := 0; y < e.rows; y++ {
+		e.blank_row(y)
+	}
+	cursor_x, cursor_y = 0, 0
+	e.draw()
+}
+
+// scroll moves everything up a logical line.
+func (e *screen_editor) scroll() {
+	n := 1
+	if e.rows > 2 && e.linked[1] {
+		n = 2
+	}
+	copy(e.cells, append(e.cells[n:], e.cells[:n]...))
+	copy(e.linked, e.linked[n:])
+	for y := e.rows - n; y < e.rows; y++ {
+		e.blank_row(y)
+	}
+	e.linked[0] = false
+	cursor_y -= n
+	e.draw()
+}
+
+// open_row inserts a blank row at y, pushing the rows below it down.
+func (e *screen_editor) open_row(y int) {
+	last := e.cells[e.rows - 1]
+	copy(e.cells[y + 1:], e.cells[y:e.rows - 1])
+	copy(e.linked[y + 1:], e.linked[y:e.rows - 1])
+	e.cells[y] = last
+	e.blank_row(y)
+	for r := y; r < e.rows; r++ {
+		e.draw_row(r)
+	}
+}
+
+// line returns the first row of the logical line on row y and how many rows it has.
+func (e *screen_editor) line(y int) (int, int) {
+	if e.linked[y] {
+		y--
+	}
+	if y + 1 < e.rows && e.linked[y + 1] {
+		return y, 2
+	}
+	return y, 1
+}
+
+// cell returns the cell at offset i of the logical line starting at row y.
+func (e *screen_editor) cell(y int, i int) *screen_cell {
+	return &e.cells[y + i / e.cols][i % e.cols]
+}
+
+/*
+ * advance moves the cursor right after a character is put down. Going
+ * off the end of the first row of a logical line makes the line two
+ * rows long, opening a row for it if the next row belongs to another
+ * line; going off the end of the second starts a new line.
+ */
+func (e *screen_editor) advance() {
+	cursor_x++
+	if cursor_x < e.cols {
+		return
+	}
+	cursor_x = 0
+	if _, n := e.line(cursor_y); n == 1 {
+		if cursor_y + 1 == e.rows {
+			e.scroll()
+		} else if !e.is_blank(cursor_y + 1) {
+			e.open_row(cursor_y + 1)
+		}
+		e.linked[cursor_y + 1] = true
+		cursor_y++
+		return
+	}
+	e.next_line()
+}
+
+func (e *screen_editor) is_blank(y int) bool {
+	if e.linked[y] || (y + 1 < e.rows && e.linked[y + 1]) {
+		return false
+	}
+	for _, cell := range e.cells[y] {
+		if cell.c != ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+// next_line moves to the start of the next logical line, scrolling at the bottom.
+func (e *screen_editor) next_line() {
+	start, n := e.line(cursor_y)
+	cursor_x = 0
+	cursor_y = start + n
+	for cursor_y >= e.rows {
+		e.scroll()
+	}
+}
+
+/************************************************************
+ * Output
+ ************************************************************/
+
+var color_codes = map[byte]int{
+	5:	COLOR_WHITE,
+	28:	COLOR_RED,
+	30:	COLOR_GREEN,
+	31:	COLOR_BLUE,
+	129:	COLOR_ORANGE,
+	144:	COLOR_BLACK,
+	149:	COLOR_BROWN,
+	150:	COLOR_LTRED,
+	151:	COLOR_GREY1,
+	152:	COLOR_GREY2,
+	153:	COLOR_LTGREEN,
+	154:	COLOR_LTBLUE,
+	155:	COLOR_GREY3,
+	156:	COLOR_PURPLE,
+	158:	COLOR_YELLOW,
+	159:	COLOR_CYAN,
+}
+
+func (e *screen_editor) put(c byte) {
+	e.cells[cursor_y][cursor_x] = screen_cell{ c: c, color: e.color, rev: e.rev }
+	e.draw_cell(cursor_x, cursor_y)
+	e.advance()
+}
+
+// chrout does what printing c (or typing it) does on the C64 screen.
+func (e *screen_editor) chrout(c byte) {
+	defer e.flush()
+
+	if c == 13 || c == 141 {
+		e.quote = false
+		e.inserts = 0
+		e.rev = false
+		e.next_line()
+		return
+	}
+	control := c < 0x20 || (c >= 0x80 && c < 0xA0)
+	if control && (e.inserts > 0 || (e.quote && c != 20)) {
+		e.put(c)
+		if e.inserts > 0 {
+			e.inserts--
+		}
+		return
+	}
+	if !control {
+		if c == '"' {
+			e.quote = !e.quote
+		}
+		e.put(c)
+		if e.inserts > 0 {
+			e.inserts--
+		}
+		return
+	}
+
+	if color, ok := color_codes[c]; ok {
+		e.color = color
+		return
+	}
+	switch c {
+	case 14:
+		if screen_charset != CHARSET_NONE {
+			screen_charset = CHARSET_LOWER
+			e.draw()
+		}
+	case 142:
+		if screen_charset != CHARSET_NONE {
+			screen_charset = CHARSET_UPPER
+			e.draw()
+		}
+	case 17:		// CRSR DOWN
+		cursor_y++
+		if cursor_y == e.rows {
+			e.scroll()
+		}
+	case 145:		// CRSR UP
+		if cursor_y > 0 {
+			cursor_y--
+		}
+	case 29:		// CRSR RIGHT
+		cursor_x++
+		if cursor_x == e.cols {
+			cursor_x = 0
+			cursor_y++
+			if cursor_y == e.rows {
+				e.scroll()
+			}
+		}
+	case 157:		// CRSR LEFT
+		cursor_x--
+		if cursor_x < 0 {
+			cursor_x = 0
+			if cursor_y > 0 {
+				cursor_x = e.cols - 1
+				cursor_y--
+			}
+		}
+	case 18:
+		e.rev = true
+	case 146:
+		e.rev = false
+	case 19:
+		cursor_x, cursor_y = 0, 0
+	case 147:
+		e.clear()
+	case 20:
+		e.delete()
+	case 148:
+		e.insert()
+	}
+}
+
+// delete removes the character left of the cursor, pulling the rest of the line left.
+func (e *screen_editor) delete() {
+	start, n := e.line(cursor_y)
+	pos := (cursor_y - start) * e.cols + cursor_x
+	if pos == 0 {
+		return
+	}
+	end := n * e.cols
+	for i := pos - 1; i < end - 1; i++ {
+		*e.cell(start, i) = *e.cell(start, i + 1)
+	}
+	*e.cell(start, end - 1) = screen_cell{ c: ' ', color: e.color }
+	pos--
+	cursor_x, cursor_y = pos % e.cols, start + pos / e.cols
+	for y := start; y < start + n; y++ {
+		e.draw_row(y)
+	}
+}
+
+// insert opens a space at the cursor, making the line longer if it's full and can be.
+func (e *screen_editor) insert() {
+	start, n := e.line(cursor_y)
+	end := n * e.cols
+	if e.cell(start, end - 1).c != ' ' {
+		if n == 2 {
+			return
+		}
+		if start + 1 == e.rows {
+			e.scroll()
+			start--
+		} else {
+			e.open_row(start + 1)
+		}
+		e.linked[start + 1] = true
+		n, end = 2, 2 * e.cols
+	}
+	pos := (cursor_y - start) * e.cols + cursor_x
+	for i := end - 1; i > pos; i-- {
+		*e.cell(start, i) = *e.cell(start, i - 1)
+	}
+	*e.cell(start, pos) = screen_cell{ c: ' ', color: e.color }
+	e.inserts++
+	for y := start; y < start + n; y++ {
+		e.draw_row(y)
+	}
+}
+
+/************************************************************
+ * Input
+ ************************************************************/
+
+/*
+ * chrin gives BASIC the next character of the line RETURN was pressed
+ * on, letting the user edit the screen until then. If RETURN is pressed
+ * on the line input started on (after INPUT's question mark, say), the
+ * line starts where the cursor was; anywhere else, it's the whole line.
+ */
+func (e *screen_editor) chrin() byte {
+	if len(e.input) == 0 {
+		e.readline()
+	}
+	c := e.input[0]
+	e.input = e.input[1:]
+	return c
+}
+
+func (e *screen_editor) readline() {
+	in_x, in_y := cursor_x, cursor_y
+	in_start, _ := e.line(in_y)
+	e.flush()
+	for {
+		k := next_key()
+		if k == KEY_EOF {
+			exit(0)
+		}
+		if k == KEY_STOP {
+			stop_pressed()		// nothing to stop while typing
+			continue
+		}
+		if k != 13 && k != 141 {
+			e.chrout(k)
+			continue
+		}
+
+		start, n := e.line(cursor_y)
+		from := 0
+		if start == in_start {
+			from = (in_y - start) * e.cols + in_x
+		}
+		end := n * e.cols
+		for end > from && e.cell(start, end - 1).c == ' ' {
+			end--
+		}
+		e.input = e.input[:0]
+		for i := from; i < end; i++ {
+			e.input = append(e.input, e.cell(start, i).c)
+		}
+		e.input = append(e.input, 13)
+
+		// like on the C64, the cursor stays put until BASIC prints a carriage return
+		e.quote = false
+		e.inserts = 0
+		e.rev = false
+		return
+	}
+}
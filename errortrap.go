@@ -0,0 +1,291 @@
+package main
+
+import (
+	"math"
+)
+
+/************************************************************
+ *
+ * Error Trapping
+ *
+ ************************************************************/
+
+/*
+ * With the plugin on (SYS 1), a program can catch its own errors:
+ *
+ * ON ERROR GOTO line	go to line on an error instead of stopping
+ * ON ERROR GOTO 0		stop on errors again
+ * RESUME			run the statement that failed again
+ * RESUME NEXT		go on after the statement that failed
+ * RESUME line		go on at line
+ *
+ * The error handler finds the error number in ER and the line it
+ * happened in in EL. An error in the handler itself (before RESUME)
+ * stops the program as usual, and so do errors in direct mode. Nothing
+ * changes for programs that don't use ON ERROR, and the trap is gone
+ * at READY.
+ *
+ * The current statement is noted in GONE, and an error jumps to the
+ * handler with the stack as it was at the start of that statement, so
+ * whatever the statement left on it is dropped.
+ */
+const (
+	NEWSTT = 0xA7AE		// the next statement, after TXTPTR
+	GONE_VECTOR = 0xA7E1	// the statement at TXTPTR + 1, through IGONE
+)
+
+var (
+	on_error_line		int = -1		// the handler, or -1
+	in_error_handler	bool
+
+	// where the current statement started
+	statement_chrptr	uint16
+	statement_line		uint16
+	statement_sp		byte
+
+	// where the error happened
+	resume_chrptr		uint16
+	resume_line		uint16
+)
+
+func init() {
+	on_hook(HOOK_READY, func() {
+		on_error_line = -1
+		in_error_handler = false
+	})
+}
+
+func get_curlin() uint16 {
+	return uint16(RAM[0x39]) | (uint16(RAM[0x3A]) << 8)
+}
+
+func set_curlin(l uint16) {
+	RAM[0x39] = byte(l & 0xFF)
+	RAM[0x3A] = byte(l >> 8)
+}
+
+// direct_mode is whether BASIC is running a line typed at READY rather than a program (CURLIN is $FFxx).
+func direct_mode() bool {
+	return RAM[0x3A] == 0xFF
+}
+
+/* note_statement remembers where the statement GONE is about to run starts */
+func note_statement() {
+	statement_chrptr = get_chrptr()
+	statement_line = get_curlin()
+	statement_sp = S
+}
+
+/* find_line returns the address of program line n; links that don't go forward end the program */
+func find_line(n uint16) (uint16, bool) {
+	addr := int(RAM[0x2B]) | int(RAM[0x2C]) << 8
+	for addr < 0xFFFC && RAM[addr + 1] != 0 {
+		num := uint16(RAM[addr + 2]) | (uint16(RAM[addr + 3]) << 8)
+		if num == n {
+			return uint16(addr), true
+		}
+		if num > n {
+			break
+		}
+		next := int(RAM[addr]) | int(RAM[addr + 1]) << 8
+		if next <= addr {
+			break
+		}
+		addr = next
+	}
+	return 0, false
+}
+
+/* goto_line makes the next statement the start of line n, like GOTO */
+func goto_line(n uint16) uint16 {
+	addr, ok := find_line(n)
+	if !ok {
+		return error_x(ERROR_UNDEFD_STATMENT)
+	}
+	set_chrptr(addr - 1)		// the end of the line before
+	kernal_sp = int(statement_sp)
+	return NEWSTT
+}
+
+/* get_line_number reads the line number at TXTPTR, like LINGET */
+func get_line_number() (uint16, bool) {
+	var n uint
+
+	CHRGOT()
+	if A < '0' || A > '9' {
+		return 0, false
+	}
+	for A >= '0' && A <= '9' {
+		n = n * 10 + uint(A - '0')
+		if n > 63999 {
+			return 0, false
+		}
+		CHRGET()
+	}
+	return uint16(n), true
+}
+
+// end_of_statement is whether TXTPTR is at the end of a statement.
+func end_of_statement() bool {
+	CHRGOT()
+	return A == 0 || A == ':'
+}
+
+/*
+ * skip_statement returns the address of the : or end of line after the
+ * statement at addr, for RESUME NEXT. A colon in quotes doesn't end it,
+ * which is also how DATA ends. REM takes the rest of the line, and so
+ * does IF: the error was either in its condition or in the statement
+ * right after THEN (which runs without going through GONE), and either
+ * way the rest of the line belongs to the IF.
+ */
+func skip_statement(addr uint16) uint16 {
+	for RAM[addr] == ' ' {
+		addr++
+	}
+	rest_of_line := RAM[addr] == TOKEN_REM || RAM[addr] == TOKEN_IF
+	quote := false
+	for {
+		c := RAM[addr]
+		if c == 0 || (c == ':' && !quote && !rest_of_line) {
+			return addr
+		}
+		if c == '"' {
+			quote = !quote
+		}
+		addr++
+	}
+}
+
+/* on_error handles ON ERROR GOTO, after the GOTO */
+func on_error() uint16 {
+	n, ok := get_line_number()
+	if !ok || !end_of_statement() {
+		return error_x(ERROR_SYNTAX)
+	}
+	if n == 0 {
+		on_error_line = -1
+	} else {
+		on_error_line = int(n)
+	}
+	return NEWSTT
+}
+
+/* resume handles RESUME, RESUME NEXT and RESUME line, after the RESUME */
+func resume() uint16 {
+	if !in_error_handler {
+		return error_x(ERROR_CANT_CONTINUE)
+	}
+	CHRGOT()
+	switch {
+	case A == 0x82:		// NEXT
+		CHRGET()
+		if !end_of_statement() {
+			return error_x(ERROR_SYNTAX)
+		}
+		in_error_handler = false
+		set_curlin(resume_line)
+		set_chrptr(skip_statement(resume_chrptr + 1))
+		kernal_sp = int(statement_sp)
+		return NEWSTT
+	case A >= '0' && A <= '9':
+		n, ok := get_line_number()
+		if !ok || !end_of_statement() {
+			return error_x(ERROR_SYNTAX)
+		}
+		in_error_handler = false
+		return goto_line(n)
+	case A == 0 || A == ':':
+		in_error_handler = false
+		set_curlin(resume_line)
+		set_chrptr(resume_chrptr)
+		kernal_sp = int(statement_sp)
+		return GONE_VECTOR
+	}
+	return error_x(ERROR_SYNTAX)
+}
+
+/* trap_error jumps to the ON ERROR handler for error X, or returns 0 to report it */
+func trap_error() uint16 {
+	if X & 0x80 != 0 || on_error_line < 0 || in_error_handler || direct_mode() {
+		return 0
+	}
+	err := X
+	resume_chrptr = statement_chrptr
+	resume_line = statement_line
+	if !set_variable("ER", float64(err)) || !set_variable("EL", float64(resume_line)) {
+		return 0
+	}
+	in_error_handler = true
+	return goto_line(uint16(on_error_line))
+}
+
+/************************************************************
+ * Variables
+ ************************************************************/
+
+/* cbm_float packs v in the five-byte format variables are stored in */
+func cbm_float(v float64) [5]byte {
+	var b [5]byte
+
+	if v == 0 {
+		return b
+	}
+	f, e := math.Frexp(math.Abs(v))		// f is 0.5 to 1
+	if e + 0x80 > 0xFF {
+		e = 0xFF - 0x80
+		f = 1 - math.Pow(2, -32)
+	} else if e + 0x80 < 1 {
+		return b
+	}
+	m := uint32(f * (1 << 32))
+	b[0] = byte(e + 0x80)
+	b[1] = byte(m >> 24) & 0x7F		// the top bit is always 1, so it holds the sign
+	if v < 0 {
+		b[1] |= 0x80
+	}
+	b[2] = byte(m >> 16)
+	b[3] = byte(m >> 8)
+	b[4] = byte(m)
+	return b
+}
+
+/*
+ * set_variable sets the float variable name, making it if there is
+ * none, after the other simple variables (so the arrays move up). It
+ * returns false if there is no room below FRETOP, or if the pointers
+ * to the variables are out of order.
+ */
+func set_variable(name string, v float64) bool {
+	var id [2]byte
+	copy(id[:], name)
+
+	vartab := int(RAM[0x2D]) | int(RAM[0x2E]) << 8
+	arytab := int(RAM[0x2F]) | int(RAM[0x30]) << 8
+	strend := int(RAM[0x31]) | int(RAM[0x32]) << 8
+	fretop := int(RAM[0x33]) | int(RAM[0x34]) << 8
+	if vartab > arytab || arytab > strend || strend > fretop {
+		return false
+	}
+	addr := vartab
+	for ; addr + 7 <= arytab; addr += 7 {
+		if RAM[addr] == id[0] && RAM[addr + 1] == id[1] {
+			break
+		}
+	}
+	if addr + 7 > arytab {
+		addr = arytab
+		if strend + 7 > fretop {
+			return false
+		}
+		copy(RAM[arytab + 7:strend + 7], RAM[arytab:strend])
+		arytab += 7
+		strend += 7
+		RAM[0x2F], RAM[0x30] = byte(arytab), byte(arytab >> 8)
+		RAM[0x31], RAM[0x32] = byte(strend), byte(strend >> 8)
+		RAM[addr], RAM[addr + 1] = id[0], id[1]
+	}
+	f := cbm_float(v)
+	copy(RAM[addr + 2:addr + 7], f[:])
+	return true
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCbmFloat(t *testing.T) {
+	tests := []struct {
+		v		float64
+		want		[5]byte
+	}{
+		{ 0, [5]byte{ 0x00, 0x00, 0x00, 0x00, 0x00 } },
+		{ 1, [5]byte{ 0x81, 0x00, 0x00, 0x00, 0x00 } },
+		{ -1, [5]byte{ 0x81, 0x80, 0x00, 0x00, 0x00 } },
+		{ 0.5, [5]byte{ 0x80, 0x00, 0x00, 0x00, 0x00 } },
+		{ 10, [5]byte{ 0x84, 0x20, 0x00, 0x00, 0x00 } },
+		{ 63999, [5]byte{ 0x90, 0x79, 0xFF, 0x00, 0x00 } },
+	}
+
+	for _, tt := range tests {
+		if got := cbm_float(tt.v); got != tt.want {
+			t.Errorf("%v: got % X, want % X", tt.v, got, tt.want)
+		}
+	}
+}
+
+// load_test_program puts a program at $0801 with no variables yet, with the plugin's keywords crunched
+func load_test_program(t *testing.T, text string) {
+	saved := *plugin_keywords_flag
+	*plugin_keywords_flag = true
+	prg, err := tokenize_basic([]byte(text), CHARSET_UPPER, BASIC_START)
+	*plugin_keywords_flag = saved
+	if err != nil {
+		t.Fatal(err)
+	}
+	RAM[0x2B], RAM[0x2C] = 0x01, 0x08
+	if err := install_program(prg[2:]); err != nil {
+		t.Fatal(err)
+	}
+	copy(RAM[0x2F:0x33], []byte{ RAM[0x2D], RAM[0x2E], RAM[0x2D], RAM[0x2E] })		// ARYTAB, STREND
+	RAM[0x33], RAM[0x34] = 0x00, 0xA0		// FRETOP
+}
+
+func find_variable(name string) []byte {
+	vartab := uint16(RAM[0x2D]) | (uint16(RAM[0x2E]) << 8)
+	arytab := uint16(RAM[0x2F]) | (uint16(RAM[0x30]) << 8)
+	for addr := vartab; addr < arytab; addr += 7 {
+		if string(RAM[addr:addr + 2]) == name {
+			return RAM[addr + 2:addr + 7]
+		}
+	}
+	return nil
+}
+
+func TestSetVariable(t *testing.T) {
+	load_test_program(t, "10 END\n")
+	// an array after the variables
+	array := []byte{ 'B', 0, 12, 0, 1, 0, 2, 0, 0, 0, 0, 0 }
+	arytab := uint16(RAM[0x2F]) | (uint16(RAM[0x30]) << 8)
+	copy(RAM[arytab:], array)
+	strend := arytab + uint16(len(array))
+	RAM[0x31], RAM[0x32] = byte(strend), byte(strend >> 8)
+
+	if !set_variable("ER", 11) || !set_variable("EL", 20) || !set_variable("ER", 14) {
+		t.Fatalf("no room for variables")
+	}
+	if got, want := find_variable("ER"), cbm_float(14); !bytes.Equal(got, want[:]) {
+		t.Errorf("ER is % X, want % X", got, want)
+	}
+	if got, want := find_variable("EL"), cbm_float(20); !bytes.Equal(got, want[:]) {
+		t.Errorf("EL is % X, want % X", got, want)
+	}
+	moved := uint16(RAM[0x2F]) | (uint16(RAM[0x30]) << 8)
+	if moved != arytab + 14 || !bytes.Equal(RAM[moved:moved + uint16(len(array))], array) {
+		t.Errorf("array at $%04X is % X, want it at $%04X", moved, RAM[moved:moved + uint16(len(array))], arytab + 14)
+	}
+
+	RAM[0x33], RAM[0x34] = RAM[0x31], RAM[0x32]		// memory full
+	if set_variable("ZZ", 1) {
+		t.Errorf("variable made without room")
+	}
+
+	// pointers at the top of memory, or out of order, don't move anything
+	RAM[0x31], RAM[0x32] = 0xFC, 0xFF
+	RAM[0x33], RAM[0x34] = 0xFF, 0xFF
+	if set_variable("ZZ", 1) {
+		t.Errorf("variable made past the end of memory")
+	}
+	RAM[0x2F], RAM[0x30] = 0xFE, 0xFF
+	RAM[0x31], RAM[0x32] = 0x00, 0x10
+	if set_variable("ZZ", 1) {
+		t.Errorf("variable made with ARYTAB past STREND")
+	}
+}
+
+// statement_at points TXTPTR before statement n (from 0) of line l, like GONE does
+func statement_at(t *testing.T, l uint16, n int) {
+	addr, ok := find_line(l)
+	if !ok {
+		t.Fatalf("no line %d", l)
+	}
+	p := addr + 3
+	for ; n > 0; n-- {
+		p = skip_statement(p + 1)
+	}
+	set_chrptr(p)
+	set_curlin(l)
+}
+
+func TestFindLine(t *testing.T) {
+	load_test_program(t, "10 END\n20 END\n30 END\n")
+	if addr, ok := find_line(20); !ok || RAM[addr + 2] != 20 {
+		t.Errorf("line 20 not found")
+	}
+	if _, ok := find_line(25); ok {
+		t.Errorf("line 25 found")
+	}
+	// a link back to the start doesn't go round for ever
+	line20, _ := find_line(20)
+	RAM[line20], RAM[line20 + 1] = 0x01, 0x08
+	if _, ok := find_line(30); ok {
+		t.Errorf("line 30 found through a link back")
+	}
+}
+
+func TestErrorTrap(t *testing.T) {
+	defer func() {
+		on_error_line, in_error_handler = -1, false
+		kernal_sp = -1
+	}()
+	load_test_program(t, "10 ON ERROR GOTO 100\n20 PRINT \"A:B\";1/0:PRINT \"NEXT\"\n100 RESUME NEXT\n110 RESUME 10\n120 RESUME\n")
+
+	// ON ERROR GOTO 100
+	statement_at(t, 10, 0)
+	if !compare("\221ERR\260\211") {
+		t.Fatalf("no ON ERROR GOTO")
+	}
+	if pc := on_error(); pc != NEWSTT || on_error_line != 100 {
+		t.Fatalf("ON ERROR GOTO: pc $%04X, handler %d", pc, on_error_line)
+	}
+
+	// not in direct mode
+	set_curlin(0xFF00)
+	X = ERROR_SYNTAX
+	if trap_error() != 0 {
+		t.Errorf("error trapped in direct mode")
+	}
+
+	// the error in line 20
+	statement_at(t, 20, 0)
+	S = 0xF0
+	note_statement()
+	stmt := get_chrptr()
+	S = 0xE0
+	X = ERROR_DEVISION_BY_ZERO
+	if pc := trap_error(); pc != NEWSTT {
+		t.Fatalf("error not trapped: pc $%04X", pc)
+	}
+	handler, _ := find_line(100)
+	if get_chrptr() != handler - 1 || kernal_sp != 0xF0 {
+		t.Errorf("TXTPTR $%04X SP $%02X, want $%04X $F0", get_chrptr(), kernal_sp, handler - 1)
+	}
+	if got, want := find_variable("ER"), cbm_float(ERROR_DEVISION_BY_ZERO); !bytes.Equal(got, want[:]) {
+		t.Errorf("ER is % X, want % X", got, want)
+	}
+	if got, want := find_variable("EL"), cbm_float(20); !bytes.Equal(got, want[:]) {
+		t.Errorf("EL is % X, want % X", got, want)
+	}
+
+	// an error in the handler isn't
+	if trap_error() != 0 {
+		t.Errorf("error in the handler trapped")
+	}
+
+	// RESUME NEXT goes past the quoted colon to the next statement
+	statement_at(t, 100, 0)
+	compare(keyword("RESUME"))
+	if pc := resume(); pc != NEWSTT || get_curlin() != 20 {
+		t.Fatalf("RESUME NEXT: pc $%04X line %d", pc, get_curlin())
+	}
+	if c := RAM[get_chrptr()]; c != ':' || RAM[get_chrptr() + 1] != TOKEN_PRINT || RAM[get_chrptr() - 1] != '0' {
+		t.Errorf("RESUME NEXT: TXTPTR at % X", RAM[get_chrptr() - 1:get_chrptr() + 2])
+	}
+
+	// RESUME without an error
+	statement_at(t, 120, 0)
+	compare(keyword("RESUME"))
+	if pc := resume(); pc != ROM_ERROR || X != ERROR_CANT_CONTINUE {
+		t.Errorf("RESUME outside the handler: pc $%04X X %d", pc, X)
+	}
+
+	// RESUME runs the statement again
+	in_error_handler = true
+	if pc := resume(); pc != GONE_VECTOR || get_chrptr() != stmt {
+		t.Errorf("RESUME: pc $%04X TXTPTR $%04X, want $%04X", pc, get_chrptr(), stmt)
+	}
+
+	// RESUME line
+	in_error_handler = true
+	statement_at(t, 110, 0)
+	compare(keyword("RESUME"))
+	line10, _ := find_line(10)
+	if pc := resume(); pc != NEWSTT || get_chrptr() != line10 - 1 || in_error_handler {
+		t.Errorf("RESUME 10: pc $%04X TXTPTR $%04X", pc, get_chrptr())
+	}
+}
+
+func TestSkipStatement(t *testing.T) {
+	load_test_program(t, "10 PRINT \"A:B\":X=1\n20 DATA 1,\"A:B\",C:X=1\n30 REM A:B:C\n40 IF A THEN B=1:C=2\n50 X=1: REM :Y\n")
+
+	tests := []struct {
+		line		uint16
+		n		int
+		want		byte		// the byte after the colon, or 0 for the end of the line
+	}{
+		{ 10, 0, 'X' },
+		{ 20, 0, 'X' },		// DATA ends at a colon out of quotes
+		{ 30, 0, 0 },
+		{ 40, 0, 0 },		// the statements after THEN belong to the IF
+		{ 50, 0, ' ' },
+		{ 50, 1, 0 },
+	}
+
+	for _, tt := range tests {
+		statement_at(t, tt.line, tt.n)
+		end := skip_statement(get_chrptr() + 1)
+		got := RAM[end]
+		if got == ':' {
+			got = RAM[end + 1]
+		}
+		if got != tt.want {
+			t.Errorf("line %d statement %d: ends at % X", tt.line, tt.n, RAM[end:end + 2])
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+/************************************************************
+ *
+ * BASIC Extensions
+ *
+ ************************************************************/
+
+/*
+ * New statements and functions are written in Go, each in a file of its
+ * own that registers them when the program starts:
+ *
+ *	func init() {
+ *		register_statement("BEEP", beep)
+ *		register_function("DEC", dec)
+ *		register_string_function("HEX$", hex)
+ *	}
+ *
+ * Each name becomes a plugin keyword (see plugin.go), so they work after
+ * SYS 1, like LOCATE. The handler reads its arguments from the
+ * basic_args it is given, one at a time, and the commas between them are
+ * checked for it; a function's arguments are in parentheses, which may be
+ * empty. Strings come and go as Go strings, translated from and to
+ * PETSCII in the screen's character set.
+ *
+ * A handler returns basic_err(ERROR_...) for a BASIC error, or wraps one
+ * (fmt.Errorf("...: %w", ...)) to have the reason logged too; any other
+ * error is logged like a host error and becomes ?ILLEGAL QUANTITY. When
+ * BASIC itself finds an error in an argument (?TYPE MISMATCH for a string
+ * where a number should be, ?SYNTAX for a missing comma), the handler is
+ * dropped where it is, so it shouldn't leave anything half done.
+ */
+type basic_args struct {
+	n		int		// how many have been read
+}
+
+// a BASIC error, with its ERROR_ number
+type basic_err byte
+
+func (e basic_err) Error() string {
+	return fmt.Sprintf("BASIC error %d", byte(e))
+}
+
+func register_statement(name string, f func(args *basic_args) error) {
+	add_plugin_keyword(name, func() uint16 {
+		var args basic_args
+
+		if err := f(&args); err != nil {
+			return basic_error_pc(err)
+		}
+		return end_statement()
+	}, nil)
+}
+
+func register_function(name string, f func(args *basic_args) (float64, error)) {
+	if strings.HasSuffix(name, "$") {
+		fatalf("function %s returns a number, but its name ends in $", name)
+	}
+	add_plugin_keyword(name, nil, func() uint16 {
+		return run_function(func(args *basic_args) error {
+			v, err := f(args)
+			if err != nil {
+				return err
+			}
+			return set_fac(v)
+		})
+	})
+}
+
+func register_string_function(name string, f func(args *basic_args) (string, error)) {
+	if !strings.HasSuffix(name, "$") {
+		fatalf("function %s returns a string, but its name doesn't end in $", name)
+	}
+	add_plugin_keyword(name, nil, func() uint16 {
+		return run_function(func(args *basic_args) error {
+			s, err := f(args)
+			if err != nil {
+				return err
+			}
+			return make_string(petscii_string(s, screen_charset))
+		})
+	})
+}
+
+/* basic_error_pc raises the BASIC error for err */
+func basic_error_pc(err error) uint16 {
+	var e basic_err
+
+	if !errors.As(err, &e) {
+		host_error(err)
+		return error_x(ERROR_ILLEGAL_QUANTITY)
+	}
+	if err != error(e) {
+		host_error(err)
+	}
+	return error_x(byte(e))
+}
+
+/*
+ * run_function runs a function in EVAL, with TXTPTR on the character
+ * after its keyword; the result is in FAC when it returns, and BASIC goes
+ * on with CHRGET past the closing parenthesis, as after a number.
+ */
+func run_function(f func(args *basic_args) error) uint16 {
+	var args basic_args
+
+	CHRGOT()
+	if A != '(' {
+		return error_x(ERROR_SYNTAX)
+	}
+	CHRGET()
+	if err := f(&args); err != nil {
+		return basic_error_pc(err)
+	}
+	CHRGOT()
+	if A != ')' {
+		return error_x(ERROR_SYNTAX)
+	}
+	return ROM_CHRGET
+}
+
+/************************************************************
+ * Arguments
+ ************************************************************/
+
+func (a *basic_args) next() {
+	if a.n > 0 {
+		check_comma()
+	}
+	a.n++
+}
+
+/* more returns whether there is another argument to read */
+func (a *basic_args) more() bool {
+	CHRGOT()
+	if a.n > 0 {
+		return A == ','
+	}
+	return A != 0 && A != ':' && A != ')'
+}
+
+// get_word reads an argument from 0 to 65535.
+func (a *basic_args) get_word() uint16 {
+	a.next()
+	return get_word()
+}
+
+// get_byte reads an argument from 0 to 255.
+func (a *basic_args) get_byte() byte {
+	a.next()
+	return get_byte()
+}
+
+func (a *basic_args) get_number() float64 {
+	a.next()
+	call(ROM_FRMNUM)
+	return fac_value()
+}
+
+func (a *basic_args) get_string() string {
+	a.next()
+	return unicode_string(get_string(), screen_charset)
+}
+
+/************************************************************
+ * Results
+ ************************************************************/
+
+/* fac_value returns the number in FAC */
+func fac_value() float64 {
+	if RAM[0x61] == 0 {
+		return 0
+	}
+	m := uint32(RAM[0x62]) << 24 | uint32(RAM[0x63]) << 16 | uint32(RAM[0x64]) << 8 | uint32(RAM[0x65])
+	v := math.Ldexp(float64(m), int(RAM[0x61]) - 0x80 - 32)
+	if RAM[0x66] & 0x80 != 0 {
+		v = -v
+	}
+	return v
+}
+
+/* set_fac puts v in FAC as the number an expression gave */
+func set_fac(v float64) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return basic_err(ERROR_OVERFLOW)
+	}
+	for i := 0x61; i <= 0x66; i++ {
+		RAM[i] = 0
+	}
+	RAM[0x70] = 0		// rounding
+	RAM[0x0D] = 0		// VALTYP: a number
+	RAM[0x0E] = 0		// INTFLG: not an integer
+	if v == 0 {
+		return nil
+	}
+	f, e := math.Frexp(math.Abs(v))		// f is 0.5 to 1
+	if e + 0x80 > 0xFF {
+		return basic_err(ERROR_OVERFLOW)
+	} else if e + 0x80 < 1 {
+		return nil
+	}
+	m := uint32(f * (1 << 32))
+	RAM[0x61] = byte(e + 0x80)
+	RAM[0x62] = byte(m >> 24)
+	RAM[0x63] = byte(m >> 16)
+	RAM[0x64] = byte(m >> 8)
+	RAM[0x65] = byte(m)
+	if v < 0 {
+		RAM[0x66] = 0xFF
+	}
+	return nil
+}
+
+/* make_string puts s in string space, and its descriptor in FAC, as the string an expression gave */
+func make_string(s string) error {
+	if len(s) > 255 {
+		return basic_err(ERROR_STRING_TOO_LONG)
+	}
+	A = byte(len(s))
+	call(ROM_STRSPA)
+	addr := uint16(RAM[0x62]) | (uint16(RAM[0x63]) << 8)
+	copy(RAM[addr:], s)
+	call(ROM_PUTNEW)		// VALTYP is a string now
+	return nil
+}
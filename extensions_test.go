@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFac(t *testing.T) {
+	tests := []struct {
+		v		float64
+		want		[]byte		// $61-$66
+	}{
+		{ 0, []byte{ 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 } },
+		{ 1, []byte{ 0x81, 0x80, 0x00, 0x00, 0x00, 0x00 } },
+		{ -0.5, []byte{ 0x80, 0x80, 0x00, 0x00, 0x00, 0xFF } },
+		{ 10, []byte{ 0x84, 0xA0, 0x00, 0x00, 0x00, 0x00 } },
+		{ 65535, []byte{ 0x90, 0xFF, 0xFF, 0x00, 0x00, 0x00 } },
+	}
+
+	for _, tt := range tests {
+		RAM[0x0D] = 0xFF
+		if err := set_fac(tt.v); err != nil {
+			t.Errorf("%v: unexpected error %v", tt.v, err)
+			continue
+		}
+		if !bytes.Equal(RAM[0x61:0x67], tt.want) || RAM[0x0D] != 0 {
+			t.Errorf("%v: FAC % X VALTYP %d, want % X 0", tt.v, RAM[0x61:0x67], RAM[0x0D], tt.want)
+		}
+		if got := fac_value(); got != tt.v {
+			t.Errorf("%v: read back as %v", tt.v, got)
+		}
+	}
+	for _, v := range []float64{ 1e39, math.Inf(1), math.NaN() } {
+		if err := set_fac(v); err != basic_err(ERROR_OVERFLOW) {
+			t.Errorf("%v: error %v, want ?OVERFLOW", v, err)
+		}
+	}
+}
+
+func TestBasicErrorPC(t *testing.T) {
+	defer func(w io.Writer) {
+		diagnostics = w
+	}(diagnostics)
+
+	tests := []struct {
+		err		error
+		want_x	byte
+		logged	bool
+	}{
+		{ basic_err(ERROR_TYPE_MISMATCH), ERROR_TYPE_MISMATCH, false },
+		{ fmt.Errorf("no such disk: %w", basic_err(ERROR_FILE_NOT_FOUND)), ERROR_FILE_NOT_FOUND, true },
+		{ errors.New("host on fire"), ERROR_ILLEGAL_QUANTITY, true },
+	}
+	for _, tt := range tests {
+		var log bytes.Buffer
+
+		diagnostics = &log
+		if pc := basic_error_pc(tt.err); pc != ROM_ERROR || X != tt.want_x {
+			t.Errorf("%v: pc $%04X X %d, want $A437 %d", tt.err, pc, X, tt.want_x)
+		}
+		if logged := strings.Contains(log.String(), tt.err.Error()); logged != tt.logged {
+			t.Errorf("%v: logged %q", tt.err, log.String())
+		}
+	}
+}
+
+func TestRegisterStatement(t *testing.T) {
+	defer func(k []plugin_keyword) {
+		plugin_keywords = k
+	}(plugin_keywords)
+	defer func(w io.Writer) {
+		diagnostics = w
+	}(diagnostics)
+	diagnostics = &bytes.Buffer{}
+
+	ran := 0
+	register_statement("TESTOK", func(args *basic_args) error {
+		ran++
+		if args.more() {
+			return basic_err(ERROR_SYNTAX)
+		}
+		return nil
+	})
+	register_statement("TESTFAIL", func(args *basic_args) error {
+		return errors.New("it failed")
+	})
+	register_function("TWO", func(args *basic_args) (float64, error) {
+		return 2, nil
+	})
+	load_test_program(t, "10 TESTOK:TESTOK\n20 TESTOK 1\n30 TESTFAIL\n40 TWO\n")
+
+	tests := []struct {
+		line		uint16
+		want_pc	uint16
+		want_x	byte
+	}{
+		{ 10, NEWSTT, 0 },
+		{ 20, ROM_ERROR, ERROR_SYNTAX },
+		{ 30, ROM_ERROR, ERROR_ILLEGAL_QUANTITY },
+		{ 40, ROM_ERROR, ERROR_SYNTAX },		// a function as a statement
+	}
+	for _, tt := range tests {
+		statement_at(t, tt.line, 0)
+		X = 0
+		if pc := plugin_gone(); pc != tt.want_pc || X != tt.want_x {
+			t.Errorf("line %d: pc $%04X X %d, want $%04X %d", tt.line, pc, X, tt.want_pc, tt.want_x)
+		}
+	}
+	if ran != 2 {
+		t.Errorf("TESTOK ran %d times, want 2", ran)
+	}
+	// TXTPTR is left on the colon
+	statement_at(t, 10, 0)
+	plugin_gone()
+	if c := RAM[get_chrptr()]; c != ':' {
+		t.Errorf("TXTPTR on $%02X, want the colon", c)
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	defer func(k []plugin_keyword) {
+		plugin_keywords = k
+	}(plugin_keywords)
+
+	register_function("TWO", func(args *basic_args) (float64, error) {
+		if args.more() {
+			return 0, basic_err(ERROR_SYNTAX)
+		}
+		return 2, nil
+	})
+	register_statement("TESTOK", func(args *basic_args) error {
+		return nil
+	})
+	load_test_program(t, "10 PRINT TWO()+1\n20 PRINT TWO\n30 PRINT TESTOK()\n40 PRINT 1\n")
+
+	tests := []struct {
+		line		uint16
+		want_pc	uint16
+		want_x	byte
+	}{
+		{ 10, ROM_CHRGET, 0 },		// CHRGET past the )
+		{ 20, ROM_ERROR, ERROR_SYNTAX },		// no parentheses
+		{ 30, ROM_ERROR, ERROR_SYNTAX },		// a statement in an expression
+		{ 40, 0, 0 },
+	}
+	for _, tt := range tests {
+		statement_at(t, tt.line, 0)
+		CHRGET()		// PRINT; EVAL starts before the expression
+		start := get_chrptr()
+		X = 0
+		pc := plugin_eval()
+		if pc != tt.want_pc || X != tt.want_x {
+			t.Errorf("line %d: pc $%04X X %d, want $%04X %d", tt.line, pc, X, tt.want_pc, tt.want_x)
+		}
+		if pc == 0 && get_chrptr() != start {
+			t.Errorf("line %d: TXTPTR $%04X, want it back at $%04X", tt.line, get_chrptr(), start)
+		}
+	}
+
+	statement_at(t, 10, 0)
+	CHRGET()
+	plugin_eval()
+	if RAM[get_chrptr()] != ')' || fac_value() != 2 || RAM[0x0D] != 0 {
+		t.Errorf("TXTPTR on $%02X, FAC %v, VALTYP %d", RAM[get_chrptr()], fac_value(), RAM[0x0D])
+	}
+}
+
+func TestFunctionArgument(t *testing.T) {
+	defer func(k []plugin_keyword) {
+		plugin_keywords = k
+		fetch_override = map[uint16]byte{}
+		call_depth = 0
+	}(plugin_keywords)
+
+	register_function("HALF", func(args *basic_args) (float64, error) {
+		return args.get_number() / 2, nil
+	})
+	load_test_program(t, "10 PRINT HALF(9)\n")
+	statement_at(t, 10, 0)
+	CHRGET()
+	paren := get_chrptr() + 3
+	for RAM[paren] != ')' {
+		paren++
+	}
+	copy(RAM[0x61:0x67], make([]byte, 6))
+
+	// FRMNUM leaves 9 in FAC and TXTPTR on the ), through the 6502's memory
+	done := fake_bus(t, []bus_access{
+		{ MAGIC_EVAL, high, true, 0 },
+		{ 0x0061, low, false, 0x84 },
+		{ 0x0062, low, false, 0x90 },
+		{ 0x007A, low, false, byte(paren) },
+		{ 0x007B, low, false, byte(paren >> 8) },
+		{ MAGIC_CONTINUATION, high, true, 0 },
+	}, regs_monitor{})
+	access_addr, access_rw = MAGIC_EVAL, high
+	var pc uint16
+	in_trap(func() {
+		pc = plugin_eval()
+	})
+	finish_access()
+	<-done
+	if pc != ROM_CHRGET || fac_value() != 4.5 {
+		t.Errorf("HALF(9): pc $%04X FAC %v, want $%04X 4.5", pc, fac_value(), ROM_CHRGET)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+/************************************************************
+ *
+ * Functions
+ *
+ ************************************************************/
+
+/*
+ * These come with the plugin (SYS 1), to show how functions are
+ * written (see extensions.go); they are registered in plugin.go, so
+ * their tokens stay the same:
+ *
+ * HEX$(n)		n, 0 to 65535, as four hex digits, like BASIC 7.0
+ * DEC(s)		the hex number in s, 0 to FFFF
+ * ENV$(s)		the host's environment variable s, or "" if there is none
+ *			or it wasn't given with -env
+ * TIMEMS()		the milliseconds since cbmbasic started, on TI's clock (-clock)
+ *
+ * A string where a number should be, or the other way round, is a
+ * ?TYPE MISMATCH, whether in an argument or in what the result is used
+ * for.
+ *
+ * ENV$ only reads the variables -env names, so a program can't get at
+ * the rest of the environment (tokens, paths, user names) unless it is
+ * meant to.
+ */
+var env_flags string_list
+
+func init() {
+	flag.Var(&env_flags, "env", "let ENV$ read the host's environment variable `name` (may be repeated)")
+}
+
+func hex_string(args *basic_args) (string, error) {
+	return fmt.Sprintf("%04X", args.get_word()), nil
+}
+
+func dec(args *basic_args) (float64, error) {
+	n, err := strconv.ParseUint(args.get_string(), 16, 16)
+	if err != nil {
+		return 0, basic_err(ERROR_ILLEGAL_QUANTITY)
+	}
+	return float64(n), nil
+}
+
+func env_string(args *basic_args) (string, error) {
+	name := args.get_string()
+	for _, s := range env_flags {
+		if s == name {
+			return os.Getenv(name), nil
+		}
+	}
+	return "", nil
+}
+
+func timems(args *basic_args) (float64, error) {
+	return float64(elapsed_ms()), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+/*
+ * with_calls runs f in a trap, with the ROM routines it calls (n of
+ * them) returning regs at once; what they would leave in memory has to
+ * be there already.
+ */
+func with_calls(t *testing.T, n int, regs regs_monitor, f func()) {
+	accesses := []bus_access{ { MAGIC_EVAL, high, true, 0 } }
+	for i := 0; i < n; i++ {
+		accesses = append(accesses, bus_access{ MAGIC_CONTINUATION, high, true, 0 })
+	}
+	done := fake_bus(t, accesses, regs)
+	access_addr, access_rw = MAGIC_EVAL, high
+	in_trap(f)
+	finish_access()
+	<-done
+	fetch_override = map[uint16]byte{}
+}
+
+func TestFunctions(t *testing.T) {
+	defer func(cs charset) {
+		screen_charset = cs
+		clock_cycles = false
+		cycle = 0
+	}(screen_charset)
+	screen_charset = CHARSET_UPPER
+
+	var got string
+	var v float64
+	var err error
+
+	RAM[0x14], RAM[0x15] = 0xEF, 0xBE		// the word GETADR read
+	with_calls(t, 2, regs_monitor{}, func() {
+		got, err = hex_string(&basic_args{})
+	})
+	if got != "BEEF" || err != nil {
+		t.Errorf("HEX$(48879) = %q, %v", got, err)
+	}
+
+	copy(RAM[0xC000:], "fF")		// not hex digits in PETSCII
+	with_calls(t, 2, regs_monitor{ A: 2, X: 0x00, Y: 0xC0 }, func() {		// FRESTR: the string
+		v, err = dec(&basic_args{})
+	})
+	if err != basic_err(ERROR_ILLEGAL_QUANTITY) {
+		t.Errorf("DEC(\"fF\") = %v, %v, want ?ILLEGAL QUANTITY", v, err)
+	}
+	copy(RAM[0xC000:], "FF")
+	with_calls(t, 2, regs_monitor{ A: 2, X: 0x00, Y: 0xC0 }, func() {
+		v, err = dec(&basic_args{})
+	})
+	if v != 255 || err != nil {
+		t.Errorf("DEC(\"FF\") = %v, %v", v, err)
+	}
+
+	t.Setenv("CBMBASIC", "here")
+	t.Setenv("SECRET", "key")
+	defer func(l string_list) {
+		env_flags = l
+	}(env_flags)
+	env_flags = string_list{ "CBMBASIC" }
+	copy(RAM[0xC000:], "CBMBASIC")
+	with_calls(t, 2, regs_monitor{ A: 8, X: 0x00, Y: 0xC0 }, func() {
+		got, err = env_string(&basic_args{})
+	})
+	if got != "here" || err != nil {
+		t.Errorf("ENV$(\"CBMBASIC\") = %q, %v", got, err)
+	}
+	copy(RAM[0xC000:], "SECRET")		// not given with -env
+	with_calls(t, 2, regs_monitor{ A: 6, X: 0x00, Y: 0xC0 }, func() {
+		got, err = env_string(&basic_args{})
+	})
+	if got != "" || err != nil {
+		t.Errorf("ENV$(\"SECRET\") = %q, %v", got, err)
+	}
+
+	clock_cycles = true
+	cycle = 2 * C64ClockHz * 3 / 2		// half-cycles
+	if v, _ := timems(&basic_args{}); v != 1500 {
+		t.Errorf("TIMEMS() = %v after 1.5 seconds", v)
+	}
+}
+
+func TestMakeString(t *testing.T) {
+	defer func(cs charset) {
+		screen_charset = cs
+	}(screen_charset)
+	screen_charset = CHARSET_UPPER
+
+	RAM[0x62], RAM[0x63] = 0x00, 0x9F		// where STRSPA made room
+	with_calls(t, 2, regs_monitor{}, func() {
+		if err := make_string(petscii_string("here", screen_charset)); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	if !bytes.Equal(RAM[0x9F00:0x9F04], []byte("HERE")) {
+		t.Errorf("string space has % X", RAM[0x9F00:0x9F04])
+	}
+	if err := make_string(string(make([]byte, 256))); err != basic_err(ERROR_STRING_TOO_LONG) {
+		t.Errorf("256 characters: error %v, want ?STRING TOO LONG", err)
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	defer func() {
+		fetch_override = map[uint16]byte{}
+		call_depth = 0
+	}()
+
+	// DEC(5): FRMEVL returns, then FRESTR finds a number and raises ?TYPE MISMATCH
+	load_test_program(t, "10 PRINT DEC(5)\n")
+	statement_at(t, 10, 0)
+	CHRGET()
+	done := fake_bus(t, []bus_access{
+		{ MAGIC_EVAL, high, true, 0 },
+		{ MAGIC_CONTINUATION, high, true, 0 },
+		{ ROM_ERROR, high, true, 0 },
+	}, regs_monitor{})
+	access_addr, access_rw = MAGIC_EVAL, high
+	PC = MAGIC_EVAL
+	instruction_fetch()
+	if access_addr != ROM_ERROR || call_depth != 0 {
+		t.Errorf("6502 at $%04X, %d calls running; want it at the error handler, none", access_addr, call_depth)
+	}
+	finish_access()
+	<-done
+}
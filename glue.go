@@ -1,13 +1,62 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
 )
 
 func fatalf(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, "%s\n", fmt.Sprintf(format, args...))
-	os.Exit(1)
+	exit(1)
+}
+
+/*
+ * BASIC only gets to see a failed host read or write as a status bit
+ * or an error like ?DEVICE NOT PRESENT, so the host's reason is logged
+ * here; -log sends it to a file instead of stderr.
+ */
+var log_file = flag.String("log", "", "log host I/O errors to `file` instead of stderr")
+
+var diagnostics io.Writer = os.Stderr
+
+func init_diagnostics() {
+	if *log_file == "" {
+		return
+	}
+	f, err := os.OpenFile(*log_file, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+	if err != nil {
+		fatalf("error opening log: %v", err)
+	}
+	diagnostics = f
+	at_exit(func() {
+		f.Close()
+	})
+}
+
+func host_error(err error) {
+	fmt.Fprintf(diagnostics, "cbmbasic: %v\n", err)
+}
+
+/*
+ * Anything that needs to write out results when the interpreter
+ * quits (profiles, reports, ...) registers itself with at_exit;
+ * the runtime calls exit instead of os.Exit so these get run.
+ */
+var exit_hooks []func()
+
+func at_exit(f func()) {
+	exit_hooks = append(exit_hooks, f)
+}
+
+func exit(code int) {
+	hooks := exit_hooks
+	exit_hooks = nil		// in case a hook calls fatalf
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+	os.Exit(code)
 }
 
 func SETZ(a byte) {
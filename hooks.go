@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+/************************************************************
+ *
+ * ROM Hooks
+ *
+ ************************************************************/
+
+/*
+ * The runtime needs to know when BASIC gets to certain points: when it
+ * prints the banner or READY, when it waits for a line, when it raises
+ * an error. A hook table maps each of these events to the address in
+ * the ROM where it happens, and when the 6502 fetches an instruction at
+ * one of them, the monitor fires the event's callbacks. Callbacks see
+ * the registers as they are there, but can't change them.
+ *
+ * The table for cbmbasic.bin is built in. Another ROM needs its own,
+ * loaded with -hooks from a file of "event = $addr" lines (the plain
+ * label file format); events it leaves out don't fire.
+ */
+type hook_event int
+
+const (
+	HOOK_BANNER hook_event = iota		// the banner and BYTES FREE are about to be printed
+	HOOK_READY				// READY is about to be printed
+	HOOK_MAIN				// BASIC reads a line at the READY prompt
+	HOOK_LINE				// the line was read (and INLIN printed its CR)
+	HOOK_ERROR				// an error is about to be reported (not trapped by ON ERROR), with its number in X
+)
+
+var hook_names = map[string]hook_event{
+	"banner":	HOOK_BANNER,
+	"ready":	HOOK_READY,
+	"main":	HOOK_MAIN,
+	"line":	HOOK_LINE,
+	"error":	HOOK_ERROR,
+}
+
+var hooks_file = flag.String("hooks", "", "load the ROM hook table from `file` (event = $addr lines), for a ROM other than cbmbasic.bin")
+
+var cbmbasic_hooks = map[uint16]hook_event{
+	0xE422:	HOOK_BANNER,		// INITMS
+	0xA474:	HOOK_READY,		// READY
+	0xA483:	HOOK_MAIN,		// MAIN, after the jump through IMAIN: JSR INLIN
+	0xA486:	HOOK_LINE,
+	0xA43A:	HOOK_ERROR,		// ERROR, after the jump through IERROR
+}
+
+var (
+	rom_hooks		= cbmbasic_hooks
+	hook_callbacks	= map[hook_event][]func(){}
+)
+
+// on_hook makes f get called whenever event happens.
+func on_hook(event hook_event, f func()) {
+	hook_callbacks[event] = append(hook_callbacks[event], f)
+}
+
+func fire_hook(event hook_event) {
+	for _, f := range hook_callbacks[event] {
+		f()
+	}
+}
+
+func init_hooks() {
+	if *hooks_file == "" {
+		return
+	}
+	t, err := load_hooks(*hooks_file)
+	if err != nil {
+		fatalf("error loading hooks: %v", err)
+	}
+	rom_hooks = t
+}
+
+func load_hooks(filename string) (map[uint16]hook_event, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	syms, err := parse_symbols(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	t := map[uint16]hook_event{}
+	for _, s := range syms {
+		event, ok := hook_names[s.name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown event %q", filename, s.name)
+		}
+		if _, ok := t[s.addr]; ok {
+			return nil, fmt.Errorf("%s: two events at $%04X", filename, s.addr)
+		}
+		t[s.addr] = event
+	}
+	return t, nil
+}
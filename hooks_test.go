@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadHooks(t *testing.T) {
+	tests := []struct {
+		name		string
+		text		string
+		want		map[uint16]hook_event
+	}{
+		{ "table", "; another ROM\nready = $A474\nerror = $A43A ; ERROR\n", map[uint16]hook_event{ 0xA474: HOOK_READY, 0xA43A: HOOK_ERROR } },
+		{ "VICE labels", "al C:a474 .ready\n", map[uint16]hook_event{ 0xA474: HOOK_READY } },
+		{ "unknown event", "prompt = $A474\n", nil },
+		{ "two events", "ready = $A474\nmain = $A474\n", nil },
+	}
+
+	for _, tt := range tests {
+		f := filepath.Join(t.TempDir(), "hooks")
+		if err := os.WriteFile(f, []byte(tt.text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := load_hooks(f)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for addr, ev := range tt.want {
+			if got[addr] != ev {
+				t.Errorf("%s: event at $%04X is %d, want %d", tt.name, addr, got[addr], ev)
+			}
+		}
+	}
+}
+
+func TestScriptOutput(t *testing.T) {
+	defer func(i bool) {
+		interactive = i
+		quiet_output, reading_line = false, false
+	}(interactive)
+
+	tests := []struct {
+		interactive	bool
+		event		hook_event
+		printed	bool
+	}{
+		{ false, HOOK_BANNER, false },
+		{ false, HOOK_READY, false },
+		{ false, HOOK_MAIN, false },		// INLIN's CR
+		{ false, HOOK_LINE, true },
+		{ true, HOOK_BANNER, true },
+		{ true, HOOK_READY, true },
+		{ true, HOOK_MAIN, false },
+		{ true, HOOK_LINE, true },
+	}
+	for _, tt := range tests {
+		interactive = tt.interactive
+		fire_hook(tt.event)
+		printed := !quiet_output && !reading_line
+		if printed != tt.printed {
+			t.Errorf("interactive=%v after event %d: printed=%v, want %v", tt.interactive, tt.event, printed, tt.printed)
+		}
+	}
+}
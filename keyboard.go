@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+/************************************************************
+ *
+ * Keyboard
+ *
+ ************************************************************/
+
+/*
+ * In raw mode the terminal sends keys as they are pressed; read_key
+ * turns them into what the C64 keyboard would have produced. The
+ * control keys that have PETSCII codes (CTRL-E for white, CTRL-R for
+ * RVS ON, CTRL-S for HOME, ...) are the same on both, so they pass
+ * through. An escape sequence arrives in one piece, so an ESC with
+ * nothing after it is the Esc key.
+ */
+var key_reader = bufio.NewReader(os.Stdin)
+
+var escape_keys = map[string]byte{
+	"[A":	145,		// CRSR UP
+	"[B":	17,		// CRSR DOWN
+	"[C":	29,		// CRSR RIGHT
+	"[D":	157,		// CRSR LEFT
+	"[H":	19,		// HOME
+	"OH":	19,
+	"[1~":	19,
+	"[2~":	148,		// INSERT
+	"[3~":	20,		// DEL; the C64 has no forward delete
+	"OA":	145,
+	"OB":	17,
+	"OC":	29,
+	"OD":	157,
+}
+
+const (
+	KEY_STOP = 3
+	KEY_EOF = 4		// CTRL-D
+	KEY_ESC = 27
+)
+
+func read_key() (byte, error) {
+	b, err := key_reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b == '\r' || b == '\n':
+		return 13, nil
+	case b == 8 || b == 0x7F:
+		return 20, nil
+	case b == 12:		// CTRL-L, as in redraw, is CLR
+		return 147, nil
+	case b == KEY_ESC:
+		if key_reader.Buffered() == 0 {
+			return KEY_ESC, nil
+		}
+		seq := ""
+		for key_reader.Buffered() > 0 {
+			c, _ := key_reader.ReadByte()
+			seq += string(c)
+			// sequences end with a letter or ~
+			if len(seq) > 1 && (c == '~' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')) {
+				break
+			}
+		}
+		return escape_keys[seq], nil		// 0, ignored, if we don't know it
+	case b < 0x20:
+		return b, nil
+	case b < utf8.RuneSelf:
+		return unicode_to_petscii(rune(b), screen_charset), nil
+	}
+
+	// the rest of a UTF-8 character
+	buf := []byte{ b }
+	for !utf8.FullRune(buf) && len(buf) < utf8.UTFMax {
+		c, err := key_reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		buf = append(buf, c)
+	}
+	r, _ := utf8.DecodeRune(buf)
+	return unicode_to_petscii(r, screen_charset), nil
+}
+
+/*
+ * Keys go into a queue as they are typed, like the C64's ten character
+ * keyboard buffer, so GETIN can return 0 when nothing was typed instead
+ * of waiting. On a terminal, the terminal is put in raw mode so keys
+ * arrive as they are pressed: CTRL-C and Esc are RUN/STOP, and since
+ * CTRL-C no longer quits, CTRL-D on an empty line does, like the end
+ * of input does otherwise. Lines typed outside the screen editor are
+ * echoed and can be corrected with backspace.
+ */
+const KEYBOARD_BUFFER_SIZE = 10
+
+var raw_flag = flag.Bool("raw", true, "put the terminal in raw mode so GET and RUN/STOP work (CTRL-C or Esc is RUN/STOP, CTRL-D quits)")
+
+var (
+	keyboard_buffer	= make(chan byte, KEYBOARD_BUFFER_SIZE)
+	keyboard_raw	bool
+	keyboard_once	sync.Once
+	keyboard_line	[]byte		// the rest of the line being read
+	stop_key		int32		// set while RUN/STOP has not been seen by STOP
+)
+
+func init_keyboard() {
+	if !interactive || !*raw_flag || !is_terminal(os.Stdin) {
+		return
+	}
+	restore, err := make_raw(os.Stdin, false)
+	if err != nil {
+		fatalf("error setting up terminal: %v", err)
+	}
+	at_exit(restore)
+	keyboard_raw = true
+	console_echo = false
+	start_keyboard()
+}
+
+// start_keyboard starts reading stdin into the keyboard buffer, the first time it's needed.
+func start_keyboard() {
+	keyboard_once.Do(func() {
+		go read_keyboard()
+	})
+}
+
+func read_keyboard() {
+	for {
+		var c byte
+		var err error
+
+		if keyboard_raw {
+			c, err = read_key()
+		} else {
+			c, err = read_petscii(key_reader, screen_charset)
+		}
+		if err != nil {
+			if err != io.EOF {
+				host_error(err)
+			}
+			close(keyboard_buffer)
+			return
+		}
+		if c == 0 {
+			continue
+		}
+		if keyboard_raw {
+			queue_key(c)
+		} else {
+			keyboard_buffer <- c		// piped input waits for room instead
+		}
+	}
+}
+
+/*
+ * queue_key puts a key typed at the terminal in the buffer. Like the
+ * C64's, the buffer holds 10 keys and the ones typed after it is full
+ * are dropped, so a program that doesn't GET them can still be stopped
+ * with RUN/STOP.
+ */
+func queue_key(c byte) {
+	if c == KEY_STOP || c == KEY_ESC {
+		atomic.StoreInt32(&stop_key, 1)
+		c = KEY_STOP
+	}
+	select {
+	case keyboard_buffer <- c:
+	default:
+	}
+}
+
+// next_key waits for a key; at the end of input, cbmbasic is done.
+func next_key() byte {
+	start_keyboard()
+	c, ok := <-keyboard_buffer
+	if !ok {
+		exit(0)
+	}
+	return c
+}
+
+// poll_key returns the next key, or 0 if none was typed.
+func poll_key() byte {
+	start_keyboard()
+	select {
+	case c, ok := <-keyboard_buffer:
+		if !ok {
+			return 0
+		}
+		return c
+	default:
+		return 0
+	}
+}
+
+// stop_pressed reports whether RUN/STOP was pressed since the last time, and forgets it.
+func stop_pressed() bool {
+	return atomic.SwapInt32(&stop_key, 0) != 0
+}
+
+func flush_keyboard() {
+	for {
+		select {
+		case _, ok := <-keyboard_buffer:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+/* keyboard_line_chrin reads a line from the keyboard, echoing it, then hands it out a character at a time */
+func keyboard_line_chrin() byte {
+	if !keyboard_raw {
+		return next_key()
+	}
+	for len(keyboard_line) == 0 {
+		var line []byte
+
+		for {
+			k := next_key()
+			if k == 13 {
+				newline()
+				keyboard_line = append(line, 13)
+				break
+			}
+			switch {
+			case k == KEY_EOF && len(line) == 0:
+				newline()
+				exit(0)
+			case k == KEY_STOP:
+				stop_pressed()		// INPUT can't be stopped
+			case k == 20:
+				if len(line) > 0 {
+					line = line[:len(line) - 1]
+					os.Stdout.WriteString("\b \b")
+					cursor_x--
+					clamp_cursor()
+				}
+			case petscii_to_unicode(k, screen_charset) != 0:
+				line = append(line, k)
+				put_char(k)
+			}
+		}
+	}
+	c := keyboard_line[0]
+	keyboard_line = keyboard_line[1:]
+	return c
+}
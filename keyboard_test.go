@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyboardBufferFull(t *testing.T) {
+	defer func(b chan byte) {
+		keyboard_buffer = b
+		stop_key = 0
+	}(keyboard_buffer)
+	keyboard_buffer = make(chan byte, KEYBOARD_BUFFER_SIZE)
+
+	// typed ahead of a program that doesn't GET them
+	for i := 0; i < KEYBOARD_BUFFER_SIZE + 5; i++ {
+		queue_key('A')
+	}
+	queue_key(KEY_STOP)
+	if !stop_pressed() {
+		t.Errorf("RUN/STOP not seen with the buffer full")
+	}
+	if n := len(keyboard_buffer); n != KEYBOARD_BUFFER_SIZE {
+		t.Errorf("%d keys in the buffer, want %d", n, KEYBOARD_BUFFER_SIZE)
+	}
+	for len(keyboard_buffer) > 0 {
+		if c := <-keyboard_buffer; c != 'A' {
+			t.Errorf("got key %d, want A", c)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ Copyright (c) 2010 Greg James, Brian Silverman, Barry Silverman
+ Copyright (c) 2013 Pietro Gagliardi
+
+ The following is provided under terms of the Creative Commons
+ Attribution-NonCommercial-ShareAlike 3.0 Unported license:
+ http://creativecommons.org/licenses/by-nc-sa/3.0/
+
+ Specify the original author as Greg James and the following URL
+ for original source material:  www.visual6502.org
+*/
+
+package main
+
+import (
+	"fmt"
+)
+
+// names of the nodes that have constants in transdefs.go
+var nodenames = map[uint64]string{
+	a0:	"a0",
+	a1:	"a1",
+	a2:	"a2",
+	a3:	"a3",
+	a4:	"a4",
+	a5:	"a5",
+	a6:	"a6",
+	a7:	"a7",
+	ab0:	"ab0",
+	ab1:	"ab1",
+	ab2:	"ab2",
+	ab3:	"ab3",
+	ab4:	"ab4",
+	ab5:	"ab5",
+	ab6:	"ab6",
+	ab7:	"ab7",
+	ab8:	"ab8",
+	ab9:	"ab9",
+	ab10:	"ab10",
+	ab11:	"ab11",
+	ab12:	"ab12",
+	ab13:	"ab13",
+	ab14:	"ab14",
+	ab15:	"ab15",
+	adh0:	"adh0",
+	adh1:	"adh1",
+	adh2:	"adh2",
+	adh3:	"adh3",
+	adh4:	"adh4",
+	adh5:	"adh5",
+	adh6:	"adh6",
+	adh7:	"adh7",
+	adl0:	"adl0",
+	adl1:	"adl1",
+	adl2:	"adl2",
+	adl3:	"adl3",
+	adl4:	"adl4",
+	adl5:	"adl5",
+	adl6:	"adl6",
+	adl7:	"adl7",
+	alu0:	"alu0",
+	alu1:	"alu1",
+	alu2:	"alu2",
+	alu3:	"alu3",
+	alu4:	"alu4",
+	alu5:	"alu5",
+	alu6:	"alu6",
+	alu7:	"alu7",
+	cclk:	"cclk",
+	clearIR:	"clearIR",
+	clk0:	"clk0",
+	clk1out:	"clk1out",
+	clk2out:	"clk2out",
+	clock1:	"clock1",
+	clock2:	"clock2",
+	cp1:	"cp1",
+	d1x1:	"d1x1",
+	db0:	"db0",
+	db1:	"db1",
+	db2:	"db2",
+	db3:	"db3",
+	db4:	"db4",
+	db5:	"db5",
+	db6:	"db6",
+	db7:	"db7",
+	dor0:	"dor0",
+	dor1:	"dor1",
+	dor2:	"dor2",
+	dor3:	"dor3",
+	dor4:	"dor4",
+	dor5:	"dor5",
+	dor6:	"dor6",
+	dor7:	"dor7",
+	fetch:	"fetch",
+	h1x1:	"h1x1",
+	idb0:	"idb0",
+	idb1:	"idb1",
+	idb2:	"idb2",
+	idb3:	"idb3",
+	idb4:	"idb4",
+	idb5:	"idb5",
+	idb6:	"idb6",
+	idb7:	"idb7",
+	idl0:	"idl0",
+	idl1:	"idl1",
+	idl2:	"idl2",
+	idl3:	"idl3",
+	idl4:	"idl4",
+	idl5:	"idl5",
+	idl6:	"idl6",
+	idl7:	"idl7",
+	irq:	"irq",
+	nmi:	"nmi",
+	notir0:	"notir0",
+	notir1:	"notir1",
+	notir2:	"notir2",
+	notir3:	"notir3",
+	notir4:	"notir4",
+	notir5:	"notir5",
+	notir6:	"notir6",
+	notir7:	"notir7",
+	notRdy0:	"notRdy0",
+	nots0:	"nots0",
+	nots1:	"nots1",
+	nots2:	"nots2",
+	nots3:	"nots3",
+	nots4:	"nots4",
+	nots5:	"nots5",
+	nots6:	"nots6",
+	nots7:	"nots7",
+	p0:	"p0",
+	p1:	"p1",
+	p2:	"p2",
+	p3:	"p3",
+	p4:	"p4",
+	p5:	"p5",
+	p6:	"p6",
+	p7:	"p7",
+	pch0:	"pch0",
+	pch1:	"pch1",
+	pch2:	"pch2",
+	pch3:	"pch3",
+	pch4:	"pch4",
+	pch5:	"pch5",
+	pch6:	"pch6",
+	pch7:	"pch7",
+	pcl0:	"pcl0",
+	pcl1:	"pcl1",
+	pcl2:	"pcl2",
+	pcl3:	"pcl3",
+	pcl4:	"pcl4",
+	pcl5:	"pcl5",
+	pcl6:	"pcl6",
+	pcl7:	"pcl7",
+	pd0:	"pd0",
+	pd1:	"pd1",
+	pd2:	"pd2",
+	pd3:	"pd3",
+	pd4:	"pd4",
+	pd5:	"pd5",
+	pd6:	"pd6",
+	pd7:	"pd7",
+	rdy:	"rdy",
+	res:	"res",
+	rw:	"rw",
+	s0:	"s0",
+	s1:	"s1",
+	s2:	"s2",
+	s3:	"s3",
+	s4:	"s4",
+	s5:	"s5",
+	s6:	"s6",
+	s7:	"s7",
+	sb0:	"sb0",
+	sb1:	"sb1",
+	sb2:	"sb2",
+	sb3:	"sb3",
+	sb4:	"sb4",
+	sb5:	"sb5",
+	sb6:	"sb6",
+	sb7:	"sb7",
+	so:	"so",
+	sync_:	"sync",
+	t2:	"t2",
+	t3:	"t3",
+	t4:	"t4",
+	t5:	"t5",
+	vcc:	"vcc",
+	vss:	"vss",
+	x0:	"x0",
+	x1:	"x1",
+	x2:	"x2",
+	x3:	"x3",
+	x4:	"x4",
+	x5:	"x5",
+	x6:	"x6",
+	x7:	"x7",
+	y0:	"y0",
+	y1:	"y1",
+	y2:	"y2",
+	y3:	"y3",
+	y4:	"y4",
+	y5:	"y5",
+	y6:	"y6",
+	y7:	"y7",
+}
+
+// node_name returns the name of node nn, or its number if it has none
+func node_name(nn uint64) string {
+	if name, ok := nodenames[nn]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", nn)
+}
+
+/*
+ * transistors have no names of their own; transistor_name names one by
+ * the nodes at its gate and at the two ends of its channel, "gate:c1-c2"
+ */
+func transistor_name(t uint64) string {
+	td := transdefs[t]
+	return node_name(td.gate) + ":" + node_name(td.c1) + "-" + node_name(td.c2)
+}
@@ -25,6 +25,7 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 	// ...
 )
@@ -107,6 +108,58 @@ type regs_monitor struct {
 }
 var regs_chan = make(chan regs_monitor)
 
+/*
+ * Tools that need to look at (or poke) the chip's nodes from another
+ * goroutine send a function over probe_chan; chiploop runs it between
+ * half-cycles, so it sees a consistent state. chiploop can be held up
+ * in the middle of a half-cycle (for instance, waiting for the monitor
+ * to take clk1), so chip_probe gives up after timeout and returns false.
+ */
+var probe_chan = make(chan func())
+
+func chip_probe(f func(), timeout time.Duration) bool {
+	done := make(chan struct{})
+	g := func() {
+		f()
+		close(done)
+	}
+	select {
+	case probe_chan <- g:
+		<-done
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+/*
+ * stop_chip stops the chip for good between two half-cycles, so that
+ * what is written out on exit (profiles, the die) can read its state
+ * from any goroutine. The monitor may be the one exiting, with chiploop
+ * waiting for it to take clk1; that is taken here instead, so chiploop
+ * can finish its half-cycle. If no chip answers, none is running.
+ */
+var chip_halted bool		// only touched by chiploop
+
+func stop_chip() {
+	halted := make(chan struct{})
+	halt := func() {
+		chip_halted = true
+		close(halted)
+	}
+	timeout := time.After(probe_timeout)
+	for {
+		select {
+		case probe_chan <- halt:
+			<-halted
+			return
+		case <-clk1_chan:
+		case <-timeout:
+			return
+		}
+	}
+}
+
 /************************************************************
  *
  * Libc Functions and Basic Data Types
@@ -220,7 +273,14 @@ func get_nodes_pulldown(node uint64) bool {
 
 var nodes_outclocks map[uint64]chan bool
 
+// the output clocks only go out when they change, so the monitor sees each edge once
 func set_nodes_value(node uint64, state bool) {
+	if get_nodes_value(node) == state {
+		return
+	}
+	if profiling {
+		profile_node(node)
+	}
 	set_bitmap(nodes_value, node, state)
 	if c := nodes_outclocks[node]; c != nil {
 		c <- state
@@ -255,6 +315,9 @@ func set_transistors_on(t uint64, state bool) {
 		return
 	}
 //#endif
+	if profiling && transistor_state(t) != state {
+		profile_transistor(t)
+	}
 	set_bitmap(transistors_on, t, state)
 }
 
@@ -456,9 +519,15 @@ func recalcNode(node uint64) {
 		nn := group_get(i)
 		if get_nodes_value(nn) != newv {
 			set_nodes_value(nn, newv)
+			if covering {
+				coverage_node(nn)
+			}
 			for t := uint64(0); t < nodes_gatecount[nn]; t++ {
 				tn := nodes_gates[nn][t]
 				set_transistors_on(tn, !transistor_state(tn))
+				if covering {
+					coverage_transistor(tn)
+				}
 			}
 			listout_add(nn)
 		}
@@ -596,6 +665,16 @@ func readIR() byte {
 	return read8(notir0,notir1,notir2,notir3,notir4,notir5,notir6,notir7) ^ 0xFF
 }
 
+/*
+ * The timing generator's state; like visual6502, we consider the
+ * T0 and T1 signals (clock1 and clock2) and T2-T5 active when low.
+ * More than one T-state can be active at once (T0 and T2 overlap,
+ * for instance), so bit n of the result is set if Tn is active.
+ */
+func readT() byte {
+	return (read8(clock1,clock2,t2,t3,t4,t5,vss,vss) ^ 0xFF) & 0x3F
+}
+
 func readSP() byte {
 	return read8(s0,s1,s2,s3,s4,s5,s6,s7)
 }
@@ -640,6 +719,10 @@ func chipStatus() {
 			readP(),
 			readIR())
 
+	if name := symbol_name(readPC()); name != "" {
+		fmt.Printf(" <%s>", name)
+	}
+
 	if clk {
 		if r_w {
 			fmt.Printf(" R$%04X=$%02X", a, memory[a])
@@ -659,6 +742,25 @@ func chipStatus() {
 
 var memory [65536]byte
 
+/*
+ * memory belongs to the monitor, which is the only one to write it;
+ * it holds memory_mu while it does (through RAM, for as long as a hook
+ * or trap runs, except while call lets the 6502 run), so that the web
+ * UI can read it from its own goroutines with read_memory
+ */
+var memory_mu sync.RWMutex
+
+// read_memory returns a copy of n bytes from addr on, wrapping around like the 6502
+func read_memory(addr uint16, n int) []byte {
+	b := make([]byte, n)
+	memory_mu.RLock()
+	for i := range b {
+		b[i] = memory[(int(addr) + i) & 0xFFFF]
+	}
+	memory_mu.RUnlock()
+	return b
+}
+
 func mRead(a uint16) byte {
 	return memory[a]
 }
@@ -681,18 +783,50 @@ func handleMemory() {
  *
  ************************************************************/
 
+/*
+ * When clk1 goes low, the monitor handles a memory access: it reads
+ * the address and R/W, then gives the chip the byte it reads or takes
+ * the one it writes. The clock waits until it has, or the chip could
+ * go on to the next half-cycle with the bus half done.
+ */
+var bus_busy bool
+
 func chiploop() {
 	for {
+		tick := clk0_chan
+		if bus_busy {
+			tick = nil
+		}
+
 		// TODO(andlabs) - will this properly handle timing?
 		select {
 		// input pins
-		case <-clk0_chan:		// TODO(andlabs) set clock state from channel input?
+		case <-tick:		// TODO(andlabs) set clock state from channel input?
+			if chip_halted {
+				break
+			}
 			clk := isNodeHigh(clk0)
+			clk1 := isNodeHigh(clk1out)
+
+			if profiling {
+				profile_halfcycle()
+			}
 
 			// invert clock
 			setNode(clk0, !clk)
+			if nodes_outclocks != nil && clk1 && !isNodeHigh(clk1out) {
+				bus_busy = true
+			}
+
+			if die_animating {
+				die_frame()
+			}
 
 			cycle++
+
+			if tracing {
+				trace_halfcycle()
+			}
 		case d := <-rdy_chan:
 			setNode(rdy, d)
 		case d := <-irq_chan:
@@ -701,6 +835,7 @@ func chiploop() {
 			setNode(nmi, d)
 		case d := <-db_chan:
 			writeDataBus(d)
+			bus_busy = false
 		case d := <-so_chan:		// TODO does this properly handle so's odd behavior?
 			setNode(so, d)
 		case d := <-res_chan:
@@ -715,6 +850,7 @@ func chiploop() {
 		case sync_chan <- isNodeHigh(sync_):
 		case ab_chan <- readAddressBus():
 		case db_chan <- readDataBus():
+			bus_busy = false
 		case rw_chan <- isNodeHigh(rw):
 //		case clk2_chan <- isNodeHigh(clk2out):
 
@@ -726,6 +862,8 @@ func chiploop() {
 			S:	readSP(),
 			P:	readP(),
 		}:
+		case f := <-probe_chan:
+			f()
 		}
 	}
 }
@@ -776,7 +914,7 @@ func setupNodesAndTransistors() {
 		}
 	}
 	transistors = uint(j)
-	if DEBUG {
+	if DEBUG && !batch {		// -batch's standard output is the program's
 		fmt.Printf("transistors: %d\n", transistors)
 	}
 
@@ -803,10 +941,15 @@ func setupNodesAndTransistors() {
 	}
 }
 
-func dochip(chip_clock <-chan time.Time) {
+/* power_up sets up the chip with all its pins in their initial state, before RESET is released */
+func power_up() {
 	// set up data structures for efficient emulation
 	setupNodesAndTransistors()
 
+	// powering up isn't part of the coverage, just where it starts
+	cover := covering
+	covering = false
+
 	// all nodes are down
 	for nn := uint64(0); nn < NODES; nn++ {
 		set_nodes_value(nn, low)
@@ -827,6 +970,15 @@ func dochip(chip_clock <-chan time.Time) {
 
 	recalcAllNodes()
 
+	covering = cover
+	if covering {
+		seed_coverage()
+	}
+}
+
+func dochip(chip_clock <-chan time.Time) {
+	power_up()
+
 	// run the chip
 	go chiploop()
 
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+/************************************************************
+ *
+ * PETSCII
+ *
+ ************************************************************/
+
+/*
+ * The C64 has two character sets: upper case and graphics (the one it
+ * starts with) and lower and upper case, switched with CHR$(14) and
+ * CHR$(142). The same PETSCII code shows a different glyph in each.
+ * Glyphs with no exact Unicode equivalent outside the Symbols for
+ * Legacy Computing block (which few terminal fonts have) get the
+ * closest box-drawing or block character.
+ *
+ * CHARSET_NONE passes bytes through untranslated, like cbmbasic used to.
+ */
+type charset int
+
+const (
+	CHARSET_NONE charset = iota
+	CHARSET_UPPER
+	CHARSET_LOWER
+)
+
+var charset_names = map[string]charset{
+	"none":	CHARSET_NONE,
+	"upper":	CHARSET_UPPER,
+	"lower":	CHARSET_LOWER,
+}
+
+func parse_charset(s string) (charset, error) {
+	cs, ok := charset_names[s]
+	if !ok {
+		return CHARSET_NONE, fmt.Errorf("unknown character set %q (want upper, lower or none)", s)
+	}
+	return cs, nil
+}
+
+// $A0-$BF in upper case and graphics; $E0-$FE repeat them
+var petscii_a0 = [32]rune{
+	' ', '▌', '▄', '▔', '▁', '▏', '▒', '▕',
+	'▒', '◤', '▕', '├', '▗', '└', '┐', '▂',
+	'┌', '┴', '┬', '┤', '▎', '▍', '▐', '▀',
+	'▀', '▃', '┘', '▖', '▝', '┘', '▘', '▚',
+}
+
+// $C0-$DF in upper case and graphics; $60-$7F repeat them
+var petscii_c0 = [32]rune{
+	'─', '♠', '│', '─', '─', '─', '─', '│',
+	'│', '╮', '╰', '╯', '└', '╲', '╱', '┌',
+	'┐', '●', '▁', '♥', '▏', '╭', '╳', '○',
+	'♣', '▕', '♦', '┼', '▒', '│', 'π', '◥',
+}
+
+var petscii_unicode [3][256]rune
+
+func init() {
+	for _, cs := range []charset{ CHARSET_UPPER, CHARSET_LOWER } {
+		t := &petscii_unicode[cs]
+		for c := 0x20; c < 0x60; c++ {
+			t[c] = rune(c)
+		}
+		t[0x5C] = '£'
+		t[0x5E] = '↑'
+		t[0x5F] = '←'
+		for i := 0; i < 32; i++ {
+			t[0xA0 + i] = petscii_a0[i]
+			t[0xC0 + i] = petscii_c0[i]
+		}
+		if cs == CHARSET_LOWER {
+			for c := 'A'; c <= 'Z'; c++ {
+				t[0x41 + c - 'A'] = c - 'A' + 'a'
+				t[0xC1 + c - 'A'] = c
+			}
+			t[0xA9] = '◩'
+			t[0xBA] = '✓'
+			t[0xDE] = '▒'
+			t[0xDF] = '◪'
+		}
+		for i := 0; i < 32; i++ {
+			t[0x60 + i] = t[0xC0 + i]
+			t[0xE0 + i] = t[0xA0 + i]
+		}
+		t[0xFF] = t[0xDE]
+	}
+}
+
+// petscii_to_unicode returns the glyph for c, or 0 for control codes.
+func petscii_to_unicode(c byte, cs charset) rune {
+	if cs == CHARSET_NONE {
+		return rune(c)
+	}
+	return petscii_unicode[cs][c]
+}
+
+/*
+ * unicode_to_petscii maps a typed character to PETSCII. Plain ASCII
+ * lower case letters are the unshifted letters in both character sets
+ * (so LIST shows what was typed in the lower case set, and keywords
+ * work when typed in lower case in the upper case set); ASCII that has
+ * no PETSCII glyph, like {, passes through unchanged.
+ */
+func unicode_to_petscii(r rune, cs charset) byte {
+	switch r {
+	case '\n':
+		return 13
+	case 8, 0x7F:		// backspace is DEL
+		if cs != CHARSET_NONE {
+			return 20
+		}
+	}
+	if cs == CHARSET_NONE {
+		return byte(r)
+	}
+	if r >= 'a' && r <= 'z' {
+		return byte(r - 'a' + 'A')
+	}
+	if r >= 'A' && r <= 'Z' {
+		if cs == CHARSET_LOWER {
+			return byte(r - 'A' + 0xC1)
+		}
+		return byte(r)
+	}
+	if r < 0x80 {
+		return byte(r)
+	}
+	// prefer the canonical codes over their repeats in $60-$7F and $E0-$FF
+	t := &petscii_unicode[cs]
+	for _, c := range []int{ 0x5C, 0x5E, 0x5F } {
+		if t[c] == r {
+			return byte(c)
+		}
+	}
+	for c := 0xA0; c < 0xE0; c++ {
+		if t[c] == r {
+			return byte(c)
+		}
+	}
+	return '?'
+}
+
+/*
+ * read_petscii reads one UTF-8 character from r and translates it,
+ * reading only as many bytes as the character has, so nothing is
+ * read ahead of what the KERNAL asked for.
+ */
+func read_petscii(r io.Reader, cs charset) (byte, error) {
+	b := make([]byte, utf8.UTFMax)
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, err
+	}
+	n := 1
+	if cs != CHARSET_NONE {
+		switch {
+		case b[0] & 0xE0 == 0xC0:
+			n = 2
+		case b[0] & 0xF0 == 0xE0:
+			n = 3
+		case b[0] & 0xF8 == 0xF0:
+			n = 4
+		}
+	}
+	if n > 1 {
+		if _, err := io.ReadFull(r, b[1:n]); err != nil {
+			return 0, err
+		}
+	}
+	ru, _ := utf8.DecodeRune(b[:n])
+	if n == 1 {
+		ru = rune(b[0])
+	}
+	return unicode_to_petscii(ru, cs), nil
+}
+
+/* write_petscii writes the glyph for c to w, or nothing for a control code */
+func write_petscii(w io.Writer, c byte, cs charset) error {
+	r := petscii_to_unicode(c, cs)
+	if r == 0 {
+		return nil
+	}
+	if cs == CHARSET_NONE {
+		_, err := w.Write([]byte{ c })
+		return err
+	}
+	b := make([]byte, utf8.UTFMax)
+	_, err := w.Write(b[:utf8.EncodeRune(b, r)])
+	return err
+}
+
+// petscii_string and unicode_string translate whole strings, such as file names.
+func petscii_string(s string, cs charset) string {
+	if cs == CHARSET_NONE {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = append(b, unicode_to_petscii(r, cs))
+	}
+	return string(b)
+}
+
+func unicode_string(s string, cs charset) string {
+	if cs == CHARSET_NONE {
+		return s
+	}
+	r := make([]rune, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if u := petscii_to_unicode(s[i], cs); u != 0 {
+			r = append(r, u)
+		}
+	}
+	return string(r)
+}
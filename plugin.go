@@ -41,16 +41,24 @@ package main
  *
  * SYS 0
  *
- * Please note that the current implementation does not tokenize new keywords,
- * but stores them verbatim and compares strings when during execution, which
- * is very bad for performance. Also, there is currently no demo code for
- * added functions.
+ * New keywords are tokenized: BASIC V2 has no free tokens left, so a new
+ * keyword is stored as TOKEN_ESCAPE ($FE, which BASIC V2 doesn't use)
+ * followed by $80 plus its place in plugin_keywords. Both bytes are
+ * $80 or more, so nothing in the ROM mistakes them for a colon, a quote or
+ * a space. A line is crunched in CRNCH with the same tokenizer that reads
+ * .bas files (see basic.go), listed in QPLOP, and run in GONE by looking
+ * the token up. New keywords are looked for before BASIC V2's, so one
+ * can have an old keyword in it (SYSTEM has SYS), but they can't be
+ * abbreviated. Statements BASIC V2 already has can be taken over by their
+ * token in plugin_overrides.
+ *
+ * With the plugin off, the new keywords are a ?SYNTAX ERROR, and LIST
+ * doesn't know them. functions.go has some functions, as examples.
  */
 
 import (
+	"bytes"
 	"fmt"
-	"os"
-//	"os/exec"
 )
 
 func get_chrptr() uint16 {
@@ -76,38 +84,25 @@ func compare(s string) bool {
 	return true
 }
 
-/*
- * Continuation
- *
- * This will put a magic value onto the stack and run the main
- * function again with another PC value as a start address.
- * When the code returns, it will find the magic value, and
- * the main function will quit, so we end up here again.
- */
-func call(pc uint16) {
-	PC = pc
-	PUSH_WORD(MAGIC_CONTINUATION - 1)
-	main()		// TODO(andlabs) - handled?
-}
-
+// the ROM routines these call are in runtime_init.go (call)
 func check_comma() {
-	call(0xAEFD)
+	call(ROM_CHKCOM)
 }
 
 func get_word() uint16 {
-	call(0xAD8A)
-	call(0xB7F7)
+	call(ROM_FRMNUM)
+	call(ROM_GETADR)
 	return uint16(RAM[0x14]) | (uint16(RAM[0x15]) << 8)
 }
 
 func get_byte() byte {
-	call(0xB79E)
+	call(ROM_GETBYT)
 	return X
 }
 
 func get_string() string {
-	call(0xAD9E)
-	call(0xB6A3)
+	call(ROM_FRMEVL)
+	call(ROM_FRESTR)
 	base := uint16(X) | (uint16(Y) << 8)
 	return string(RAM[base:base + uint16(A)])
 }
@@ -148,17 +143,17 @@ const (
 // originally error(), renamed to avoid conflict with Go error
 func error_x(index byte) uint16 {
 	X = index
-	return 0xA437		// error handler
+	return ROM_ERROR
 }
 
 /*
  * Print BASIC Error Message
  *
  * We could add handling of extra error codes here, or
- * print friendlier strings, or implement "ON ERROR GOTO".
+ * print friendlier strings. ON ERROR GOTO is done here.
  */
 func plugin_error() uint16 {
-	return 0
+	return trap_error()
 }
 
 /*
@@ -170,18 +165,145 @@ func plugin_main() uint16 {
 	return 0
 }
 
+/*
+ * Keywords
+ *
+ * A keyword's token is its place in plugin_keywords, so a program
+ * saved with new keywords in it lists and runs the same only with the
+ * same keywords added in the same order. The ones here come first.
+ */
+type plugin_keyword struct {
+	name		string
+	statement	func() uint16		// or nil
+	function	func() uint16		// in EVAL, or nil
+}
+
+/*
+ * A statement starts with TXTPTR on the character after its keyword
+ * and returns where BASIC goes next, like the plugin vectors do:
+ * end_statement() after the statement, or error_x() on an error. An
+ * override can also return 0 to let BASIC run the statement as usual.
+ * Most statements are better written with register_statement (see
+ * extensions.go), which does this for them.
+ */
+var (
+	plugin_keywords	[]plugin_keyword
+	plugin_overrides	map[byte]func() uint16
+)
+
+// (in init, since the statements call BASIC, which crunches with the tables)
+func init() {
+	register_statement("LOCATE", locate)
+	add_plugin_keyword("RESUME", resume, nil)		// see errortrap.go
+	register_statement("QUIT", quit)
+	register_string_function("HEX$", hex_string)		// see functions.go
+	register_function("DEC", dec)
+	register_string_function("ENV$", env_string)
+	register_function("TIMEMS", timems)
+	plugin_overrides = map[byte]func() uint16{
+		0x91:	on_error_goto,		// ON
+		0x92:	wait_6502,		// WAIT
+	}
+}
+
+/*
+ * add_plugin_keyword gives name the next token. A name is a letter
+ * and then letters and digits, with a $ at the end for a string
+ * function; it has at least two characters, so that its two tokens
+ * never take more room than it does.
+ */
+func add_plugin_keyword(name string, statement func() uint16, function func() uint16) {
+	ok := len(name) >= 2 && name[0] >= 'A' && name[0] <= 'Z'
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '$' && i == len(name) - 1) {
+			ok = false
+		}
+	}
+	if !ok {
+		fatalf("plugin keyword %q: not a keyword name", name)
+	}
+	for _, kw := range plugin_keywords {
+		if kw.name == name {
+			fatalf("plugin keyword %s added twice", name)
+		}
+	}
+	if len(plugin_keywords) == 0x80 {
+		fatalf("plugin keyword %s: no tokens left", name)
+	}
+	plugin_keywords = append(plugin_keywords, plugin_keyword{ name, statement, function })
+}
+
+/* match_plugin_keyword returns the tokens of the new keyword at the start of b, or nil */
+func match_plugin_keyword(b []byte) []byte {
+	for i, kw := range plugin_keywords {
+		if bytes.HasPrefix(b, []byte(kw.name)) {
+			return []byte{ TOKEN_ESCAPE, byte(0x80 + i) }
+		}
+	}
+	return nil
+}
+
+/* plugin_keyword_name returns the name of the new keyword with token c (after TOKEN_ESCAPE) */
+func plugin_keyword_name(c byte) (string, bool) {
+	i := int(c) - 0x80
+	if i < 0 || i >= len(plugin_keywords) {
+		return "", false
+	}
+	return plugin_keywords[i].name, true
+}
+
+/* end_statement goes on to the next statement if TXTPTR is at the end of this one */
+func end_statement() uint16 {
+	if !end_of_statement() {
+		return error_x(ERROR_SYNTAX)
+	}
+	return NEWSTT
+}
+
 /*
  * Tokenize BASIC Text
+ *
+ * This crunches the line at TXTPTR into the start of the input buffer,
+ * and leaves things the way the ROM's CRUNCH does: the line ends in
+ * two zeros, Y is its length plus 5 and TXTPTR is just before it.
  */
 func plugin_crnch() uint16 {
-	return 0
+	start := get_chrptr()
+	end := start
+	for RAM[end] != 0 {
+		end++
+	}
+	line := crunch(RAM[start:end], true)
+	n := copy(RAM[0x0200:], line)
+	RAM[0x0200 + n] = 0
+	RAM[0x0200 + n + 2] = 0
+	set_chrptr(0x01FF)
+	A = 0xFF
+	Y = byte(n + 5)
+	return ROM_CRUNCH_DONE
 }
 
 /*
  * BASIC Text LIST
+ *
+ * A is the byte to list, at Y in the line at ($5F).
  */
 func plugin_qplop() uint16 {
-	return 0
+	if A != TOKEN_ESCAPE || RAM[0x0F] & 0x80 != 0 {		// not in quotes
+		return 0
+	}
+	line := uint16(RAM[0x5F]) | (uint16(RAM[0x60]) << 8)
+	name, ok := plugin_keyword_name(RAM[line + uint16(Y) + 1])
+	if !ok {
+		return ROM_QPLOP_CHAR	// list it as it is
+	}
+	for i := 0; i < len(name); i++ {
+		A = name[i]
+		CHROUT()
+	}
+	Y++
+	return ROM_QPLOP_NEXT	// the byte after the token
 }
 
 /*
@@ -190,77 +312,82 @@ func plugin_qplop() uint16 {
  * This is used for interpreting statements.
  */
 func plugin_gone() uint16 {
-	set_chrptr(get_chrptr() + 1)
-	for {
-		var chrptr uint16
-
-		set_chrptr(get_chrptr() - 1)
-		chrptr = get_chrptr()
-
-		/*
-		 * this example shows:
-		 * - how to get a 16 bit integer
-		 * - how to get an 8 bit integer
-		 * - how to check for a comma delimiter
-		 * - how to do error handling
-		 */
-		if compare("LOCATE") {
-			var x, y byte
-
-			y = get_byte()		// 'line' first
-			check_comma()
-			x = get_byte()		// then 'column'
-			/* XXX ignores terminal size */
-			if x > 80 || y > 25 || x == 0 || y == 0 {
-				return error_x(ERROR_ILLEGAL_QUANTITY)
-			}
-			move_cursor(x, y)
-
-			continue
+	note_statement()
+	chrptr := get_chrptr()
+	CHRGET()
+	if A == TOKEN_ESCAPE {
+		CHRGET()
+		i := int(A) - 0x80
+		if i < 0 || i >= len(plugin_keywords) || plugin_keywords[i].statement == nil {
+			return error_x(ERROR_SYNTAX)		// or a function
+		}
+		CHRGET()
+		return plugin_keywords[i].statement()
+	}
+	if f, ok := plugin_overrides[A]; ok {
+		CHRGET()
+		if pc := f(); pc != 0 {
+			return pc
 		}
+	}
+	set_chrptr(chrptr)
+	return 0
+}
+
+/*
+ * this example shows:
+ * - how to add a statement (see extensions.go)
+ * - how to get 8 bit integers
+ * - how to do error handling
+ */
+func locate(args *basic_args) error {
+	y := args.get_byte()		// 'line' first
+	x := args.get_byte()		// then 'column'
+	// counting from 1
+	if !set_cursor(int(x) - 1, int(y) - 1) {
+		return basic_err(ERROR_ILLEGAL_QUANTITY)
+	}
+	return nil
+}
 
-		/*
-		 * this example shows:
-		 * - how to override existing keywords
-		 * - how to hand the instruction to the
-		 *   original interpreter if we don't want
-		 *   to handle it
-		 */
-		if compare("\222") {		// 0x92 - WAIT
-			var a uint16
+func quit(args *basic_args) error {
+	exit(0)
+	return nil
+}
 
-			a = get_word()
-			check_comma()
-			get_byte()
-			if a == 6502 {
-				fmt.Printf("MICROSOFT!")
-				continue
-			} else {
-				set_chrptr(chrptr)
-				return 0
-			}
-		}
+/*
+ * this example shows:
+ * - how to override existing keywords
+ * - how to get a 16 bit integer
+ * - how to hand the instruction to the
+ *   original interpreter if we don't want
+ *   to handle it
+ */
+func wait_6502() uint16 {
+	var a uint16
 
-		/*
-		 * this example shows:
-		 * - how to deal with new keywords that contain
-		 *   existing keywords
-		 * - how to parse a string
-		 */
-//		if compare("\236TEM") {
-//			s = get_string()
-//			// TODO(andlabs) - UNIX ONLY
-//			exec.Command("sh", "-c", s).Run()
-//
-//			continue
-//		}
+	a = get_word()
+	check_comma()
+	get_byte()
+	if a != 6502 {
+		return 0
+	}
+	fmt.Printf("MICROSOFT!")
+	return end_statement()
+}
 
-		if compare("QUIT") {
-			os.Exit(0)
-		}
-		break
+/*
+ * this example shows:
+ * - how to look for more than the token
+ * - how to go somewhere else than the next statement
+ * (see errortrap.go)
+ */
+func on_error_goto() uint16 {
+	set_chrptr(get_chrptr() - 1)		// compare starts before the text
+	if !compare("ERR\260\211") {		// ERR OR GOTO
+		return 0
 	}
-	return 0
+	return on_error()
 }
 
 /*
@@ -270,5 +397,17 @@ func plugin_gone() uint16 {
  * New functions and operators go here.
  */
 func plugin_eval() uint16 {
-	return 0
+	chrptr := get_chrptr()
+	CHRGET()
+	if A != TOKEN_ESCAPE {
+		set_chrptr(chrptr)
+		return 0
+	}
+	CHRGET()
+	i := int(A) - 0x80
+	if i < 0 || i >= len(plugin_keywords) || plugin_keywords[i].function == nil {
+		return error_x(ERROR_SYNTAX)		// or a statement
+	}
+	CHRGET()
+	return plugin_keywords[i].function()
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// keyword is the tokens of a plugin keyword, for compare
+func keyword(name string) string {
+	return string(match_plugin_keyword([]byte(name)))
+}
+
+func TestPluginCrnch(t *testing.T) {
+	copy(RAM[0x0200:], "10 ?\"QUIT\":LOCATE 1,2\x00")
+	set_chrptr(0x0203)		// after the line number
+
+	if pc := plugin_crnch(); pc != ROM_CRUNCH_DONE {
+		t.Errorf("pc $%04X, want CRUNCH's RTS", pc)
+	}
+	want := append([]byte{ 0x99, '"', 'Q', 'U', 'I', 'T', '"', ':', 0xFE, 0x80, ' ', '1', ',', '2' }, 0)
+	if !bytes.Equal(RAM[0x0200:0x0200 + len(want)], want) || RAM[0x0200 + len(want) + 1] != 0 {
+		t.Errorf("got % X, want % X", RAM[0x0200:0x0200 + len(want) + 2], want)
+	}
+	if Y != byte(len(want) - 1 + 5) || get_chrptr() != 0x01FF {
+		t.Errorf("Y=%d TXTPTR=$%04X, want Y=%d TXTPTR=$01FF", Y, get_chrptr(), len(want) - 1 + 5)
+	}
+}
+
+func TestPluginQplop(t *testing.T) {
+	load_test_program(t, "10 RESUME:LOCATE 1,1:?\"AB\"\n")
+	line, _ := find_line(10)
+	RAM[0x5F], RAM[0x60] = byte(line), byte(line >> 8)
+	RAM[line + 16], RAM[line + 17] = 0xFE, 0xC0		// in the string
+
+	tests := []struct {
+		name		string
+		y		byte
+		quote		byte
+		want_pc	uint16
+		want_y	byte
+		want		string
+	}{
+		{ "RESUME", 4, 1, ROM_QPLOP_NEXT, 5, "RESUME" },
+		{ "LOCATE", 7, 1, ROM_QPLOP_NEXT, 8, "LOCATE" },
+		{ "in quotes", 16, 0xFE, 0, 16, "" },
+		{ "not a keyword", 16, 1, ROM_QPLOP_CHAR, 16, "" },
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+
+		// list to a file, to see what was printed
+		kernal_file_setup(&test_device{ w: &out, channels: map[byte]*disk_channel{} }, 2, 1)
+		OPEN()
+		X = 2
+		CHKOUT()
+		RAM[0x0F] = tt.quote
+		Y = tt.y
+		A = RAM[line + uint16(Y)]
+		pc := plugin_qplop()
+		y := Y
+		CLRCHN()
+		A = 2
+		CLOSE()
+		if pc != tt.want_pc || y != tt.want_y || out.String() != tt.want {
+			t.Errorf("%s: pc $%04X Y %d listed %q, want $%04X %d %q", tt.name, pc, y, out.String(), tt.want_pc, tt.want_y, tt.want)
+		}
+	}
+}
+
+func TestPluginGone(t *testing.T) {
+	defer func() {
+		on_error_line, in_error_handler = -1, false
+	}()
+	load_test_program(t, "10 RESUME\n20 ON ERROR GOTO 100\n30 ON A GOTO 10\n40 PRINT\n50 LOCATE\n")
+	line50, _ := find_line(50)
+	RAM[line50 + 5] = 0xC0		// not a keyword
+
+	tests := []struct {
+		line		uint16
+		want_pc	uint16
+		want_x	byte
+	}{
+		{ 10, ROM_ERROR, ERROR_CANT_CONTINUE },		// RESUME outside the handler
+		{ 20, NEWSTT, 0 },
+		{ 30, 0, 0 },
+		{ 40, 0, 0 },
+		{ 50, ROM_ERROR, ERROR_SYNTAX },
+	}
+	for _, tt := range tests {
+		statement_at(t, tt.line, 0)
+		start := get_chrptr()
+		X = 0
+		pc := plugin_gone()
+		if pc != tt.want_pc || X != tt.want_x {
+			t.Errorf("line %d: pc $%04X X %d, want $%04X %d", tt.line, pc, X, tt.want_pc, tt.want_x)
+		}
+		if pc == 0 && get_chrptr() != start {
+			t.Errorf("line %d: TXTPTR $%04X, want it back at $%04X", tt.line, get_chrptr(), start)
+		}
+	}
+	if on_error_line != 100 {
+		t.Errorf("ON ERROR GOTO 100 set the handler to %d", on_error_line)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/************************************************************
+ *
+ * Activity Profiler
+ *
+ ************************************************************/
+
+/*
+ * The profiler counts how often each node and each transistor
+ * changes state, broken down by the opcode in IR and the active
+ * T-state(s) at the start of the half-cycle in which the change
+ * happened. The number of state changes is roughly proportional
+ * to the dynamic power the chip draws, so the totals double as a
+ * (very rough) power estimate.
+ *
+ * Counting happens in set_nodes_value() and set_transistors_on(),
+ * which only run on the goroutine that drives the chip (chiploop, or
+ * a test). That goroutine counts into its own profiler without any
+ * locking; the counts are merged into a copy when the profile is
+ * written.
+ */
+type profile_key struct {
+	ir		byte
+	t		byte		// bitmask from readT()
+}
+
+type profile_counts struct {
+	halfcycles	uint64
+	nodes		[NODES]uint32
+	transistors	[TRANSISTORS]uint32
+}
+
+type profiler struct {
+	data		map[profile_key]*profile_counts
+	cur		*profile_counts
+}
+
+func new_profiler() *profiler {
+	return &profiler{
+		data:	map[profile_key]*profile_counts{},
+	}
+}
+
+var (
+	profiling		bool
+	chip_profile	= new_profiler()		// only touched by the goroutine driving the chip
+)
+
+var (
+	profile_file = flag.String("profile", "", "write node/transistor activity per opcode and T-state to `file` (.json for JSON, CSV otherwise)")
+	profile_top = flag.Int("profile-top", 10, "number of hottest nodes per instruction to list in the profile summary on stderr (0 to disable)")
+)
+
+func init_profile() {
+	if *profile_file == "" {
+		return
+	}
+	profiling = true
+	at_exit(func() {
+		data := collect_profile()
+		if err := write_profile_file(*profile_file, data); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing profile: %v\n", err)
+		}
+		if *profile_top > 0 {
+			write_profile_summary(os.Stderr, data, *profile_top)
+		}
+	})
+}
+
+/*
+ * Called by chiploop before each clock edge; all state changes up to
+ * the next call are attributed to the opcode and T-state seen here.
+ */
+func profile_halfcycle() {
+	chip_profile.halfcycle(readIR(), readT())
+}
+
+func (p *profiler) halfcycle(ir byte, t byte) {
+	key := profile_key{
+		ir:	ir,
+		t:	t,
+	}
+	pc := p.data[key]
+	if pc == nil {
+		pc = new(profile_counts)
+		p.data[key] = pc
+	}
+	pc.halfcycles++
+	p.cur = pc
+}
+
+func profile_node(node uint64) {
+	if chip_profile.cur != nil {
+		chip_profile.cur.nodes[node]++
+	}
+}
+
+func profile_transistor(t uint64) {
+	if chip_profile.cur != nil {
+		chip_profile.cur.transistors[t]++
+	}
+}
+
+/* merge_into adds p's counts to data */
+func (p *profiler) merge_into(data map[profile_key]*profile_counts) {
+	for k, pc := range p.data {
+		sum := data[k]
+		if sum == nil {
+			sum = new(profile_counts)
+			data[k] = sum
+		}
+		sum.halfcycles += pc.halfcycles
+		for n, count := range pc.nodes {
+			sum.nodes[n] += count
+		}
+		for t, count := range pc.transistors {
+			sum.transistors[t] += count
+		}
+	}
+}
+
+/* collect_profile stops the chip and merges its counts into a copy for the writers below */
+func collect_profile() map[profile_key]*profile_counts {
+	data := map[profile_key]*profile_counts{}
+	stop_chip()
+	chip_profile.merge_into(data)
+	return data
+}
+
+func tstate_name(t byte) string {
+	var s []string
+
+	for i := uint(0); i < 6; i++ {
+		if t & (1 << i) != 0 {
+			s = append(s, fmt.Sprintf("T%d", i))
+		}
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, "+")
+}
+
+// the keys of data, sorted by opcode then T-state
+func profile_keys(data map[profile_key]*profile_counts) []profile_key {
+	keys := make([]profile_key, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ir != keys[j].ir {
+			return keys[i].ir < keys[j].ir
+		}
+		return keys[i].t < keys[j].t
+	})
+	return keys
+}
+
+func write_profile_file(filename string, data map[profile_key]*profile_counts) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if strings.HasSuffix(filename, ".json") {
+		err = write_profile_json(w, data)
+	} else {
+		err = write_profile_csv(w, data)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// one row per (opcode, T-state, node or transistor) with a nonzero count
+func write_profile_csv(w io.Writer, data map[profile_key]*profile_counts) error {
+	_, err := fmt.Fprintf(w, "opcode,tstate,halfcycles,kind,index,name,count\n")
+	if err != nil {
+		return err
+	}
+	for _, k := range profile_keys(data) {
+		pc := data[k]
+		for n, count := range pc.nodes {
+			if count == 0 {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "%02X,%s,%d,node,%d,%s,%d\n",
+				k.ir, tstate_name(k.t), pc.halfcycles, n, node_name(uint64(n)), count)
+			if err != nil {
+				return err
+			}
+		}
+		for t, count := range pc.transistors {
+			if count == 0 {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "%02X,%s,%d,transistor,%d,%s,%d\n",
+				k.ir, tstate_name(k.t), pc.halfcycles, t, transistor_name(uint64(t)), count)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type profile_json_entry struct {
+	Opcode		string			`json:"opcode"`
+	TState		string			`json:"tstate"`
+	HalfCycles	uint64			`json:"halfcycles"`
+	Nodes		map[string]uint32	`json:"nodes"`
+	Transistors	map[string]uint32	`json:"transistors"`
+}
+
+func write_profile_json(w io.Writer, data map[profile_key]*profile_counts) error {
+	entries := []profile_json_entry{}
+	for _, k := range profile_keys(data) {
+		pc := data[k]
+		e := profile_json_entry{
+			Opcode:		fmt.Sprintf("%02X", k.ir),
+			TState:		tstate_name(k.t),
+			HalfCycles:	pc.halfcycles,
+			Nodes:		map[string]uint32{},
+			Transistors:	map[string]uint32{},
+		}
+		for n, count := range pc.nodes {
+			if count != 0 {
+				e.Nodes[node_name(uint64(n))] = count
+			}
+		}
+		for t, count := range pc.transistors {
+			if count != 0 {
+				e.Transistors[transistor_name(uint64(t))] = count
+			}
+		}
+		entries = append(entries, e)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(entries)
+}
+
+/*
+ * For each opcode, print the total number of state changes (over all
+ * its T-states), the average per half-cycle as the power estimate, and
+ * the top hottest nodes.
+ */
+func write_profile_summary(w io.Writer, data map[profile_key]*profile_counts, top int) {
+	type opcode_total struct {
+		halfcycles	uint64
+		flips		uint64
+		nodes		[NODES]uint64
+	}
+
+	var totals [256]*opcode_total
+	for k, pc := range data {
+		ot := totals[k.ir]
+		if ot == nil {
+			ot = new(opcode_total)
+			totals[k.ir] = ot
+		}
+		ot.halfcycles += pc.halfcycles
+		for n, count := range pc.nodes {
+			ot.nodes[n] += uint64(count)
+			ot.flips += uint64(count)
+		}
+		for _, count := range pc.transistors {
+			ot.flips += uint64(count)
+		}
+	}
+
+	fmt.Fprintf(w, "opcode  halfcycles  changes  changes/halfcycle  hottest nodes\n")
+	for ir, ot := range totals {
+		if ot == nil {
+			continue
+		}
+		hot := make([]int, NODES)
+		for n := range hot {
+			hot[n] = n
+		}
+		sort.SliceStable(hot, func(i, j int) bool {
+			return ot.nodes[hot[i]] > ot.nodes[hot[j]]
+		})
+		if top > len(hot) {
+			top = len(hot)
+		}
+		var names []string
+		for _, n := range hot[:top] {
+			if ot.nodes[n] == 0 {
+				break
+			}
+			names = append(names, fmt.Sprintf("%s(%d)", node_name(uint64(n)), ot.nodes[n]))
+		}
+		fmt.Fprintf(w, "    %02X  %10d  %7d  %17.1f  %s\n",
+			ir, ot.halfcycles, ot.flips,
+			float64(ot.flips) / float64(ot.halfcycles),
+			strings.Join(names, " "))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// set_ir_t puts the chip's IR and timing nodes in the given state
+func set_ir_t(ir byte, t byte) {
+	for i, nn := range []uint64{ notir0, notir1, notir2, notir3, notir4, notir5, notir6, notir7 } {
+		set_bitmap(nodes_value, nn, ir & (1 << uint(i)) == 0)
+	}
+	for i, nn := range []uint64{ clock1, clock2, t2, t3, t4, t5 } {
+		set_bitmap(nodes_value, nn, t & (1 << uint(i)) == 0)
+	}
+}
+
+// with_profile runs f with a fresh profiler and the chip's nodes restored afterwards
+func with_profile(f func()) {
+	saved_nodes := append([]bitmap_t(nil), nodes_value...)
+	saved_profile := chip_profile
+	defer func() {
+		copy(nodes_value, saved_nodes)
+		chip_profile = saved_profile
+		profiling = false
+	}()
+	chip_profile = new_profiler()
+	profiling = true
+	f()
+}
+
+func TestProfileHalfcycle(t *testing.T) {
+	with_profile(func() {
+		set_ir_t(0xA9, 0x01)
+		profile_halfcycle()
+		set_nodes_value(100, !get_nodes_value(100))
+		set_nodes_value(100, !get_nodes_value(100))
+		set_nodes_value(100, get_nodes_value(100))		// no change, not counted
+		set_transistors_on(7, !transistor_state(7))
+
+		set_ir_t(0xA9, 0x02)
+		profile_halfcycle()
+		set_nodes_value(200, !get_nodes_value(200))
+
+		set_ir_t(0xA9, 0x01)
+		profile_halfcycle()
+		set_nodes_value(100, !get_nodes_value(100))
+
+		data := map[profile_key]*profile_counts{}
+		chip_profile.merge_into(data)		// no chiploop to probe here
+		if len(data) != 2 {
+			t.Fatalf("got %d keys, want 2", len(data))
+		}
+		t0 := data[profile_key{ 0xA9, 0x01 }]
+		t1 := data[profile_key{ 0xA9, 0x02 }]
+		if t0 == nil || t1 == nil {
+			t.Fatalf("missing keys: %v", data)
+		}
+		if t0.halfcycles != 2 || t0.nodes[100] != 3 || t0.transistors[7] != 1 || t0.nodes[200] != 0 {
+			t.Errorf("T0: halfcycles %d, node 100 %d, transistor 7 %d, node 200 %d",
+				t0.halfcycles, t0.nodes[100], t0.transistors[7], t0.nodes[200])
+		}
+		if t1.halfcycles != 1 || t1.nodes[200] != 1 || t1.nodes[100] != 0 {
+			t.Errorf("T1: halfcycles %d, node 200 %d, node 100 %d", t1.halfcycles, t1.nodes[200], t1.nodes[100])
+		}
+	})
+}
+
+func TestProfileMerge(t *testing.T) {
+	p := new_profiler()
+	p.halfcycle(0xEA, 0x01)
+	p.cur.nodes[5] = 2
+	q := new_profiler()
+	q.halfcycle(0xEA, 0x01)
+	q.cur.nodes[5] = 3
+	q.halfcycle(0x00, 0x01)
+
+	data := map[profile_key]*profile_counts{}
+	p.merge_into(data)
+	q.merge_into(data)
+	if pc := data[profile_key{ 0xEA, 0x01 }]; pc.halfcycles != 2 || pc.nodes[5] != 5 {
+		t.Errorf("got %d halfcycles, %d changes of node 5", pc.halfcycles, pc.nodes[5])
+	}
+	if p.data[profile_key{ 0xEA, 0x01 }].nodes[5] != 2 {
+		t.Errorf("merge changed its source")
+	}
+}
+
+func test_profile_data() map[profile_key]*profile_counts {
+	p := new_profiler()
+	p.halfcycle(0xA9, 0x04)
+	p.cur.nodes[100] = 4
+	p.cur.transistors[7] = 2
+	p.halfcycle(0x18, 0x01)
+	p.cur.nodes[200] = 1
+	p.cur.nodes[300] = 5
+	p.cur.nodes[400] = 3
+	return p.data
+}
+
+func TestWriteProfileCSV(t *testing.T) {
+	var b bytes.Buffer
+	if err := write_profile_csv(&b, test_profile_data()); err != nil {
+		t.Fatal(err)
+	}
+	want := "opcode,tstate,halfcycles,kind,index,name,count\n" +
+		fmt.Sprintf("18,T0,1,node,200,%s,1\n", node_name(200)) +
+		fmt.Sprintf("18,T0,1,node,300,%s,5\n", node_name(300)) +
+		fmt.Sprintf("18,T0,1,node,400,%s,3\n", node_name(400)) +
+		fmt.Sprintf("A9,T2,1,node,100,%s,4\n", node_name(100)) +
+		fmt.Sprintf("A9,T2,1,transistor,7,%s,2\n", transistor_name(7))
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+	if transistor_name(7) == "" {
+		t.Errorf("transistor has no name")
+	}
+}
+
+func TestWriteProfileJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := write_profile_json(&b, test_profile_data()); err != nil {
+		t.Fatal(err)
+	}
+	var got []profile_json_entry
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Opcode != "18" || got[1].Opcode != "A9" || got[1].TState != "T2" {
+		t.Fatalf("got %+v", got)
+	}
+	if got[1].Nodes[node_name(100)] != 4 || got[1].Transistors[transistor_name(7)] != 2 || got[0].Nodes[node_name(300)] != 5 {
+		t.Errorf("got %+v", got)
+	}
+	// transistors are named as in the CSV, not numbered
+	for name := range got[1].Transistors {
+		if !strings.Contains(name, ":") {
+			t.Errorf("transistor %q has no name", name)
+		}
+	}
+}
+
+func TestWriteProfileSummary(t *testing.T) {
+	var b bytes.Buffer
+	write_profile_summary(&b, test_profile_data(), 2)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %q", lines)
+	}
+	// the two hottest of 300 (5), 400 (3) and 200 (1), hottest first
+	want := fmt.Sprintf("    18           1        9                9.0  %s(5) %s(3)", node_name(300), node_name(400))
+	if lines[1] != want {
+		t.Errorf("got %q, want %q", lines[1], want)
+	}
+	// node and transistor changes both count
+	want = fmt.Sprintf("    A9           1        6                6.0  %s(4)", node_name(100))
+	if lines[2] != want {
+		t.Errorf("got %q, want %q", lines[2], want)
+	}
+}
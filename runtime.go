@@ -28,10 +28,8 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"time"
 	// ...
@@ -42,25 +40,18 @@ import (
 // the main program must set this to true if it had #define DEBUG before
 var DEBUG bool = false
 
+/*
+ * RAM is the 6502's memory, the one the monitor hands it over the bus,
+ * so what the KERNAL and plugin code reads and writes here is what the
+ * ROM sees; the trap code runs with memory_mu held (see runtime_init.go).
+ */
 var (
-	RAM		[65536]byte
+	RAM		= &memory
 )
 
-func stack4(a uint16, b uint16, c uint16, d uint16) bool {
-//	printf("stack4: %x,%x,%x,%x\n", a, b, c, d);
-	if STACK16(S+1) + 1 != a {
-		return false
-	}
-	if STACK16(S+3) + 1 != b {
-		return false
-	}
-	if STACK16(S+5) + 1 != c {
-		return false
-	}
-	if STACK16(S+7) + 1 != d {
-		return false
-	}
-	return true
+// caller names the code that JSRed to the KERNAL function being trapped
+func caller() string {
+	return symbolize(STACK16(S+1) + 1)
 }
 
 /*
@@ -161,10 +152,22 @@ const (
 	KERN_ERR_MISSING_FILE_NAME = 8
 	KERN_ERR_ILLEGAL_DEVICE_NUMBER = 9
 
+	KERN_ST_TIME_OUT_WRITE = 0x01
 	KERN_ST_TIME_OUT_READ = 0x02
+	KERN_ST_VERIFY = 0x10		// VERIFY found a difference
+	KERN_ST_READ_ERROR = 0x20		// the tape's checksum error bit, so BASIC can tell it from a mismatch
 	KERN_ST_EOF = 0x40
+	KERN_ST_DEVICE_NOT_PRESENT = 0x80
 )
 
+/*
+ * A KERNAL call that fails in a way BASIC would not notice from the
+ * return values (an error reading INPUT#, writing PRINT#, ...) sets
+ * basic_error to one of the ERROR_ numbers; instead of returning, the
+ * 6502 then goes to BASIC's error handler, like error_x does for plugins.
+ */
+var basic_error byte
+
 /* KERNAL internal state */
 var (
 	kernal_msgflag		byte
@@ -177,11 +180,15 @@ var (
 	kernal_quote			int = 0
 	kernal_output			byte = 0
 	kernal_input			byte = 0
-	kernal_files = []*os.File{ nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil }
-	kernal_files_next = []int{ 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0 }
+	kernal_files			= map[byte]*kernal_file{}
 )
 
-const EOF = 0xFFFF
+/* an open logical file: the device it was opened on and its secondary address */
+type kernal_file struct {
+	dev		device
+	devnum	byte
+	sec		byte
+}
 
 /* shell script hack */
 var (
@@ -190,6 +197,28 @@ var (
 	input_file		*os.File
 )
 
+var (
+	quiet_output	bool		// from the banner or READY to the next prompt, when not interactive
+	reading_line	bool		// INLIN is reading a line at the READY prompt
+)
+
+func init() {
+	on_hook(HOOK_BANNER, func() {
+		quiet_output = !interactive
+	})
+	on_hook(HOOK_READY, func() {
+		readycount++
+		quiet_output = !interactive
+	})
+	on_hook(HOOK_MAIN, func() {
+		quiet_output = false
+		reading_line = true
+	})
+	on_hook(HOOK_LINE, func() {
+		reading_line = false
+	})
+}
+
 func init_os(args []string) uint16 {
 	var err error
 
@@ -198,7 +227,10 @@ func init_os(args []string) uint16 {
 		return PC
 	}
 
-	if len(args) > 1 {
+	if *batch_flag {
+		interactive = false		// init_batch loads the program
+		input_file = nil
+	} else if len(args) > 1 {
 		interactive = false
 		input_file, err = os.Open(args[1])
 		if err != nil {
@@ -231,7 +263,7 @@ func init_os(args []string) uint16 {
 	}
 	rand.Seed(time.Now().Unix())
 
-	return 0xE394		// main entry point of BASIC
+	return ROM_COLD_START
 }
 
 var (
@@ -293,7 +325,7 @@ func SETMSG() {
 func MEMTOP() {
 	if DEBUG {		// CBMBASIC doesn't do this
 		if !C {
-			fatalf("UNIMPL: set top of RAM")
+			fatalf("UNIMPL: set top of RAM (called from %s)", caller())
 		}
 	}
 	X = byte(RAM_TOP & 0xFF)
@@ -311,7 +343,7 @@ func MEMTOP() {
 func MEMBOT() {
 	if DEBUG {		// CBMBASIC doesn't do this
 		if !C {
-			fatalf("UNIMPL: set bot of RAM")
+			fatalf("UNIMPL: set bot of RAM (called from %s)", caller())
 		}
 	}
 	X = byte(RAM_BOT & 0xFF)
@@ -346,43 +378,43 @@ func OPEN() {
 	if kernal_files[kernal_lfn] != nil {
 		C = true
 		A = KERN_ERR_FILE_OPEN
-	} else if kernal_filename_len == 0 {
+		return
+	}
+	dev, err := find_device(kernal_dev)
+	if err != KERN_ERR_NONE {
 		C = true
-		A = KERN_ERR_MISSING_FILE_NAME
-	} else {
-		var f *os.File
-		var err error
-
-		filename := string(RAM[kernal_filename:kernal_filename + kernal_filename_len])
-		if kernal_sec == 0 {
-			f, err = os.Open(filename)
-		} else {
-			f, err = os.Create(filename)
-		}
-		// TODO(andlabs) - report error on stderr?
-		if err != nil {
-			f = nil
-		}
-		kernal_files[kernal_lfn] = f
-		if kernal_files[kernal_lfn] != nil {
-			kernal_files_next[kernal_lfn] = EOF
-			C = false
-		} else {
-			C = true
-			A = KERN_ERR_FILE_NOT_FOUND
-		}
+		A = err
+		return
+	}
+	filename := string(RAM[kernal_filename:kernal_filename + kernal_filename_len])
+	err = dev.open(filename, kernal_sec)
+	if err != KERN_ERR_NONE {
+		C = true
+		A = err
+		return
 	}
+	kernal_files[kernal_lfn] = &kernal_file{
+		dev:		dev,
+		devnum:	kernal_dev,
+		sec:		kernal_sec,
+	}
+	C = false
 }
 
 /* CLOSE */
 // TODO(andlabs) - was static; this makes it exported (worry?)
 func CLOSE() {
-	if kernal_files[kernal_lfn] == nil {
+	f := kernal_files[kernal_lfn]
+	if f == nil {
 		C = true
 		A = KERN_ERR_FILE_NOT_OPEN
 	} else {
-		kernal_files[kernal_lfn].Close()
-		kernal_files[kernal_lfn] = nil
+		st := f.dev.close(f.sec)
+		delete(kernal_files, kernal_lfn)
+		kernal_status |= st
+		if st & KERN_ST_DEVICE_NOT_PRESENT != 0 {
+			basic_error = ERROR_DEVICE_NOT_PRESENT
+		}
 		C = false
 	}
 }
@@ -432,49 +464,37 @@ var (
 /* CHRIN */
 // TODO(andlabs) - was static; this makes it exported (worry?)
 func CHRIN() {
-	var c []byte
-	var err error
-
-	if (!interactive) && (readycount == 2) {
-		os.Exit(0)
+	if (!interactive) && (!batch) && (readycount == 2) {
+		exit(0)
 	}
-	if kernal_input != 0 {
-		if kernal_files_next[kernal_input] == EOF {
-			c := make([]byte, 1)
-			_, err := kernal_files[kernal_input].Read(c)
-			if err == io.EOF {
-				kernal_status |= KERN_ST_EOF
-				kernal_status |= KERN_ST_TIME_OUT_READ
-				A = 13
-				goto out
-			} else if err != nil {
-				// TODO(andlabs)
-			} else {
-				kernal_files_next[kernal_input] = int(c[0])
-			}
+	if f := kernal_files[kernal_input]; kernal_input != 0 && f != nil {
+		A = f.dev.read(f.sec)
+		st := f.dev.status(f.sec)
+		kernal_status |= st
+		if st & KERN_ST_TIME_OUT_READ != 0 {
+			A = 13
 		}
-		A = byte(kernal_files_next[kernal_input] & 0xFF)
-		c = make([]byte, 1)
-		_, err = kernal_files[kernal_input].Read(c)
-		if err == io.EOF {
-			kernal_status |= KERN_ST_EOF
-			kernal_files_next[kernal_input] = EOF
-		} else if err != nil {
-			// TODO(andlabs)
-		} else {
-			kernal_files_next[kernal_input] = int(c[0])
+		if st & KERN_ST_READ_ERROR != 0 {
+			A = 13
+			basic_error = ERROR_FILE_DATA
 		}
-	out:
+	} else {
+		A = keyboard_chrin()
+	}
+	C = false
+}
+
+/* what CHRIN reads from the keyboard, which may be a BASIC program given on the command line */
+func keyboard_chrin() byte {
+	var A byte
+
+	if batch && reading_line {
+		A = batch_chrin()
+	} else if input_file == nil && editor_active {
+		A = editor.chrin()
 	} else if input_file == nil {
-		c := make([]byte, 1)
-		_, err := os.Stdin.Read(c)
-		if err != nil {
-			// TODO(andlabs)
-		}
-		A = c[0]
-		if A=='\n' {
-			A = '\r'
-		}
+		A = keyboard_line_chrin()
+		echoed(A)
 	} else {
 		if fakerun {
 			A = run[fakerun_index]
@@ -483,14 +503,15 @@ func CHRIN() {
 				input_file = nil		// switch to stdin
 			}
 		} else {
-			c := make([]byte, 1)
-			_, err := input_file.Read(c)
-			if err == io.EOF {
-				A = 255		// TODO(andlabs) - is this correct?
-			} else if err != nil {
-				// TODO(andlabs)
+			c, err := read_petscii(input_file, screen_charset)
+			if err != nil {
+				// BASIC programs can't contain 255 (it's pi), so it marks the end
+				if err != io.EOF {
+					host_error(err)
+				}
+				A = 255
 			} else {
-				A = c[0]
+				A = c
 			}
 			if (A == 255) && (readycount == 1) {
 				fakerun = true
@@ -498,12 +519,9 @@ func CHRIN() {
 				A = run[fakerun_index]
 				fakerun_index++
 			}
-			if A == '\n' {
-				A = '\r'
-			}
 		}
 	}
-	C = false
+	return A
 }
 
 /* CHROUT */
@@ -520,41 +538,23 @@ int d = *(unsigned short*)(&RAM[0x0100+S+7]) + 1;
 printf("CHROUT: %d @ %x,%x,%x,%x\n", A, a, b, c, d);
 #endif
 */
-	if !interactive {
-		if stack4(0xe10f, 0xab4a, 0xab30, 0xe430) {
-			/* COMMODORE 64 BASIC V2 */
-			C = false
-			return
-		}
-		if stack4(0xe10f, 0xab4a, 0xab30, 0xe43d) {
-			/* 38911 */
-			C = false
-			return
-		}
-		if stack4(0xe10f, 0xab4a, 0xab30, 0xe444) {
-			/* BASIC BYTES FREE */
-			C = false
-			return
-		}
+	if batch && batch_chrout() {
+		C = false
+		return
 	}
-	if stack4(0xe10f, 0xab4a, 0xab30, 0xa47b) {
-		/* READY */
-		if A == 'R' {
-			readycount++
-		}
-		if !interactive {
-			C = false
-			return
-		}
+	if quiet_output {
+		/* the banner, BYTES FREE and READY, when running a script */
+		C = false
+		return
 	}
-	if stack4(0xe10f, 0xab4a, 0xaadc, 0xa486) {
+	if reading_line && !editor_active {
 		/*
-		 * CR after each entered numbered program line:
+		 * CR after each line entered at the READY prompt:
 		 * The CBM screen editor returns CR when the user
 		 * hits return, but does not print the character,
 		 * therefore CBMBASIC does. On UNIX, the terminal
 		 * prints all input characters, so we have to avoid
-		 * printing it again
+		 * printing it again (unless we are the screen editor)
 		 */
 		C = false
 		return
@@ -563,84 +563,107 @@ printf("CHROUT: %d @ %x,%x,%x,%x\n", A, a, b, c, d);
 //#if 0
 //	printf("CHROUT: %c (%d)\n", A, A);
 //#else
-	if kernal_output != 0 {
-		c := []byte{ A }
-		_, err := kernal_files[kernal_output].Write(c)
-		if err == io.EOF {
+	if f := kernal_files[kernal_output]; kernal_output != 0 && f != nil {
+		f.dev.write(f.sec, A)
+		st := f.dev.status(f.sec)
+		kernal_status |= st
+		if st & KERN_ST_DEVICE_NOT_PRESENT != 0 {
+			basic_error = ERROR_DEVICE_NOT_PRESENT
+			return
+		}
+		if st & KERN_ST_TIME_OUT_WRITE != 0 {
 			C = true
 			A = KERN_ERR_NOT_OUTPUT_FILE
-		} else if err != nil {
-			// TODO(andlabs)
-		} else {
-			C = false
+			return
+		}
+	} else {
+		screen_chrout(A)
+	}
+//#endif
+	C = false
+}
+
+/* what CHROUT prints to the screen */
+func screen_chrout(c byte) {
+	if editor_active {
+		editor.chrout(c)
+		return
+	}
+	if kernal_quote != 0 {		// TODO make kernal_quote a bool?
+		if c == '"' || c == '\n' || c == '\r' {
+			kernal_quote = 0
 		}
+		put_char(c)
 	} else {
-		if kernal_quote != 0 {		// TODO make kernal_quote a bool?
-			if A == '"' || A == '\n' || A == '\r' {
-				kernal_quote = 0
+		switch c {
+		case 5:
+			set_color(COLOR_WHITE)
+		case 10:
+			// do nothing (what is this byte? TODO(andlabs))
+		case 13:
+			newline()
+		case 14:		// lower case character set
+			if screen_charset != CHARSET_NONE {
+				screen_charset = CHARSET_LOWER
 			}
-            		fmt.Printf("%c", A)
-		} else {
-			switch A {
-			case 5:
-				set_color(COLOR_WHITE)
-			case 10:
-				// do nothing (what is this byte? TODO(andlabs))
-			case 13:
-				fmt.Printf("%c%c", 13, 10)
-			case 17:		// CSR DOWN
-				down_cursor()
-			case 19:		// CSR HOME
-				move_cursor(0, 0)
-			case 28:
-				set_color(COLOR_RED)
-			case 29:		// CSR RIGHT
-				right_cursor()
-			case 30:
-				set_color(COLOR_GREEN)
-			case 31:
-				set_color(COLOR_BLUE)
-			case 129:
-				set_color(COLOR_ORANGE)
-			case 144:
-				set_color(COLOR_BLACK)
-			case 145:		// CSR UP
-				up_cursor()
-			case 147:		// clear screen
+		case 17:		// CSR DOWN
+			down_cursor()
+		case 18:		// RVS ON
+			reverse_video(true)
+		case 19:		// CSR HOME
+			home_cursor()
+		case 28:
+			set_color(COLOR_RED)
+		case 29:		// CSR RIGHT
+			right_cursor()
+		case 30:
+			set_color(COLOR_GREEN)
+		case 31:
+			set_color(COLOR_BLUE)
+		case 129:
+			set_color(COLOR_ORANGE)
+		case 142:		// upper case character set
+			if screen_charset != CHARSET_NONE {
+				screen_charset = CHARSET_UPPER
+			}
+		case 144:
+			set_color(COLOR_BLACK)
+		case 146:		// RVS OFF
+			reverse_video(false)
+		case 145:		// CSR UP
+			up_cursor()
+		case 147:		// clear screen
 //#ifndef NO_CLRHOME
-				clear_screen()
+			clear_screen()
 //#endif
-			case 149:
-				set_color(COLOR_BROWN)
-			case 150:
-				set_color(COLOR_LTRED)
-			case 151:
-				set_color(COLOR_GREY1)
-			case 152:
-				set_color(COLOR_GREY2)
-			case 153:
-				set_color(COLOR_LTGREEN)
-			case 154:
-				set_color(COLOR_LTBLUE)
-			case 155:
-				set_color(COLOR_GREY3)
-			case 156:
-				set_color(COLOR_PURPLE)
-			case 158:
-				set_color(COLOR_YELLOW)
-			case 159:
-				set_color(COLOR_CYAN)
-			case 157:		// CSR LEFT
-				left_cursor()
-			case '"':
-				kernal_quote = 1
-				fallthrough
-			default:
-				fmt.Printf("%c", A)
-			}
+		case 149:
+			set_color(COLOR_BROWN)
+		case 150:
+			set_color(COLOR_LTRED)
+		case 151:
+			set_color(COLOR_GREY1)
+		case 152:
+			set_color(COLOR_GREY2)
+		case 153:
+			set_color(COLOR_LTGREEN)
+		case 154:
+			set_color(COLOR_LTBLUE)
+		case 155:
+			set_color(COLOR_GREY3)
+		case 156:
+			set_color(COLOR_PURPLE)
+		case 158:
+			set_color(COLOR_YELLOW)
+		case 159:
+			set_color(COLOR_CYAN)
+		case 157:		// CSR LEFT
+			left_cursor()
+		case '"':
+			kernal_quote = 1
+			fallthrough
+		default:
+			put_char(c)
 		}
-//#endif
-		C = false
 	}
 }
 
@@ -649,195 +672,86 @@ printf("CHROUT: %d @ %x,%x,%x,%x\n", A, a, b, c, d);
 func LOAD() {
 	var start uint16
 	var end uint16
-	var i int
-
-	var err error
-	var filename string
-	var f *os.File
-	var st os.FileInfo
-	var c []byte
 	var b []byte
 
-	if A != 0 {
-		fatalf("UNIMPL: VERIFY")
+	verify := A != 0
+	kernal_status = 0
+	if kernal_dev == DEV_KEYBOARD || kernal_dev == DEV_SCREEN {
+		C = true
+		A = KERN_ERR_ILLEGAL_DEVICE_NUMBER
+		return
+	}
+	dev, err := find_device(kernal_dev)
+	if err != KERN_ERR_NONE {
+		C = true
+		A = err
+		return
 	}
 	if kernal_filename_len == 0 {
-		goto missing_file_name
+		C = true
+		A = KERN_ERR_MISSING_FILE_NAME
+		return
 	}
 
-/* on special filename $ read directory entries and load they in the basic area memory */
-	if RAM[kernal_filename] == '$' {
-		var file_size int64
-		var old_memp uint16			// TODO hack!
-		var memp uint16 = 0x0801		// TODO hack!
-
-		old_memp = memp
-		memp += 2
-		RAM[memp] = 0; memp++
-		RAM[memp] = 0; memp++
-		RAM[memp] = 0x12; memp++		// REVERS ON
-		RAM[memp] = '"'; memp++
-		for i = 0; i < 16; i++ {
-			RAM[memp + uint16(i)] = ' '
-		}
-		cwd, err := os.Getwd()
-		if err != nil {
-			goto device_not_present
-		}
-		if len(cwd) > 256 {		// TODO(andlabs) - correct for getcwd((char*)&RAM[memp], 256)) / memp += strlen((char*)&RAM[memp]) /* only 16 on COMMODORE DOS */ ?
-			cwd = cwd[:256]
-		}
-		for i = 0; i < len(cwd); i++ {
-			RAM[memp] = cwd[i]; memp++
+	// the drive does the rest, including "$" for the directory
+	filename := string(RAM[kernal_filename:kernal_filename + kernal_filename_len])
+	err = dev.open(filename, 0)
+	if err != KERN_ERR_NONE {
+		C = true
+		A = err
+		return
+	}
+	for {		// we cannot read directly into RAM as we cannot guarantee RAM[size of f:] is left alone
+		c := dev.read(0)
+		st := dev.status(0)
+		if st & KERN_ST_READ_ERROR != 0 {
+			// leave memory alone rather than load half a program
+			dev.close(0)
+			kernal_status |= st
+			basic_error = ERROR_LOAD
+			return
 		}
-		RAM[memp] = '"'; memp++
-		RAM[memp] = ' '; memp++
-		RAM[memp] = '0'; memp++
-		RAM[memp] = '0'; memp++
-		RAM[memp] = ' '; memp++
-		RAM[memp] = '2'; memp++
-		RAM[memp] = 'A'; memp++
-		RAM[memp] = 0; memp++
-
-		RAM[old_memp] = byte(memp & 0xFF)
-		RAM[old_memp+1] = byte(memp >> 8)
-
-		dirp, err := os.Open(".")
-		if err != nil {
-			goto device_not_present
+		if st & KERN_ST_TIME_OUT_READ != 0 {
+			break
 		}
-		for {
-			fi, err := dirp.Readdir(1)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				// TODO(andlabs)
-			}
-			dp := fi[0]
-			name := dp.Name()
-			namlen := len(name)
-			file_size = (dp.Size() + 253) / 254	// convert file size from num of bytes to num of blocks(254 bytes)
-			if file_size > 0xFFFF {
-				file_size = 0xFFFF
-			}
-			old_memp = memp
-			memp += 2
-			RAM[memp] = byte(file_size & 0xFF); memp++
-			RAM[memp] = byte((file_size >> 8) & 0xFF); memp++
-			if file_size < 1000 {
-				RAM[memp] = ' '; memp++
-				if file_size < 100 {
-					RAM[memp] = ' '; memp++
-					if file_size < 10 {
-						RAM[memp] = ' '; memp++
-					}
-				}
-			}
-			RAM[memp] = '"'; memp++
-			if namlen > 16 {
-				namlen = 16		// TODO hack
-			}
-			for i = 0; i < namlen; i++ {
-				RAM[memp] = name[i]; memp++
-			}
-			RAM[memp] = '"'; memp++
-			for i = namlen; i < 16; i++ {
-				RAM[memp] = ' '
-				memp++
-			}
-			RAM[memp] = ' '; memp++
-			RAM[memp] = 'P'; memp++
-			RAM[memp] = 'R'; memp++
-			RAM[memp] = 'G'; memp++
-			RAM[memp] = ' '; memp++
-			RAM[memp] = ' '; memp++
-			RAM[memp] = 0; memp++
-
-			RAM[old_memp] = byte(memp & 0xFF)
-			RAM[old_memp+1] = byte(memp >> 8)
+		b = append(b, c)
+		if st & KERN_ST_EOF != 0 {
+			break
 		}
-		RAM[memp] = 0
-		RAM[memp+1] = 0
-		dirp.Close()
-		end = memp + 2
-/*
-for (i=0; i<255; i++) {
-	if (!(i&15))
-		printf("\n %04X  ", 0x0800+i);
-	printf("%02X ", RAM[0x0800+i]);
-}
-*/
-		goto load_noerr
-	} // end if RAM[kernal_filename] == '$'
-
-	filename = string(RAM[kernal_filename:kernal_filename + kernal_filename_len])
-
-	// on directory filename chdir on it
-	st, err = os.Stat(filename)
-	if err != nil {
-		goto file_not_found
 	}
-	if st.IsDir() {
-		if os.Chdir(filename) != nil {
-			goto device_not_present
-		}
-
-		RAM[0x0801] = 0
-		RAM[0x0802] = 0
-		end = 0x0803
-		goto load_noerr
+	dev.close(0)
+	if len(b) < 2 {
+		C = true
+		A = KERN_ERR_FILE_NOT_FOUND
+		return
 	}
 
-	// on file load it read it and load in the basic area memory
-	f, err = os.Open(filename)
-	if err != nil {
-		goto file_not_found
-	}
-	c = make([]byte, 2)
-	_, err = f.Read(c)
-	if err != nil {
-		// TODO(andlabs)
-	}
-	start = uint16(c[0]) | (uint16(c[1]) << 8)
-	if kernal_sec != 0 {
+	/*
+	 * Secondary address 0 relocates the file to X/Y (for BASIC, the
+	 * start of the program); any other loads it where it was saved from.
+	 * VERIFY compares instead of storing and sets a status bit at the
+	 * first difference, which BASIC reports as ?VERIFY ERROR.
+	 */
+	start = uint16(b[0]) | (uint16(b[1]) << 8)
+	if kernal_sec == 0 {
 		start = uint16(X) | (uint16(Y) << 8)
 	}
-	b, err = ioutil.ReadAll(f)	// we cannot read directly into RAM as we cannot guarantee RAM[size of f:] is left alone
-	if err != nil {
-		// TODO(andlabs)
-	}
 	end = start
-	for i = 0; ; i++ {			// TODO may overwrite ROM
-		RAM[end] = b[i]
+	for _, c := range b[2:] {		// TODO may overwrite ROM
+		if !verify {
+			RAM[end] = c
+		} else if RAM[end] != c {
+			kernal_status |= KERN_ST_VERIFY
+		}
 		if end == 0xFFFF {
 			break
 		}
 		end++
 	}
-	fmt.Printf("LOADING FROM $%04X to $%04X\n", start, end)
-	f.Close()
-
-load_noerr:
 	X = byte(end & 0xFF)
 	Y = byte(end >> 8)
 	C = false
 	A = KERN_ERR_NONE
-	return
-
-file_not_found:
-	C = true
-	A = KERN_ERR_FILE_NOT_FOUND
-	return
-
-device_not_present:
-	C = true
-	A = KERN_ERR_DEVICE_NOT_PRESENT
-	return
-
-missing_file_name:
-	C = true
-	A = KERN_ERR_MISSING_FILE_NAME
-	return
 }
 
 /* SAVE */
@@ -853,30 +767,50 @@ func SAVE() {
 		A = KERN_ERR_NONE
 		return
 	}
+	if kernal_dev == DEV_KEYBOARD || kernal_dev == DEV_SCREEN {
+		C = true
+		A = KERN_ERR_ILLEGAL_DEVICE_NUMBER
+		return
+	}
+	dev, err := find_device(kernal_dev)
+	if err != KERN_ERR_NONE {
+		C = true
+		A = err
+		return
+	}
 	if kernal_filename_len == 0 {
 		C = true
 		A = KERN_ERR_MISSING_FILE_NAME
 		return
 	}
 	filename := string(RAM[kernal_filename:kernal_filename + kernal_filename_len])
-	f, err := os.Create(filename)	// overwrite - these are not the COMMODORE DOS semantics!
-	if err != nil {
+	err = dev.open(filename, 1)
+	if err != KERN_ERR_NONE {
 		C = true
-		A = KERN_ERR_FILE_NOT_FOUND
+		A = err
 		return
 	}
-	_, err = f.Write([]byte{
-		byte(start & 0xFF),
-		byte(start >> 8),
-	})
-	if err != nil {
-		// TODO(andlabs)
+	dev.write(1, byte(start & 0xFF))
+	dev.write(1, byte(start >> 8))
+	for _, c := range RAM[start:end] {
+		dev.write(1, c)
+		if dev.status(1) & KERN_ST_TIME_OUT_WRITE != 0 {
+			break
+		}
+	}
+	st := dev.status(1)
+	st |= dev.close(1)
+	kernal_status |= st
+	if st & KERN_ST_DEVICE_NOT_PRESENT != 0 {
+		C = true
+		A = KERN_ERR_DEVICE_NOT_PRESENT
+		return
 	}
-	_, err = f.Write(RAM[start:end])
-	if err != nil {
-		// TODO(andlabs)
+	if st & KERN_ST_TIME_OUT_WRITE != 0 {
+		C = true
+		A = KERN_ERR_NOT_OUTPUT_FILE
+		return
 	}
-	f.Close()
 	C = false
 	A = KERN_ERR_NONE
 }
@@ -884,19 +818,14 @@ func SAVE() {
 /* SETTIM */
 // TODO(andlabs) - was static; this makes it exported (worry?)
 func SETTIM() {
-	// no portable way to do it in Go without having code in other files
-	// and I don't think being able to set the system time from within cbmbasic is a good idea anyway...
-	fatalf("UNIMPL: set time of day")
+	// only our clock; the host's is left alone
+	set_jiffies(uint32(Y) << 16 | uint32(X) << 8 | uint32(A))
 }
 
 /* RDTIM */
 // TODO(andlabs) - was static; this makes it exported (worry?)
 func RDTIM() {
-	var jiffies uint32
-
-	now := time.Now()
-	usec := now.Nanosecond() / int(time.Microsecond)
-	jiffies = uint32(((now.Hour()*60 + now.Minute())*60 + now.Second())*60 + usec / (1000000/60))
+	jiffies := read_jiffies()
 
 	Y = byte(jiffies / 65536)
 	X = byte((jiffies % 65536) / 256)
@@ -906,66 +835,43 @@ func RDTIM() {
 /* STOP */
 // TODO(andlabs) - was static; this makes it exported (worry?)
 func STOP() {
-	SETZ(0)		// TODO we don't support the STOP key
+	if stop_pressed() {
+		flush_keyboard()
+		SETZ(1)
+	} else {
+		SETZ(0)
+	}
 }
 
 /* GETIN */
 // TODO(andlabs) - was static; this makes it exported (worry?)
 func GETIN() {
-	var c []byte
-	var err error
-
-	if kernal_input != 0 {
-		if kernal_files_next[kernal_input] == EOF {
-			c = make([]byte, 1)
-			_, err = kernal_files[kernal_input].Read(c)
-			if err == io.EOF {
-				kernal_status |= KERN_ST_EOF
-				kernal_status |= KERN_ST_TIME_OUT_READ
-				A = 199
-				goto out
-			} else if err != nil {
-				// TODO(andlabs)
-			} else {
-				kernal_files_next[kernal_input] = int(c[0])
-			}
+	if f := kernal_files[kernal_input]; kernal_input != 0 && f != nil {
+		A = f.dev.read(f.sec)
+		st := f.dev.status(f.sec)
+		kernal_status |= st
+		if st & KERN_ST_TIME_OUT_READ != 0 {
+			A = 199
 		}
-		A = byte(kernal_files_next[kernal_input] & 0xFF)
-		c = make([]byte, 1)
-		_, err = kernal_files[kernal_input].Read(c)
-		if err == io.EOF {
-			kernal_status |= KERN_ST_EOF
-			kernal_files_next[kernal_input] = EOF
-		} else if err != nil {
-			// TODO(andlabs)
-		} else {
-			kernal_files_next[kernal_input] = int(c[0])
+		if st & KERN_ST_READ_ERROR != 0 {
+			A = 0
+			basic_error = ERROR_FILE_DATA
 		}
-	out:
-		C = false
 	} else {
-		c := make([]byte, 1)
-		_, err := os.Stdin.Read(c)
-		if err != nil {
-			// TODO(andlabs)
-		}
-		A = c[0]
-		if A == '\n' {
-			A = '\r'
-		}
-		C = false
+		A = poll_key()
 	}
+	C = false
 }
 
 /* CLALL */
 // TODO(andlabs) - was static; this makes it exported (worry?)
 func CLALL() {
-	for i := 0; i < len(kernal_files); i++ {
-		if kernal_files[i] != nil {
-			kernal_files[i].Close()
-			kernal_files[i] = nil
-		}
+	for lfn, f := range kernal_files {
+		kernal_status |= f.dev.close(f.sec)		// already logged; CLALL can't fail
+		delete(kernal_files, lfn)
 	}
+	kernal_input = 0
+	kernal_output = 0
 }
 
 /* PLOT */
@@ -977,8 +883,8 @@ func PLOT() {
 		get_cursor(&CX, &CY)
 		Y = byte(CX)
 		X = byte(CY)
-	} else {
-		fatalf("UNIMPL: set cursor %d %d\n", Y, X)
+	} else if !set_cursor(int(Y), int(X)) {
+		C = true		// off the screen; the cursor stays put
 	}
 }
 
@@ -1060,52 +966,50 @@ func kernal_dispatch() int {
 
 	case 0:
 		plugin_off()
-		S += 2
 	case 1:
 		plugin_on()
-		S += 2
 
 	case MAGIC_ERROR:
 		new_pc = plugin_error()
 		if new_pc != 0 {
-			PUSH_WORD(new_pc - 1)
+			kernal_jump = new_pc
 		} else {
-			PUSH_WORD(orig_error - 1)
+			kernal_jump = orig_error
 		}
 	case MAGIC_MAIN:
 		new_pc = plugin_main()
 		if new_pc != 0 {
-			PUSH_WORD(new_pc - 1)
+			kernal_jump = new_pc
 		} else {
-			PUSH_WORD(orig_main - 1)
+			kernal_jump = orig_main
 		}
 	case MAGIC_CRNCH:
 		new_pc = plugin_crnch()
 		if new_pc != 0 {
-			PUSH_WORD(new_pc - 1)
+			kernal_jump = new_pc
 		} else {
-			PUSH_WORD(orig_crnch - 1)
+			kernal_jump = orig_crnch
 		}
 	case MAGIC_QPLOP:
 		new_pc = plugin_qplop()
 		if new_pc != 0 {
-			PUSH_WORD(new_pc - 1)
+			kernal_jump = new_pc
 		} else {
-			PUSH_WORD(orig_qplop - 1)
+			kernal_jump = orig_qplop
 		}
 	case MAGIC_GONE:
 		new_pc = plugin_gone()
 		if new_pc != 0 {
-			PUSH_WORD(new_pc - 1)
+			kernal_jump = new_pc
 		} else {
-			PUSH_WORD(orig_gone-1)
+			kernal_jump = orig_gone
 		}
 	case MAGIC_EVAL:
 		new_pc = plugin_eval()
 		if new_pc != 0 {
-			PUSH_WORD(new_pc - 1)
+			kernal_jump = new_pc
 		} else {
-			PUSH_WORD(orig_eval - 1)
+			kernal_jump = orig_eval
 		}
 		
 	case MAGIC_CONTINUATION:
@@ -4,8 +4,6 @@ import (
 	"os"
 )
 
-/* XXX hook up memory[] with RAM[] in runtime.c */
- 
 /************************************************************
  *
  * Interface to OS Library Code / Monitor
@@ -20,6 +18,9 @@ var (
 )
 
 func init_monitor() {
+	memory_mu.Lock()
+	defer memory_mu.Unlock()
+
 	f, err := os.Open("cbmbasic.bin")
 	if err != nil {
 		fatalf("open cbmbasic.bin failed: %v", err)
@@ -48,100 +49,257 @@ func init_monitor() {
 	 * a JSR to the actual start of cbmbasic
 	 */
 	memory[0xF000] = 0x20
-	memory[0xF001] = 0x94
-	memory[0xF002] = 0xE3
+	memory[0xF001] = byte(ROM_COLD_START & 0xFF)
+	memory[0xF002] = byte(ROM_COLD_START >> 8)
 	
 	memory[0xFFFC] = 0x00
 	memory[0xFFFD] = 0xF0
 }
 
-func monitor() {
-	call_kernal := false
+/*
+ * The 6502 gets to the KERNAL through the jump table, where every entry
+ * jumps to $F800. The plugin vectors point to the MAGIC_ addresses and
+ * SYS 0 and SYS 1 go to 0 and 1, where there's no room for a JMP, so
+ * the monitor hands the 6502 a JMP $F800 when it fetches an instruction
+ * there.
+ */
+func is_trap(pc uint16) bool {
+	switch {
+	case pc >= 0xFF90:
+		return (pc - 0xFF90) % 3 == 0
+	case pc <= 1:
+		return true
+	case pc >= MAGIC_ERROR && pc <= MAGIC_EVAL:
+		return true
+	}
+	return false
+}
+
+var fetch_override = map[uint16]byte{}
+
+var (
+	kernal_jump	uint16		// where to go instead of returning, or 0
+	kernal_sp		int = -1	// the stack pointer to go there with, or -1 to keep it
+)
+
+/* kernal_return_code is the code at $F800 that the trapped call returns through */
+func kernal_return_code() []byte {
+	var code []byte
+
+	if kernal_sp >= 0 {
+		code = append(code, 0xA2, byte(kernal_sp))		// LDX #sp
+		code = append(code, 0x9A)		// TXS
+	}
+	if basic_error != 0 {
+		code = append(code, 0xA2, basic_error)		// LDX #error
+		return append(code, 0x4C, byte(ROM_ERROR & 0xFF), byte(ROM_ERROR >> 8))		// JMP ERROR
+	}
+	code = append(code, 0xA9, P)		// LDA #P
+	code = append(code, 0x48)		// PHA
+	code = append(code, 0xA9, A)		// LDA #A
+	code = append(code, 0xA2, X)		// LDX #X
+	code = append(code, 0xA0, Y)		// LDY #Y
+	code = append(code, 0x28)		// PLP
+	if kernal_jump != 0 {
+		return append(code, 0x4C, byte(kernal_jump), byte(kernal_jump >> 8))		// JMP new_pc
+	}
+	return append(code, 0x60)		// RTS
+}
 
+/* the memory access the 6502 is waiting on */
+var (
+	access_addr	uint16
+	access_rw		bool
+)
+
+func monitor() {
 	for {
-		// wait for a REF "B"
-		for <-clk1_chan != low {
-			// do nothing
+		if next_access() {
+			PC = access_addr
+			instruction_fetch()
 		}
+		finish_access()
+	}
+}
+
+/* next_access waits for the 6502's next memory access, and returns whether it fetches an instruction */
+func next_access() bool {
+	// wait for a REF "B"
+	for <-clk1_chan != low {
+		// do nothing
+	}
+
+	// REF "B"; handle memory accesses
+	access_addr = <-ab_chan
+	access_rw = <-rw_chan
+	return access_rw == high && <-sync_chan == high
+}
 
-		// REF "B"; handle memory accesses
-		addr := <-ab_chan
-		rw := <-rw_chan
-		if rw == high {		// read
-			if <-sync_chan == high {		// instruction fetch
-				PC = addr
+/* instruction_fetch fires the hooks and runs the trap at PC, if any, before the 6502 gets its instruction */
+func instruction_fetch() {
+	if is_trap(PC) && PC < 0xFF90 {
+		// no JMP $F800 there; hand the 6502 one
+		fetch_override[PC] = 0x4C
+		fetch_override[PC + 1] = 0x00
+		fetch_override[PC + 2] = 0xF8
+	}
+
+	// wait for a REF "A"
+//	for <-clk1_chan != high {
+//		// do nothing
+//	}
+
+	// REF "A"; call the kernal and commit reads/writes
+	// TODO which order?
+	memory_mu.Lock()		// the hooks and traps write memory through RAM
+	defer memory_mu.Unlock()
+	if is_breakpoint(PC) {
+		get_regs()
+		hit_breakpoint()
+	}
+	if hook, ok := rom_hooks[PC]; ok {
+		get_regs()
+		fire_hook(hook)
+	}
+	if is_trap(PC) {
+		get_regs()
+		run_trap()
+	}
+}
 
-				if PC >= 0xFF90 && ((PC - 0xFF90) % 3 == 0) {
-					call_kernal = true
-				}
+func run_trap() {
+	depth := call_depth
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(rom_error); !ok || depth != 0 {
+				panic(r)
 			}
+			// the 6502 goes on to the error handler; whatever Go was doing is dropped, like the stack
+			call_depth = 0
+			basic_error = 0
+			kernal_jump = 0
+			kernal_sp = -1
 		}
+	}()
 
-		// wait for a REF "A"
-//		for <-clk1_chan != high {
-//			// do nothing
-//		}
-
-		// REF "A"; call the kernal and commit reads/writes
-		// TODO which order?
-		if call_kernal {
-			// get register status out of 6502
-			regs := <-regs_chan
-			A = regs.A
-			X = regs.X
-			Y = regs.Y
-			S = regs.S
-			P = regs.P
-			N = (P >> 7) == 1
-			Z = ((P >> 1) & 1) == 1
-			C = (P & 1) == 1
-
-			kernal_dispatch()
-
-			// encode processor status
-			P &= 0x7C				// clear N, Z, C
-			if N {
-				P |= 1 << 7
-			}
-			if Z {
-				P |= 1 << 1
-			}
-			if C {
-				P |= 1
-			}
+	kernal_dispatch()
+
+	/*
+	 * all KERNAL calls make the 6502 jump to $F800, so we
+	 * put code there that loads the return state of the
+	 * KERNAL function and returns to the caller, or that
+	 * raises the BASIC error the call ran into
+	 */
+	encode_p()
+	copy(memory[0xF800:], kernal_return_code())
+	basic_error = 0
+	kernal_jump = 0
+	kernal_sp = -1
+	/*
+	 * XXX we could do RTI instead of PLP/RTS, but RTI seems to be
+	 * XXX broken in the chip dump - after the KERNAL call at 0xFF90,
+	 * XXX the 6502 gets heavily confused about its program counter
+	 * XXX and executes garbage instructions
+	 */
+}
 
-			/*
-			 * all KERNAL calls make the 6502 jump to $F800, so we
-			 * put code there that loads the return state of the
-			 * KERNAL function and returns to the caller
-			 */
-			memory[0xF800] = 0xA9		// LDA #P
-			memory[0xF801] = P
-			memory[0xF802] = 0x48		// PHA
-			memory[0xF803] = 0xA9		// LHA #A
-			memory[0xF804] = A
-			memory[0xF805] = 0xA2		// LDX #X
-			memory[0xF806] = X
-			memory[0xF807] = 0xA0		// LDY #Y
-			memory[0xF808] = Y
-			memory[0xF809] = 0x28		// PLP
-			memory[0xF80A] = 0x60		// RTS
-			/*
-			 * XXX we could do RTI instead of PLP/RTS, but RTI seems to be
-			 * XXX broken in the chip dump - after the KERNAL call at 0xFF90,
-			 * XXX the 6502 gets heavily confused about its program counter
-			 * XXX and executes garbage instructions
-			 */
-
-			call_kernal = false
+/* finish_access hands the 6502 the byte it reads, or takes the one it writes */
+func finish_access() {
+	if access_rw == high {		// read
+		// send data
+		rdy_chan <- high
+		if b, ok := fetch_override[access_addr]; ok {
+			delete(fetch_override, access_addr)
+			db_chan <- b
+		} else {
+			db_chan <- memory[access_addr]
 		}
+	} else {			// write
+		d := <-db_chan
+		memory_mu.Lock()
+		memory[access_addr] = d
+		memory_mu.Unlock()
+	}
+}
 
-		if rw == high {		// read
-			// send data
-			rdy_chan <- high
-			db_chan <- memory[addr]
-		} else {			// write
-			memory[addr] = <-db_chan
+/*
+ * Calling the ROM
+ *
+ * call runs the ROM routine at pc with the registers as they are, from
+ * inside a trap, and comes back with the registers it returned with. The
+ * 6502 is given code at $F800 that pushes MAGIC_CONTINUATION - 1 and
+ * jumps to pc, and the monitor runs in here until the routine returns to
+ * MAGIC_CONTINUATION; the 6502 waits there for the next call or the end
+ * of the trap. If the routine raises a BASIC error instead, there is
+ * nothing to come back to: the trap is dropped (see run_trap).
+ */
+type rom_error struct{}
+
+var call_depth int		// how many calls are running
+
+func call(pc uint16) {
+	jump, sp, err := kernal_jump, kernal_sp, basic_error
+	kernal_jump, kernal_sp, basic_error = pc, -1, 0
+	encode_p()
+	ret := uint16(MAGIC_CONTINUATION - 1)
+	code := []byte{
+		0xA9, byte(ret >> 8),		// LDA #>ret
+		0x48,				// PHA
+		0xA9, byte(ret),		// LDA #<ret
+		0x48,				// PHA
+	}
+	copy(memory[0xF800:], append(code, kernal_return_code()...))
+	kernal_jump, kernal_sp, basic_error = jump, sp, err
+
+	// the trap has memory_mu; the monitor needs it back to take the routine's writes
+	memory_mu.Unlock()
+	defer memory_mu.Lock()
+	call_depth++
+	finish_access()		// the trap's JMP $F800
+	for {
+		if next_access() {
+			PC = access_addr
+			switch PC {
+			case MAGIC_CONTINUATION:
+				get_regs()
+				call_depth--
+				// the 6502 waits here; the end of the trap or the next call goes on
+				fetch_override[PC] = 0x4C
+				fetch_override[PC + 1] = 0x00
+				fetch_override[PC + 2] = 0xF8
+				return
+			case ROM_ERROR:
+				panic(rom_error{})
+			}
+			instruction_fetch()
 		}
+		finish_access()
 	}
 }
+
+/* encode_p puts N, Z and C back into P */
+func encode_p() {
+	P &= 0x7C				// clear N, Z, C
+	if N {
+		P |= 1 << 7
+	}
+	if Z {
+		P |= 1 << 1
+	}
+	if C {
+		P |= 1
+	}
+}
+
+// get_regs gets the register status out of the 6502, for the KERNAL and the ROM hooks
+func get_regs() {
+	regs := <-regs_chan
+	A = regs.A
+	X = regs.X
+	Y = regs.Y
+	S = regs.S
+	P = regs.P
+	N = (P >> 7) == 1
+	Z = ((P >> 1) & 1) == 1
+	C = (P & 1) == 1
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var err_host = errors.New("host on fire")
+
+// failing_writer takes n bytes, then fails.
+type failing_writer struct {
+	n	int
+}
+
+func (w *failing_writer) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, err_host
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// test_device hands out channels on a reader or a writer, like a drive would on a file.
+type test_device struct {
+	r		io.Reader
+	w		io.Writer
+	channels	map[byte]*disk_channel
+}
+
+func (d *test_device) open(name string, sec byte) byte {
+	if d.w != nil {
+		d.channels[sec] = new_write_channel(d.w, nil)
+	} else {
+		d.channels[sec] = new_read_channel(d.r, nil)
+	}
+	return KERN_ERR_NONE
+}
+
+func (d *test_device) close(sec byte) byte {
+	return close_channel(d.channels, sec)
+}
+
+func (d *test_device) read(sec byte) byte {
+	return d.channels[sec].read()
+}
+
+func (d *test_device) write(sec byte, c byte) {
+	d.channels[sec].write(c)
+}
+
+func (d *test_device) status(sec byte) byte {
+	return d.channels[sec].st
+}
+
+// set up the KERNAL as if BASIC had called SETLFS and SETNAM
+func kernal_file_setup(dev device, lfn byte, sec byte) {
+	register_device(DEV_DISK, dev)
+	kernal_files = map[byte]*kernal_file{}
+	kernal_input, kernal_output = 0, 0
+	kernal_status = 0
+	basic_error = 0
+	copy(RAM[0x0200:], "FILE")
+	kernal_filename, kernal_filename_len = 0x0200, 4
+	kernal_lfn, kernal_dev, kernal_sec = lfn, DEV_DISK, sec
+}
+
+func TestHostErrors(t *testing.T) {
+	program := []byte{ 0x01, 0x08, 0xAA, 0xBB, 0xCC, 0xDD }
+
+	tests := []struct {
+		name		string
+		r		io.Reader
+		w		io.Writer
+		run		func(t *testing.T)
+		want_error	byte		// the BASIC error raised
+		want_c	bool
+		want_a	byte
+		want_st	byte
+	}{
+		{
+			name:		"LOAD read error",
+			r:		io.MultiReader(bytes.NewReader(program[:4]), iotest.ErrReader(err_host)),
+			run:		func(t *testing.T) { A = 0; LOAD() },
+			want_error:	ERROR_LOAD,
+			want_st:	KERN_ST_READ_ERROR,
+		},
+		{
+			name:		"LOAD read error before the load address",
+			r:		iotest.ErrReader(err_host),
+			run:		func(t *testing.T) { A = 0; LOAD() },
+			want_error:	ERROR_LOAD,
+			want_st:	KERN_ST_READ_ERROR,
+		},
+		{
+			name:		"VERIFY read error",
+			r:		io.MultiReader(bytes.NewReader(program[:3]), iotest.ErrReader(err_host)),
+			run:		func(t *testing.T) { A = 1; LOAD() },
+			want_error:	ERROR_LOAD,
+			want_st:	KERN_ST_READ_ERROR,
+		},
+		{
+			name:		"INPUT# read error",
+			r:		io.MultiReader(strings.NewReader("AB"), iotest.ErrReader(err_host)),
+			run:		func(t *testing.T) {
+				OPEN()
+				X = kernal_lfn
+				CHKIN()
+				CHRIN()
+				if A != 'A' || basic_error != 0 {
+					t.Errorf("INPUT# read error: first byte not read")
+				}
+				CHRIN()
+			},
+			want_a:	13,
+			want_error:	ERROR_FILE_DATA,
+			want_st:	KERN_ST_READ_ERROR,
+		},
+		{
+			name:		"GET# read error",
+			r:		iotest.ErrReader(err_host),
+			run:		func(t *testing.T) {
+				OPEN()
+				X = kernal_lfn
+				CHKIN()
+				GETIN()
+			},
+			want_error:	ERROR_FILE_DATA,
+			want_st:	KERN_ST_READ_ERROR,
+		},
+		{
+			name:		"SAVE write error",
+			w:		&failing_writer{ n: 3 },
+			run:		func(t *testing.T) {
+				RAM[0xFB], RAM[0xFC] = 0x01, 0x08
+				A = 0xFB
+				X, Y = 0x10, 0x08
+				SAVE()
+			},
+			want_c:	true,
+			want_a:	KERN_ERR_DEVICE_NOT_PRESENT,
+			want_st:	KERN_ST_DEVICE_NOT_PRESENT,
+		},
+		{
+			name:		"PRINT# write error",
+			w:		&failing_writer{},
+			run:		func(t *testing.T) {
+				OPEN()
+				X = kernal_lfn
+				CHKOUT()
+				A = 'X'
+				CHROUT()
+				CLRCHN()
+				CLOSE()
+			},
+			want_a:	'X',
+			want_error:	ERROR_DEVICE_NOT_PRESENT,
+			want_st:	KERN_ST_DEVICE_NOT_PRESENT,
+		},
+	}
+
+	defer func(w io.Writer) {
+		diagnostics = w
+	}(diagnostics)
+	for _, tt := range tests {
+		var log bytes.Buffer
+
+		diagnostics = &log
+		kernal_file_setup(&test_device{ r: tt.r, w: tt.w, channels: map[byte]*disk_channel{} }, 2, 0)
+		copy(RAM[0x0801:], []byte{ 1, 2, 3, 4 })
+		C = false
+		tt.run(t)
+		if basic_error != tt.want_error {
+			t.Errorf("%s: BASIC error %#x, want %#x", tt.name, basic_error, tt.want_error)
+		}
+		if basic_error == 0 && (C != tt.want_c || A != tt.want_a) {
+			t.Errorf("%s: C=%v A=%d, want C=%v A=%d", tt.name, C, A, tt.want_c, tt.want_a)
+		}
+		if kernal_status & tt.want_st != tt.want_st {
+			t.Errorf("%s: status %#x, want bits %#x", tt.name, kernal_status, tt.want_st)
+		}
+		if !strings.Contains(log.String(), err_host.Error()) {
+			t.Errorf("%s: host error not logged (got %q)", tt.name, log.String())
+		}
+		if !bytes.Equal(RAM[0x0801:0x0805], []byte{ 1, 2, 3, 4 }) {
+			t.Errorf("%s: memory changed to % X", tt.name, RAM[0x0801:0x0805])
+		}
+	}
+	basic_error = 0
+}
+
+func TestLoadVerify(t *testing.T) {
+	file := []byte{ 0x00, 0xC0, 0x11, 0x22, 0x33 }		// saved from $C000
+
+	tests := []struct {
+		name		string
+		sec		byte
+		verify	bool
+		ram		[]byte		// at $0801 and $C000 before
+		want_addr	uint16		// where the bytes go or are compared
+		want_ram	[]byte		// at want_addr after
+		want_st	byte
+	}{
+		{ "LOAD SA 0 relocates to X/Y", 0, false, []byte{ 0, 0, 0 }, 0x0801, []byte{ 0x11, 0x22, 0x33 }, 0 },
+		{ "LOAD SA 1 loads where it was saved", 1, false, []byte{ 0, 0, 0 }, 0xC000, []byte{ 0x11, 0x22, 0x33 }, 0 },
+		{ "VERIFY match", 0, true, []byte{ 0x11, 0x22, 0x33 }, 0x0801, []byte{ 0x11, 0x22, 0x33 }, 0 },
+		{ "VERIFY mismatch", 0, true, []byte{ 0x11, 0x99, 0x33 }, 0x0801, []byte{ 0x11, 0x99, 0x33 }, KERN_ST_VERIFY },
+		{ "VERIFY SA 1 mismatch", 1, true, []byte{ 0x11, 0x22, 0x00 }, 0xC000, []byte{ 0x11, 0x22, 0x00 }, KERN_ST_VERIFY },
+	}
+
+	for _, tt := range tests {
+		kernal_file_setup(&test_device{ r: bytes.NewReader(file), channels: map[byte]*disk_channel{} }, 1, tt.sec)
+		copy(RAM[0x0801:], tt.ram)
+		copy(RAM[0xC000:], tt.ram)
+		other := uint16(0xC000)
+		if tt.want_addr == 0xC000 {
+			other = 0x0801
+		}
+		A = 0
+		if tt.verify {
+			A = 1
+		}
+		X, Y = 0x01, 0x08
+		LOAD()
+		if C || basic_error != 0 {
+			t.Errorf("%s: C=%v A=%d, BASIC error %#x", tt.name, C, A, basic_error)
+			continue
+		}
+		if end := uint16(X) | (uint16(Y) << 8); end != tt.want_addr + 3 {
+			t.Errorf("%s: end $%04X, want $%04X", tt.name, end, tt.want_addr + 3)
+		}
+		if got := RAM[tt.want_addr:tt.want_addr + 3]; !bytes.Equal(got, tt.want_ram) {
+			t.Errorf("%s: memory at $%04X is % X, want % X", tt.name, tt.want_addr, got, tt.want_ram)
+		}
+		if got := RAM[other:other + 3]; !bytes.Equal(got, tt.ram) {
+			t.Errorf("%s: memory at $%04X changed to % X", tt.name, other, got)
+		}
+		if kernal_status != tt.want_st {
+			t.Errorf("%s: status %#x, want %#x", tt.name, kernal_status, tt.want_st)
+		}
+	}
+}
+
+func TestVerifyStatus(t *testing.T) {
+	defer func(w io.Writer) {
+		diagnostics = w
+	}(diagnostics)
+	diagnostics = io.Discard
+
+	if KERN_ST_READ_ERROR == KERN_ST_VERIFY {
+		t.Fatalf("a read error and a VERIFY mismatch have the same status bit")
+	}
+	for _, tt := range []struct {
+		name		string
+		r		io.Reader
+		want_st	byte
+		not_st	byte
+		want_error	byte
+	}{
+		{ "mismatch", bytes.NewReader([]byte{ 0x01, 0x08, 0xEE }), KERN_ST_VERIFY, KERN_ST_READ_ERROR, 0 },
+		{ "read error", io.MultiReader(bytes.NewReader([]byte{ 0x01, 0x08 }), iotest.ErrReader(err_host)), KERN_ST_READ_ERROR, KERN_ST_VERIFY, ERROR_LOAD },
+	} {
+		kernal_file_setup(&test_device{ r: tt.r, channels: map[byte]*disk_channel{} }, 1, 1)
+		RAM[0x0801] = 0x00
+		A = 1
+		LOAD()
+		if kernal_status & tt.want_st == 0 || kernal_status & tt.not_st != 0 {
+			t.Errorf("%s: status %#x, want bit %#x and not %#x", tt.name, kernal_status, tt.want_st, tt.not_st)
+		}
+		if basic_error != tt.want_error {
+			t.Errorf("%s: BASIC error %#x, want %#x", tt.name, basic_error, tt.want_error)
+		}
+	}
+	basic_error = 0
+}
+
+func TestHostOpenError(t *testing.T) {
+	var log bytes.Buffer
+
+	defer func(w io.Writer) {
+		diagnostics = w
+	}(diagnostics)
+	diagnostics = &log
+
+	// a drive on something that isn't a directory can't open anything in it
+	notdir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notdir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	kernal_file_setup(new_host_drive(new_dir_sandbox(notdir)), 2, 0)
+	OPEN()
+	if !C || A != KERN_ERR_DEVICE_NOT_PRESENT {
+		t.Errorf("C=%v A=%d, want C=true A=%d", C, A, KERN_ERR_DEVICE_NOT_PRESENT)
+	}
+	if log.Len() == 0 {
+		t.Errorf("host error not logged")
+	}
+}
+
+func TestKernalReturnCode(t *testing.T) {
+	defer func() {
+		kernal_jump, kernal_sp, basic_error = 0, -1, 0
+	}()
+	P, A, X, Y = 0x01, 0x0A, 0x0B, 0x0C
+
+	tests := []struct {
+		name		string
+		jump		uint16
+		sp		int
+		err		byte
+		want		[]byte
+	}{
+		{ "return", 0, -1, 0, []byte{ 0xA9, 0x01, 0x48, 0xA9, 0x0A, 0xA2, 0x0B, 0xA0, 0x0C, 0x28, 0x60 } },
+		{ "jump", NEWSTT, 0xF0, 0, []byte{ 0xA2, 0xF0, 0x9A, 0xA9, 0x01, 0x48, 0xA9, 0x0A, 0xA2, 0x0B, 0xA0, 0x0C, 0x28, 0x4C, 0xAE, 0xA7 } },
+		{ "error", 0, -1, ERROR_FILE_DATA, []byte{ 0xA2, ERROR_FILE_DATA, 0x4C, 0x37, 0xA4 } },
+	}
+	for _, tt := range tests {
+		kernal_jump, kernal_sp, basic_error = tt.jump, tt.sp, tt.err
+		if got := kernal_return_code(); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % X, want % X", tt.name, got, tt.want)
+		}
+	}
+}
+
+type bus_access struct {
+	addr		uint16
+	rw		bool
+	sync		bool
+	data		byte		// written
+}
+
+/*
+ * fake_bus is the 6502's side of the monitor's channels, going through
+ * accesses and answering get_regs with regs; it sends the bytes the
+ * monitor gave it on done when the last access is finished. It gets
+ * channels of its own for the test, so a bus left behind by an earlier
+ * one can't answer for it; the test fails if it doesn't get through its
+ * accesses.
+ */
+func fake_bus(t *testing.T, accesses []bus_access, regs regs_monitor) chan []byte {
+	saved_clk1, saved_ab, saved_rw, saved_sync, saved_db, saved_rdy, saved_regs := clk1_chan, ab_chan, rw_chan, sync_chan, db_chan, rdy_chan, regs_chan
+	clk1, ab, rw, sync, db, rdy, regs_c := make(chan bool), make(chan uint16), make(chan bool), make(chan bool), make(chan byte), make(chan bool), make(chan regs_monitor)
+	clk1_chan, ab_chan, rw_chan, sync_chan, db_chan, rdy_chan, regs_chan = clk1, ab, rw, sync, db, rdy, regs_c
+
+	done := make(chan []byte, 1)
+	finished_all := make(chan struct{})
+	go func() {
+		var got []byte
+
+		for _, a := range accesses {
+			var read, write chan byte
+
+			if a.rw == high {
+				read = db
+			} else {
+				write = db
+			}
+			for finished := false; !finished; {
+				select {
+				case clk1 <- low:
+				case ab <- a.addr:
+				case rw <- a.rw:
+				case sync <- a.sync:
+				case regs_c <- regs:
+				case <-rdy:
+				case d := <-read:
+					got = append(got, d)
+					finished = true
+				case write <- a.data:
+					finished = true
+				}
+			}
+		}
+		done <- got
+		close(finished_all)
+	}()
+
+	t.Cleanup(func() {
+		select {
+		case <-finished_all:
+		case <-time.After(time.Second):
+			t.Errorf("the 6502 didn't get through its accesses")
+		}
+		clk1_chan, ab_chan, rw_chan, sync_chan, db_chan, rdy_chan, regs_chan = saved_clk1, saved_ab, saved_rw, saved_sync, saved_db, saved_rdy, saved_regs
+	})
+	return done
+}
+
+// in_trap runs f the way instruction_fetch runs a trap, with memory_mu held
+func in_trap(f func()) {
+	memory_mu.Lock()
+	defer memory_mu.Unlock()
+	f()
+}
+
+func TestCall(t *testing.T) {
+	defer func() {
+		fetch_override = map[uint16]byte{}
+		call_depth = 0
+	}()
+	memory[0xFFD2] = 0x4C		// JMP $F800 in the jump table
+
+	// a KERNAL trap calls GETBYT, which writes to the stack and returns
+	done := fake_bus(t, []bus_access{
+		{ 0xFFD2, high, true, 0 },
+		{ 0xF800, high, true, 0 },
+		{ 0xF801, high, false, 0 },
+		{ 0x01F0, low, false, 0x99 },
+		{ 0xFFFF, high, true, 0 },
+	}, regs_monitor{ A: 1, X: 42, Y: 3, S: 0xF0 })
+	access_addr, access_rw = 0xFFD2, high
+	PC = 0xFFD2
+	in_trap(func() {
+		call(ROM_GETBYT)
+	})
+	if X != 42 || call_depth != 0 {
+		t.Errorf("X=%d depth %d after the call, want 42 0", X, call_depth)
+	}
+	if memory[0x01F0] != 0x99 {
+		t.Errorf("write not done")
+	}
+	code := memory[0xF800:0xF800 + 19]
+	if !bytes.Equal(code[:6], []byte{ 0xA9, 0xFF, 0x48, 0xA9, 0xFE, 0x48 }) || !bytes.Equal(code[16:], []byte{ 0x4C, 0x9E, 0xB7 }) {
+		t.Errorf("code at $F800 % X", code)
+	}
+	finish_access()		// the end of the trap
+	if got := <-done; !bytes.Equal(got, []byte{ 0x4C, 0xA9, 0xFF, 0x4C }) {
+		t.Errorf("6502 read % X", got)
+	}
+
+	// the routine raises an error instead
+	done = fake_bus(t, []bus_access{
+		{ 0xFFFF, high, true, 0 },
+		{ ROM_ERROR, high, true, 0 },
+	}, regs_monitor{})
+	in_trap(func() {
+		defer func() {
+			if _, ok := recover().(rom_error); !ok {
+				t.Errorf("no rom_error")
+			}
+		}()
+		call(ROM_CHKCOM)
+	})
+	if access_addr != ROM_ERROR {
+		t.Errorf("6502 left at $%04X, want it at $A437", access_addr)
+	}
+	finish_access()
+	<-done
+}
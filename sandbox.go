@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/************************************************************
+ *
+ * Sandbox
+ *
+ ************************************************************/
+
+/*
+ * A host drive keeps its files in a sandbox: the host directory it was
+ * given (-disk8 dir), or any fs.FS, such as an in-memory one (-disk8
+ * mem:) that starts out empty and is gone when cbmbasic quits. Every
+ * name BASIC uses is looked up relative to the sandbox's root, and
+ * names that would get out of it, like ../x or /etc/passwd, are
+ * rejected, so a BASIC program can only get at the files it was given.
+ *
+ * An fs.FS that can't be written to is read-only, and -read-only makes
+ * every drive read-only, for running programs that shouldn't change
+ * anything; DOS reports writes as WRITE PROTECT ON.
+ */
+var read_only_flag = flag.Bool("read-only", false, "make all disk drives read-only")
+
+const MEMORY_DRIVE = "mem:"
+
+var (
+	err_outside_sandbox = errors.New("outside the sandbox")
+	err_read_only = errors.New("read-only")
+)
+
+// writable_fs is an fs.FS files can be created in, removed from and renamed in.
+type writable_fs interface {
+	fs.FS
+	create(name string, append bool) (io.WriteCloser, error)
+	remove(name string) error
+	rename(from string, to string) error
+}
+
+type sandbox struct {
+	fsys		fs.FS
+	name		string		// of the root, for directory listings
+	readonly	bool
+}
+
+func new_sandbox(fsys fs.FS, name string) *sandbox {
+	_, writable := fsys.(writable_fs)
+	return &sandbox{
+		fsys:		fsys,
+		name:		name,
+		readonly:	*read_only_flag || !writable,
+	}
+}
+
+func new_dir_sandbox(dir string) *sandbox {
+	name := dir
+	if abs, err := filepath.Abs(dir); err == nil {
+		name = abs
+	}
+	return new_sandbox(open_dir_fs(dir), filepath.Base(name))
+}
+
+func new_memory_sandbox() *sandbox {
+	return new_sandbox(&memory_fs{ files: map_fs{} }, "MEMORY")
+}
+
+// resolve returns the path of name in directory dir of the sandbox, or an error if it's outside.
+func (sb *sandbox) resolve(dir string, name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", &fs.PathError{ Op: "open", Path: name, Err: err_outside_sandbox }
+	}
+	p := path.Join(dir, name)
+	if !fs.ValidPath(p) {
+		return "", &fs.PathError{ Op: "open", Path: name, Err: err_outside_sandbox }
+	}
+	return p, nil
+}
+
+func (sb *sandbox) writer() (writable_fs, error) {
+	w, ok := sb.fsys.(writable_fs)
+	if sb.readonly || !ok {
+		return nil, err_read_only
+	}
+	return w, nil
+}
+
+func (sb *sandbox) create(name string, append bool) (io.WriteCloser, error) {
+	w, err := sb.writer()
+	if err != nil {
+		return nil, &fs.PathError{ Op: "create", Path: name, Err: err }
+	}
+	return w.create(name, append)
+}
+
+func (sb *sandbox) remove(name string) error {
+	w, err := sb.writer()
+	if err != nil {
+		return &fs.PathError{ Op: "remove", Path: name, Err: err }
+	}
+	return w.remove(name)
+}
+
+func (sb *sandbox) rename(from string, to string) error {
+	w, err := sb.writer()
+	if err != nil {
+		return &fs.PathError{ Op: "rename", Path: from, Err: err }
+	}
+	return w.rename(from, to)
+}
+
+/************************************************************
+ * Host Directories
+ ************************************************************/
+
+/*
+ * Everything goes through an os.Root, so a symlink in the directory
+ * can't lead out of it either. If the directory can't be opened,
+ * everything fails with the reason.
+ */
+type dir_fs struct {
+	root		*os.Root
+	fsys		fs.FS
+	err		error
+}
+
+func open_dir_fs(dir string) *dir_fs {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return &dir_fs{ err: err }
+	}
+	return &dir_fs{ root: root, fsys: root.FS() }
+}
+
+func (d *dir_fs) Open(name string) (fs.File, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.fsys.Open(name)
+}
+
+func (d *dir_fs) create(name string, append bool) (io.WriteCloser, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC		// overwrite - these are not the COMMODORE DOS semantics!
+	if append {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	return d.root.OpenFile(filepath.FromSlash(name), flags, 0644)
+}
+
+func (d *dir_fs) remove(name string) error {
+	if d.err != nil {
+		return d.err
+	}
+	return d.root.Remove(filepath.FromSlash(name))
+}
+
+func (d *dir_fs) rename(from string, to string) error {
+	if d.err != nil {
+		return d.err
+	}
+	return d.root.Rename(filepath.FromSlash(from), filepath.FromSlash(to))
+}
+
+/************************************************************
+ * Memory
+ ************************************************************/
+
+/*
+ * map_fs is a flat fs.FS of the files in a map, for tapes and the
+ * memory drive; memory_fs adds writing to it.
+ */
+type map_fs map[string]*map_file
+
+type map_file struct {
+	data		[]byte
+	mode		fs.FileMode
+	mod_time	time.Time
+}
+
+func (m map_fs) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{ Op: "open", Path: name, Err: fs.ErrInvalid }
+	}
+	if name == "." {
+		return &map_dir{ entries: m.entries() }, nil
+	}
+	f, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{ Op: "open", Path: name, Err: fs.ErrNotExist }
+	}
+	return &map_reader{ Reader: bytes.NewReader(f.data), info: f.info(name) }, nil
+}
+
+// entries lists the files, sorted by name
+func (m map_fs) entries() []fs.DirEntry {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = fs.FileInfoToDirEntry(m[name].info(name))
+	}
+	return entries
+}
+
+func (f *map_file) info(name string) map_info {
+	return map_info{ name: name, size: int64(len(f.data)), mode: f.mode, mod_time: f.mod_time }
+}
+
+type map_info struct {
+	name		string
+	size		int64
+	mode		fs.FileMode
+	mod_time	time.Time
+}
+
+func (i map_info) Name() string {
+	return i.name
+}
+
+func (i map_info) Size() int64 {
+	return i.size
+}
+
+func (i map_info) Mode() fs.FileMode {
+	return i.mode
+}
+
+func (i map_info) ModTime() time.Time {
+	return i.mod_time
+}
+
+func (i map_info) IsDir() bool {
+	return i.mode.IsDir()
+}
+
+func (i map_info) Sys() interface{} {
+	return nil
+}
+
+type map_reader struct {
+	*bytes.Reader
+	info		map_info
+}
+
+func (r *map_reader) Stat() (fs.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *map_reader) Close() error {
+	return nil
+}
+
+// the root, the only directory there is
+type map_dir struct {
+	entries	[]fs.DirEntry
+}
+
+func (d *map_dir) Stat() (fs.FileInfo, error) {
+	return map_info{ name: ".", mode: fs.ModeDir | 0755 }, nil
+}
+
+func (d *map_dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{ Op: "read", Path: ".", Err: errors.New("is a directory") }
+}
+
+func (d *map_dir) Close() error {
+	return nil
+}
+
+func (d *map_dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type memory_fs struct {
+	files	map_fs
+}
+
+func (m *memory_fs) Open(name string) (fs.File, error) {
+	return m.files.Open(name)
+}
+
+// what is written shows up when it's closed
+type memory_file struct {
+	m		*memory_fs
+	name		string
+	buf		bytes.Buffer
+}
+
+func (f *memory_file) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *memory_file) Close() error {
+	f.m.files[f.name] = &map_file{
+		data:		f.buf.Bytes(),
+		mode:		0644,
+		mod_time:	time.Now(),
+	}
+	return nil
+}
+
+func (m *memory_fs) create(name string, append bool) (io.WriteCloser, error) {
+	if strings.Contains(name, "/") {		// there are no directories to put it in
+		return nil, &fs.PathError{ Op: "open", Path: name, Err: fs.ErrNotExist }
+	}
+	f := &memory_file{ m: m, name: name }
+	if append {
+		old, ok := m.files[name]
+		if !ok {
+			return nil, &fs.PathError{ Op: "open", Path: name, Err: fs.ErrNotExist }
+		}
+		f.buf.Write(old.data)
+	}
+	return f, nil
+}
+
+func (m *memory_fs) remove(name string) error {
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{ Op: "remove", Path: name, Err: fs.ErrNotExist }
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memory_fs) rename(from string, to string) error {
+	f, ok := m.files[from]
+	if !ok {
+		return &fs.PathError{ Op: "rename", Path: from, Err: fs.ErrNotExist }
+	}
+	if strings.Contains(to, "/") {
+		return &fs.PathError{ Op: "rename", Path: to, Err: fs.ErrNotExist }
+	}
+	delete(m.files, from)
+	m.files[to] = f
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSandboxSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "inside"), []byte("y"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"file":	filepath.Join(outside, "secret"),
+		"dir":	outside,
+		"up":	"../" + filepath.Base(outside),
+		"ok":	"inside",		// symlinks within the sandbox still work
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Skipf("no symlinks here: %v", err)
+		}
+	}
+	sb := new_dir_sandbox(dir)
+	sb.readonly = false
+
+	if _, err := fs.ReadFile(sb.fsys, "ok"); err != nil {
+		t.Errorf("symlink inside the sandbox: %v", err)
+	}
+	for _, name := range []string{ "dir/secret", "up/secret", "file" } {
+		if _, err := fs.ReadFile(sb.fsys, name); err == nil {
+			t.Errorf("read %s through a symlink", name)
+		}
+		if w, err := sb.create(name, true); err == nil {
+			w.Close()
+			t.Errorf("appended to %s through a symlink", name)
+		}
+		if err := sb.remove(name); err == nil && name != "file" {
+			t.Errorf("removed %s through a symlink", name)
+		}
+		if err := sb.rename("inside", name); err == nil && name != "file" {
+			t.Errorf("renamed a file to %s through a symlink", name)
+		}
+	}
+	if w, err := sb.create("dir/new", false); err == nil {
+		w.Close()
+		t.Errorf("created a file through a symlink")
+	}
+	if b, err := os.ReadFile(filepath.Join(outside, "secret")); err != nil || string(b) != "x" {
+		t.Errorf("the file outside was changed: %q, %v", b, err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("files were added outside: %v", entries)
+	}
+}
+
+func TestMemorySandbox(t *testing.T) {
+	sb := new_memory_sandbox()
+	for _, name := range []string{ "B", "A" } {
+		w, err := sb.create(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "DATA " + name)
+		w.Close()
+	}
+	if err := fstest.TestFS(sb.fsys, "A", "B"); err != nil {
+		t.Error(err)
+	}
+	if _, err := sb.create("SUB/C", false); err == nil {
+		t.Errorf("created a file in a directory")
+	}
+	if err := sb.rename("A", "C"); err != nil {
+		t.Error(err)
+	}
+	entries, err := fs.ReadDir(sb.fsys, ".")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "B" || entries[1].Name() != "C" {
+		t.Errorf("got %v, %v", entries, err)
+	}
+}
+
+func TestReadOnlyWrites(t *testing.T) {
+	defer func(w io.Writer) {
+		diagnostics = w
+	}(diagnostics)
+	diagnostics = io.Discard
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "OLD"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sb := new_dir_sandbox(dir)
+	sb.readonly = true
+	d := new_host_drive(sb)
+	for _, name := range []string{ "NEW", "NEW,S,W", "OLD,S,A" } {
+		d.cmd.set(DOS_OK)
+		if err := d.open(name, 2); err != KERN_ERR_DEVICE_NOT_PRESENT || d.cmd.err != DOS_WRITE_PROTECT_ON {
+			t.Errorf("%s: got error %d, DOS status %d", name, err, d.cmd.err)
+		}
+	}
+
+	p := &printer_device{ sb: sb, name: "printer.txt", charset: CHARSET_UPPER }
+	p.open("", 4)
+	p.write(4, 'A')
+	if p.status(4) & KERN_ST_DEVICE_NOT_PRESENT == 0 {
+		t.Errorf("printer status %#x, want device not present", p.status(4))
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("files were written: %v", entries)
+	}
+
+	// an image drive stays read-only after an initialize
+	image := filepath.Join(t.TempDir(), "disk.d64")
+	if err := os.WriteFile(image, make([]byte, 174848), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := new_image_drive(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id.img.readonly = true		// as -read-only does
+	id.open("I", DOS_COMMAND_CHANNEL)
+	if id.cmd.err != DOS_OK {
+		t.Errorf("I: DOS status %d", id.cmd.err)
+	}
+	if err := id.open("NEW,S,W", 2); err != KERN_ERR_DEVICE_NOT_PRESENT || id.cmd.err != DOS_WRITE_PROTECT_ON {
+		t.Errorf("write after I: got error %d, DOS status %d", err, id.cmd.err)
+	}
+
+	// and without -read-only, the printer appends to its file
+	sb.readonly = false
+	for i := 0; i < 2; i++ {
+		p := &printer_device{ sb: sb, name: "printer.txt", charset: CHARSET_UPPER }
+		p.open("", 4)
+		p.write(4, 'A')
+		p.write(4, 13)
+		p.close(4)
+		p.f.Close()
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "printer.txt")); err != nil || string(b) != "A\nA\n" {
+		t.Errorf("printer file is %q, %v", b, err)
+	}
+}
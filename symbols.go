@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/************************************************************
+ *
+ * Symbol Tables
+ *
+ ************************************************************/
+
+/*
+ * A symbol table maps addresses in the 6502 address space to
+ * names and back. The table starts out with the well-known
+ * entry points of cbmbasic.bin (the C64 BASIC ROM, which is
+ * followed by the start of the C64 KERNAL ROM at $E000) and the
+ * KERNAL jump table; label files loaded with load_symbols()
+ * are added on top, overriding the bundled names.
+ */
+type symbol_table struct {
+	names	map[uint16]string
+	addrs	map[string]uint16
+}
+
+func new_symbol_table() *symbol_table {
+	return &symbol_table{
+		names:	map[uint16]string{},
+		addrs:	map[string]uint16{},
+	}
+}
+
+// add names addr; a name added again moves, and no longer names its old address
+func (s *symbol_table) add(addr uint16, name string) {
+	if old, ok := s.names[addr]; ok {
+		delete(s.addrs, old)
+	}
+	if prev, ok := s.addrs[name]; ok {
+		delete(s.names, prev)
+	}
+	s.names[addr] = name
+	s.addrs[name] = addr
+}
+
+var symbols = new_symbol_table()
+
+/* the ROM entry points the Go side calls or returns to */
+const (
+	ROM_ERROR = 0xA437		// error handler, X = error number
+	ROM_CRUNCH_DONE = 0xA612	// CRUNCH's RTS
+	ROM_QPLOP_CHAR = 0xA6F3		// QPLOP: list the byte as it is
+	ROM_QPLOP_NEXT = 0xA700		// QPLOP: go on after the token
+	ROM_FRMNUM = 0xAD8A		// evaluate a numeric expression into FAC
+	ROM_FRMEVL = 0xAD9E		// evaluate any expression into FAC
+	ROM_CHKCOM = 0xAEFD		// ?SYNTAX unless a comma comes next
+	ROM_STRSPA = 0xB47D		// room for A bytes of string, at $62/$63
+	ROM_PUTNEW = 0xB4CA		// the descriptor on the temporary stack
+	ROM_FRESTR = 0xB6A3		// the string in FAC, A = length, $22/$23 = pointer
+	ROM_GETBYT = 0xB79E		// evaluate a byte into X
+	ROM_GETADR = 0xB7F7		// FAC to a word in $14/$15
+	ROM_COLD_START = 0xE394		// main entry point of BASIC
+	ROM_CHRGET = 0x0073
+)
+
+/* the names used by the usual C64 ROM disassemblies */
+var cbmbasic_symbols = map[uint16]string{
+	0xA000:	"BASIC_COLD_VECTOR",
+	0xA408:	"REASON",
+	ROM_ERROR:	"ERROR",
+	0xA474:	"READY",
+	0xA480:	"MAIN",
+	0xA49C:	"MAIN1",
+	0xA533:	"LINKPRG",
+	0xA560:	"INLIN",
+	0xA579:	"CRUNCH",
+	ROM_CRUNCH_DONE:	"CRUNCH_DONE",
+	0xA613:	"FNDLIN",
+	0xA642:	"SCRTCH",
+	0xA659:	"CLEAR",
+	0xA68E:	"STXPT",
+	0xA69C:	"LIST",
+	ROM_QPLOP_CHAR:	"QPLOP_CHAR",
+	ROM_QPLOP_NEXT:	"QPLOP_NEXT",
+	0xA717:	"QPLOP",
+	0xA742:	"FOR",
+	NEWSTT:	"NEWSTT",
+	0xA7E4:	"GONE",
+	0xA81D:	"RESTOR",
+	0xA82C:	"ISCNTC",
+	0xA831:	"END",
+	0xA857:	"CONT",
+	0xA871:	"RUN",
+	0xA883:	"GOSUB",
+	0xA8A0:	"GOTO",
+	0xA8D2:	"RETURN",
+	0xA8F8:	"DATA",
+	0xA928:	"IF",
+	0xA93B:	"REM",
+	0xA94B:	"ONGOTO",
+	0xA96B:	"LINGET",
+	0xA9A5:	"LET",
+	0xAA80:	"PRINTN",
+	0xAA86:	"CMD",
+	0xAAA0:	"PRINT",
+	0xAB1E:	"STROUT",
+	0xAB3B:	"OUTSPC",
+	0xAB47:	"OUTDO",
+	0xAB7B:	"GET",
+	0xABA5:	"INPUTN",
+	0xABBF:	"INPUT",
+	0xAC06:	"READ",
+	0xAD1E:	"NEXT",
+	ROM_FRMNUM:	"FRMNUM",
+	ROM_FRMEVL:	"FRMEVL",
+	0xAE83:	"EVAL",
+	0xAEF7:	"CHKCLS",
+	0xAEFA:	"CHKOPN",
+	ROM_CHKCOM:	"CHKCOM",
+	0xAF08:	"SYNERR",
+	0xB08B:	"PTRGET",
+	0xB391:	"GIVAYF",
+	ROM_STRSPA:	"STRSPA",
+	ROM_PUTNEW:	"PUTNEW",
+	0xB3A2:	"SNGFLT",
+	ROM_FRESTR:	"FRESTR",
+	ROM_GETBYT:	"GETBYT",
+	ROM_GETADR:	"GETADR",
+	0xE10C:	"BASIC_CHROUT",
+	0xE37B:	"WARM_START",
+	ROM_COLD_START:	"COLD_START",
+	0xE3BF:	"INITCZ",
+	0xE422:	"INITMS",
+	0xE453:	"INITV",
+
+	// the KERNAL jump table, as trapped by kernal_dispatch()
+	0xFF90:	"SETMSG",
+	0xFF99:	"MEMTOP",
+	0xFF9C:	"MEMBOT",
+	0xFFB7:	"READST",
+	0xFFBA:	"SETLFS",
+	0xFFBD:	"SETNAM",
+	0xFFC0:	"OPEN",
+	0xFFC3:	"CLOSE",
+	0xFFC6:	"CHKIN",
+	0xFFC9:	"CHKOUT",
+	0xFFCC:	"CLRCHN",
+	0xFFCF:	"CHRIN",
+	0xFFD2:	"CHROUT",
+	0xFFD5:	"LOAD",
+	0xFFD8:	"SAVE",
+	0xFFDB:	"SETTIM",
+	0xFFDE:	"RDTIM",
+	0xFFE1:	"STOP",
+	0xFFE4:	"GETIN",
+	0xFFE7:	"CLALL",
+	0xFFF0:	"PLOT",
+	0xFFF3:	"IOBASE",
+
+	// CHRGET/CHRGOT live in the zero page and are trapped too
+	ROM_CHRGET:	"CHRGET",
+	0x0079:	"CHRGOT",
+
+	// our own glue (see runtime_init.go and glue.go)
+	0xF000:	"RESET_TRAMPOLINE",
+	0xF800:	"KERNAL_RETURN",
+	MAGIC_ERROR:	"MAGIC_ERROR",
+	MAGIC_MAIN:	"MAGIC_MAIN",
+	MAGIC_CRNCH:	"MAGIC_CRNCH",
+	MAGIC_QPLOP:	"MAGIC_QPLOP",
+	MAGIC_GONE:	"MAGIC_GONE",
+	MAGIC_EVAL:	"MAGIC_EVAL",
+	MAGIC_CONTINUATION:	"MAGIC_CONTINUATION",
+}
+
+func init() {
+	for addr, name := range cbmbasic_symbols {
+		symbols.add(addr, name)
+	}
+}
+
+// symbol_name returns the name of addr, or "" if there is none.
+func symbol_name(addr uint16) string {
+	return symbols.names[addr]
+}
+
+// symbol_addr looks up a symbol by name.
+func symbol_addr(name string) (uint16, bool) {
+	addr, ok := symbols.addrs[name]
+	return addr, ok
+}
+
+/*
+ * symbolize formats addr for traces and error messages: $E394 becomes
+ * "$E394 <COLD_START>", and an address just past a label becomes
+ * "$E398 <COLD_START+4>". Labels more than 0xFF bytes back are not
+ * considered, as they are most likely unrelated.
+ */
+func symbolize(addr uint16) string {
+	if name := symbol_name(addr); name != "" {
+		return fmt.Sprintf("$%04X <%s>", addr, name)
+	}
+	for off := uint16(1); off <= 0xFF && off <= addr; off++ {
+		if name := symbol_name(addr - off); name != "" {
+			return fmt.Sprintf("$%04X <%s+%d>", addr, name, off)
+		}
+	}
+	return fmt.Sprintf("$%04X", addr)
+}
+
+/*
+ * parse_address accepts anything a user may type for an address:
+ * a symbol name, $hex, 0xhex or decimal.
+ */
+func parse_address(s string) (uint16, error) {
+	if addr, ok := symbol_addr(s); ok {
+		return addr, nil
+	}
+	n, err := parse_number(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown symbol or bad address %q", s)
+	}
+	return n, nil
+}
+
+func parse_number(s string) (uint16, error) {
+	var n uint64
+	var err error
+
+	switch {
+	case strings.HasPrefix(s, "$"):
+		n, err = strconv.ParseUint(s[1:], 16, 16)
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		n, err = strconv.ParseUint(s[2:], 16, 16)
+	default:
+		n, err = strconv.ParseUint(s, 10, 16)
+	}
+	return uint16(n), err
+}
+
+/************************************************************
+ *
+ * Label File Loading
+ *
+ ************************************************************/
+
+/*
+ * load_symbols reads a label file and adds its symbols. The format
+ * is detected from the contents:
+ * - VICE monitor labels ("al C:e394 .COLD_START")
+ * - ca65/ld65 debug info files ("sym id=0,name="main",...,val=0x80D,...")
+ * - plain assignments ("COLD_START = $E394"), as written by most assemblers
+ */
+func load_symbols(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	syms, err := parse_symbols(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	for _, s := range syms {
+		symbols.add(s.addr, s.name)
+	}
+	return nil
+}
+
+type symbol struct {
+	name	string
+	addr	uint16
+}
+
+func parse_symbols(r io.Reader) ([]symbol, error) {
+	var syms []symbol
+	var parse func(string) (*symbol, error)
+
+	s := bufio.NewScanner(r)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		if parse == nil {		// first real line decides
+			switch {
+			case strings.HasPrefix(line, "al "):
+				parse = parse_vice_label
+			case strings.HasPrefix(line, "version\t"), strings.HasPrefix(line, "info\t"):
+				parse = parse_dbg_label
+			default:
+				parse = parse_plain_label
+			}
+		}
+		sym, err := parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if sym != nil {
+			syms = append(syms, *sym)
+		}
+	}
+	return syms, s.Err()
+}
+
+// al C:e394 .COLD_START
+func parse_vice_label(line string) (*symbol, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "al" {
+		return nil, fmt.Errorf("bad VICE label %q", line)
+	}
+	addr := fields[1]
+	if i := strings.IndexByte(addr, ':'); i != -1 {		// memory space prefix
+		addr = addr[i+1:]
+	}
+	n, err := strconv.ParseUint(addr, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad VICE label address %q", fields[1])
+	}
+	return &symbol{
+		name:	strings.TrimPrefix(fields[2], "."),
+		addr:	uint16(n),
+	}, nil
+}
+
+// sym	id=0,name="main",addrsize=absolute,scope=0,def=1,val=0x80D,seg=0,type=lab
+func parse_dbg_label(line string) (*symbol, error) {
+	fields := strings.SplitN(line, "\t", 2)
+	if fields[0] != "sym" || len(fields) != 2 {
+		return nil, nil		// only symbols are of interest
+	}
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(fields[1], ",") {
+		if i := strings.IndexByte(kv, '='); i != -1 {
+			attrs[kv[:i]] = strings.Trim(kv[i+1:], "\"")
+		}
+	}
+	if attrs["type"] == "imp" || attrs["val"] == "" {
+		return nil, nil		// imports have no value of their own
+	}
+	n, err := parse_number(attrs["val"])
+	if err != nil {
+		return nil, fmt.Errorf("bad value for symbol %q", attrs["name"])
+	}
+	return &symbol{
+		name:	attrs["name"],
+		addr:	n,
+	}, nil
+}
+
+// COLD_START = $E394
+func parse_plain_label(line string) (*symbol, error) {
+	if i := strings.IndexByte(line, ';'); i != -1 {		// trailing comment
+		line = line[:i]
+	}
+	i := strings.IndexByte(line, '=')
+	if i == -1 {
+		return nil, fmt.Errorf("expected name = address, got %q", line)
+	}
+	name := strings.TrimSpace(line[:i])
+	value := strings.TrimSpace(line[i+1:])
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return nil, fmt.Errorf("bad label name %q", name)
+	}
+	n, err := parse_number(value)
+	if err != nil {
+		return nil, fmt.Errorf("bad address %q for %s", value, name)
+	}
+	return &symbol{
+		name:	name,
+		addr:	n,
+	}, nil
+}
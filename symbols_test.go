@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSymbols(t *testing.T) {
+	tests := []struct {
+		name	string
+		in		string
+		want	[]symbol
+	}{
+		{
+			name:	"vice",
+			in:		"al C:e394 .COLD_START\nal C:a437 .ERROR\n",
+			want:	[]symbol{{ "COLD_START", 0xE394 }, { "ERROR", 0xA437 }},
+		},
+		{
+			name:	"ld65",
+			in:		"version\tmajor=2,minor=0\n" +
+				"file\tid=0,name=\"main.s\",size=100,mtime=0x5A4B3C2D,mod=0\n" +
+				"sym\tid=0,name=\"main\",addrsize=absolute,scope=0,def=1,val=0x80D,seg=0,type=lab\n" +
+				"sym\tid=1,name=\"CHROUT\",addrsize=absolute,scope=0,ref=2,type=imp\n",
+			want:	[]symbol{{ "main", 0x080D }},
+		},
+		{
+			name:	"plain",
+			in:		"; comment\nCHKCOM = $AEFD\nFRMNUM=0xAD8A ; trailing\nvar = 2049\n",
+			want:	[]symbol{{ "CHKCOM", 0xAEFD }, { "FRMNUM", 0xAD8A }, { "var", 0x0801 }},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := parse_symbols(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: symbol %d: got %v, want %v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParseSymbolsErrors(t *testing.T) {
+	for _, in := range []string{
+		"al C:zzzz .BAD\n",
+		"NAME = $12345\n",
+		"no assignment here\n",
+	} {
+		if _, err := parse_symbols(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestSymbolTableRedefine(t *testing.T) {
+	s := new_symbol_table()
+	s.add(0x1000, "START")
+	s.add(0x2000, "START")
+	if s.addrs["START"] != 0x2000 || s.names[0x1000] != "" || s.names[0x2000] != "START" {
+		t.Errorf("START moved: addrs %v, names %v", s.addrs, s.names)
+	}
+	// a new name at the old address leaves START where it is
+	s.add(0x1000, "OTHER")
+	if addr, ok := s.addrs["START"]; !ok || addr != 0x2000 {
+		t.Errorf("START is at $%04X (%v)", addr, ok)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	defer func(s byte) {
+		S = s
+	}(S)
+	S = 0xF0
+	memory[0x01F1], memory[0x01F2] = byte((ROM_CHKCOM - 1) & 0xFF), byte((ROM_CHKCOM - 1) >> 8)		// a JSR's return address, on the 6502's stack
+	if got := caller(); got != "$AEFD <CHKCOM>" {
+		t.Errorf("caller() = %q", got)
+	}
+}
+
+func TestSymbolize(t *testing.T) {
+	tests := []struct {
+		addr	uint16
+		want	string
+	}{
+		{ 0xE394, "$E394 <COLD_START>" },
+		{ 0xAF00, "$AF00 <CHKCOM+3>" },
+		{ 0x0800, "$0800" },
+	}
+
+	for _, tt := range tests {
+		if got := symbolize(tt.addr); got != tt.want {
+			t.Errorf("symbolize($%04X) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/************************************************************
+ *
+ * Web UI
+ *
+ ************************************************************/
+
+/*
+ * -http starts a small web server with a page that shows the
+ * registers, memory, a trace of the last half-cycles and the nodes
+ * of the chip, and that can stop, start and single-step the clock.
+ * Everything (including the page's script) is served from here, so
+ * it works without internet access; the simulation itself stays in
+ * Go, the page only displays it.
+ *
+ * The API is plain JSON over HTTP:
+ *	GET /api/state			registers, cycle and whether we're running
+ *	GET /api/trace			the last TRACE_SIZE half-cycles
+ *	GET /api/memory?addr=&len=	memory contents (addr may be a symbol)
+ *	GET /api/nodes?q=		nodes whose name contains q (or whose number is q)
+ *	GET /api/disasm?addr=&n=	n instructions from addr on, symbolized
+ *	GET, POST, DELETE /api/break?addr=	list, set or clear breakpoints (see break.go)
+ *	POST /api/run, /api/stop, /api/step?n=
+ * and /api/ws, a WebSocket that pushes the state and new trace lines
+ * about ten times a second and accepts {"cmd": "run"|"stop"|"step", "n": n}.
+ *
+ * Anyone who can reach the UI can drive the chip, so it is only served
+ * on a loopback address, and only to its own pages: a request must name
+ * a loopback host (so DNS rebinding can't get another site in), and a
+ * browser's request must come from the UI's own origin (so another site
+ * can't post to it or open its WebSocket).
+ */
+var http_addr = flag.String("http", "", "serve the web UI on `addr` (for example localhost:6502)")
+
+/* the state of the chip after a half-cycle */
+type chip_state struct {
+	Cycle	uint		`json:"cycle"`
+	Clk		bool		`json:"clk"`
+	AB		uint16	`json:"ab"`
+	DB		byte		`json:"db"`
+	RW		bool		`json:"rw"`
+	PC		uint16	`json:"pc"`
+	A		byte		`json:"a"`
+	X		byte		`json:"x"`
+	Y		byte		`json:"y"`
+	SP		byte		`json:"sp"`
+	P		byte		`json:"p"`
+	IR		byte		`json:"ir"`
+	Symbol	string	`json:"symbol,omitempty"`
+}
+
+// only call on the chiploop goroutine
+func read_chip_state() chip_state {
+	return chip_state{
+		Cycle:	cycle,
+		Clk:		isNodeHigh(clk0),
+		AB:		readAddressBus(),
+		DB:		readDataBus(),
+		RW:		isNodeHigh(rw),
+		PC:		readPC(),
+		A:		readA(),
+		X:		readX(),
+		Y:		readY(),
+		SP:		readSP(),
+		P:		readP(),
+		IR:		readIR(),
+	}
+}
+
+/************************************************************
+ * Trace
+ ************************************************************/
+
+const TRACE_SIZE = 256
+
+var (
+	tracing		bool
+	trace_mu		sync.Mutex
+	trace_buf		[TRACE_SIZE]chip_state
+	trace_next	uint64		// total number of half-cycles traced
+)
+
+/* called by chiploop after each clock edge */
+func trace_halfcycle() {
+	st := read_chip_state()
+	trace_mu.Lock()
+	trace_buf[trace_next % TRACE_SIZE] = st
+	trace_next++
+	trace_mu.Unlock()
+}
+
+// trace_since returns the trace entries after number since (at most TRACE_SIZE) and the next number
+func trace_since(since uint64) ([]chip_state, uint64) {
+	trace_mu.Lock()
+	defer trace_mu.Unlock()
+
+	if trace_next - since > TRACE_SIZE || since > trace_next {
+		since = 0
+		if trace_next > TRACE_SIZE {
+			since = trace_next - TRACE_SIZE
+		}
+	}
+	var t []chip_state
+	for i := since; i < trace_next; i++ {
+		st := trace_buf[i % TRACE_SIZE]
+		st.Symbol = symbol_name(st.PC)
+		t = append(t, st)
+	}
+	return t, trace_next
+}
+
+/************************************************************
+ * Simulation Control
+ ************************************************************/
+
+var (
+	sim_mu		sync.Mutex
+	sim_running	= true
+)
+
+func sim_command(cmd string, n int) error {
+	sim_mu.Lock()
+	defer sim_mu.Unlock()
+
+	switch cmd {
+	case "run":
+		clock_run <- true
+		sim_running = true
+	case "stop":
+		clock_run <- false
+		sim_running = false
+	case "step":
+		if n <= 0 {
+			n = 1
+		}
+		clock_step <- n
+		sim_running = false
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+const probe_timeout = time.Second
+
+type ui_state struct {
+	Running	bool			`json:"running"`
+	Busy		bool			`json:"busy"`		// chip didn't answer; Chip is stale
+	Chip		chip_state	`json:"chip"`
+}
+
+var last_chip_state chip_state
+
+func current_ui_state() ui_state {
+	var st ui_state
+
+	sim_mu.Lock()
+	defer sim_mu.Unlock()
+	st.Busy = !chip_probe(func() {
+		last_chip_state = read_chip_state()
+	}, probe_timeout)
+	st.Chip = last_chip_state
+	st.Chip.Symbol = symbol_name(st.Chip.PC)
+	st.Running = sim_running
+	return st
+}
+
+/************************************************************
+ * HTTP Handlers
+ ************************************************************/
+
+func start_webui(addr string) {
+	if err := check_http_addr(addr); err != nil {
+		fatalf("error starting web UI: %v", err)
+	}
+	tracing = true
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatalf("error starting web UI: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "web UI at http://%s/\n", l.Addr())
+	go http.Serve(l, webui_handler())
+}
+
+func webui_handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serve_index)
+	mux.HandleFunc("/api/state", func(w http.ResponseWriter, r *http.Request) {
+		write_json(w, current_ui_state())
+	})
+	mux.HandleFunc("/api/trace", func(w http.ResponseWriter, r *http.Request) {
+		t, _ := trace_since(0)
+		write_json(w, t)
+	})
+	mux.HandleFunc("/api/memory", serve_memory)
+	mux.HandleFunc("/api/nodes", serve_nodes)
+	mux.HandleFunc("/api/disasm", serve_disasm)
+	mux.HandleFunc("/api/break", serve_break)
+	for _, cmd := range []string{ "run", "stop", "step" } {
+		cmd := cmd
+		mux.HandleFunc("/api/" + cmd, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			n, _ := strconv.Atoi(r.FormValue("n"))
+			if err := sim_command(cmd, n); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			write_json(w, current_ui_state())
+		})
+	}
+	mux.HandleFunc("/api/ws", serve_websocket)
+	return same_origin(mux)
+}
+
+// check_http_addr refuses to serve anywhere but on a loopback address
+func check_http_addr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !is_loopback_host(host) {
+		return fmt.Errorf("%q is not a loopback address; use localhost, 127.0.0.1 or [::1]", addr)
+	}
+	return nil
+}
+
+func is_loopback_host(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/* same_origin turns away requests for other hosts, and browsers' requests from other origins */
+func same_origin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hh, _, err := net.SplitHostPort(host); err == nil {
+			host = hh
+		}
+		if !is_loopback_host(host) {
+			http.Error(w, "bad host", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme != "http" || u.Host != r.Host {
+				http.Error(w, "cross-origin request", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func write_json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func serve_memory(w http.ResponseWriter, r *http.Request) {
+	addr, err := parse_address(r.FormValue("addr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	length := 256
+	if s := r.FormValue("len"); s != "" {
+		length, err = strconv.Atoi(s)
+		if err != nil || length < 1 || length > 65536 {
+			http.Error(w, "bad length", http.StatusBadRequest)
+			return
+		}
+	}
+	b := read_memory(addr, length)
+	write_json(w, struct {
+		Addr		uint16	`json:"addr"`
+		Bytes	[]int	`json:"bytes"`
+	}{ addr, bytes_to_ints(b) })
+}
+
+func serve_disasm(w http.ResponseWriter, r *http.Request) {
+	addr, err := parse_address(r.FormValue("addr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := 16
+	if s := r.FormValue("n"); s != "" {
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "bad count", http.StatusBadRequest)
+			return
+		}
+	}
+	mem := read_memory(0, 0x10000)
+	write_json(w, disassemble_range(addr, n, func(addr uint16) byte {
+		return mem[addr]
+	}))
+}
+
+func serve_break(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		_, err = set_breakpoint(r.FormValue("addr"))
+	case "DELETE":
+		_, err = clear_breakpoint(r.FormValue("addr"))
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	write_json(w, list_breakpoints())
+}
+
+// so JSON gets an array instead of base64
+func bytes_to_ints(b []byte) []int {
+	n := make([]int, len(b))
+	for i := range b {
+		n[i] = int(b[i])
+	}
+	return n
+}
+
+type node_info struct {
+	Number	uint64	`json:"number"`
+	Name		string	`json:"name"`
+	High		bool		`json:"high"`
+}
+
+func serve_nodes(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(r.FormValue("q"))
+	var found []uint64
+	if n, err := strconv.ParseUint(q, 10, 64); err == nil && n < NODES {
+		found = append(found, n)
+	}
+	for nn, name := range nodenames {
+		if q != "" && strings.Contains(strings.ToLower(name), q) {
+			found = append(found, nn)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return node_name(found[i]) < node_name(found[j])
+	})
+
+	nodes := []node_info{}
+	ok := chip_probe(func() {
+		for _, nn := range found {
+			nodes = append(nodes, node_info{
+				Number:	nn,
+				Name:	node_name(nn),
+				High:	isNodeHigh(nn),
+			})
+		}
+	}, probe_timeout)
+	if !ok {
+		http.Error(w, "chip is busy", http.StatusServiceUnavailable)
+		return
+	}
+	write_json(w, nodes)
+}
+
+/************************************************************
+ * WebSocket
+ ************************************************************/
+
+/*
+ * Just enough of RFC 6455 for the UI: unfragmented text frames,
+ * which the browser sends masked and we send unmasked.
+ */
+const websocket_guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func serve_websocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot hijack connection", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + websocket_guid))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if rw.Flush() != nil {
+		return
+	}
+
+	var write_mu sync.Mutex
+	send := func(v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		write_mu.Lock()
+		defer write_mu.Unlock()
+		if err = write_ws_frame(rw.Writer, b); err != nil {
+			return err
+		}
+		return rw.Flush()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, err := read_ws_frame(rw.Reader)
+			if err != nil {
+				return
+			}
+			var cmd struct {
+				Cmd	string	`json:"cmd"`
+				N	int		`json:"n"`
+			}
+			if json.Unmarshal(msg, &cmd) != nil {
+				continue
+			}
+			if err := sim_command(cmd.Cmd, cmd.N); err != nil {
+				send(map[string]string{ "error": err.Error() })
+			}
+		}
+	}()
+
+	var since uint64
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+		var msg struct {
+			State	ui_state		`json:"state"`
+			Trace	[]chip_state	`json:"trace"`
+		}
+		msg.State = current_ui_state()
+		msg.Trace, since = trace_since(since)
+		if send(msg) != nil {
+			return
+		}
+	}
+}
+
+func write_ws_frame(w io.Writer, payload []byte) error {
+	hdr := []byte{ 0x81 }		// FIN, text
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n < 65536:
+		hdr = append(hdr, 126, byte(n >> 8), byte(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = append(hdr, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+func read_ws_frame(r *bufio.Reader) ([]byte, error) {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		opcode := hdr[0] & 0x0F
+		masked := hdr[1] & 0x80 != 0
+		n := uint64(hdr[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > 65536 {
+			return nil, errors.New("websocket frame too large")
+		}
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(r, mask[:]); err != nil {
+				return nil, err
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i % 4]
+			}
+		}
+		switch opcode {
+		case 0x1:		// text
+			return payload, nil
+		case 0x8:		// close
+			return nil, errWebSocketClosed
+		}
+		// ignore pings, pongs and binary frames
+	}
+}
+
+/************************************************************
+ * The Page
+ ************************************************************/
+
+func serve_index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, webui_page)
+}
+
+const webui_page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>perfect6502</title>
+<style>
+body { background: #111; color: #ddd; font-family: monospace; margin: 1em; }
+h2 { font-size: 1em; color: #8af; margin: 0.5em 0; }
+.panel { border: 1px solid #444; padding: 0.5em; margin: 0.5em; vertical-align: top; display: inline-block; }
+#trace { height: 24em; overflow-y: scroll; white-space: pre; }
+#memory { white-space: pre; }
+button, input { font-family: monospace; background: #222; color: #ddd; border: 1px solid #555; }
+.high { color: #f46; }
+.low { color: #68f; }
+</style>
+</head>
+<body>
+<div class="panel">
+<h2>control</h2>
+<button onclick="cmd('run')">run</button>
+<button onclick="cmd('stop')">stop</button>
+<button onclick="cmd('step', 1)">half-cycle</button>
+<button onclick="cmd('step', 2)">cycle</button>
+<input id="stepn" size="6" value="100"><button onclick="cmd('step', +document.getElementById('stepn').value)">steps</button>
+<span id="status"></span>
+<h2>registers</h2>
+<div id="regs"></div>
+</div>
+<div class="panel">
+<h2>memory</h2>
+<input id="addr" size="12" value="$0801"><button onclick="loadMemory()">show</button>
+<div id="memory"></div>
+</div>
+<div class="panel">
+<h2>nodes</h2>
+<input id="q" size="12"><button onclick="findNodes()">find</button>
+<div id="nodes"></div>
+</div>
+<div class="panel">
+<h2>trace</h2>
+<div id="trace"></div>
+</div>
+<script>
+var ws = null;
+function hex(n, w) { return n.toString(16).toUpperCase().padStart(w, "0"); }
+function cmd(c, n) {
+	if (ws && ws.readyState == 1) ws.send(JSON.stringify({cmd: c, n: n || 0}));
+	else fetch("/api/" + c + "?n=" + (n || 0), {method: "POST"});
+}
+function showState(s) {
+	var c = s.chip;
+	document.getElementById("status").textContent = (s.running ? "running" : "stopped") + (s.busy ? " (busy)" : "");
+	document.getElementById("regs").textContent =
+		"cycle " + c.cycle + "\nPC " + hex(c.pc, 4) + (c.symbol ? " <" + c.symbol + ">" : "") +
+		"\nA " + hex(c.a, 2) + " X " + hex(c.x, 2) + " Y " + hex(c.y, 2) +
+		"\nSP " + hex(c.sp, 2) + " P " + hex(c.p, 2) + " IR " + hex(c.ir, 2) +
+		"\nAB " + hex(c.ab, 4) + " DB " + hex(c.db, 2) + (c.rw ? " R" : " W");
+	document.getElementById("regs").style.whiteSpace = "pre";
+}
+function traceLine(c) {
+	return c.cycle + " AB:" + hex(c.ab, 4) + " D:" + hex(c.db, 2) + " " + (c.rw ? "R" : "W") +
+		" PC:" + hex(c.pc, 4) + " A:" + hex(c.a, 2) + " X:" + hex(c.x, 2) + " Y:" + hex(c.y, 2) +
+		" SP:" + hex(c.sp, 2) + " P:" + hex(c.p, 2) + " IR:" + hex(c.ir, 2) + (c.symbol ? " <" + c.symbol + ">" : "");
+}
+function addTrace(t) {
+	if (!t) return;
+	var el = document.getElementById("trace");
+	var lines = el.textContent ? el.textContent.split("\n") : [];
+	for (var i = 0; i < t.length; i++) lines.push(traceLine(t[i]));
+	el.textContent = lines.slice(-1000).join("\n");
+	el.scrollTop = el.scrollHeight;
+}
+function loadMemory() {
+	fetch("/api/memory?len=256&addr=" + encodeURIComponent(document.getElementById("addr").value))
+		.then(function (r) { return r.json(); })
+		.then(function (m) {
+			var s = "";
+			for (var i = 0; i < m.bytes.length; i += 16) {
+				s += hex((m.addr + i) & 0xFFFF, 4) + " ";
+				for (var j = 0; j < 16 && i + j < m.bytes.length; j++) s += " " + hex(m.bytes[i + j], 2);
+				s += "\n";
+			}
+			document.getElementById("memory").textContent = s;
+		});
+}
+function findNodes() {
+	fetch("/api/nodes?q=" + encodeURIComponent(document.getElementById("q").value))
+		.then(function (r) { return r.json(); })
+		.then(function (nodes) {
+			var el = document.getElementById("nodes");
+			el.innerHTML = "";
+			nodes.forEach(function (n) {
+				var d = document.createElement("div");
+				d.className = n.high ? "high" : "low";
+				d.textContent = n.name + " (" + n.number + ") " + (n.high ? "high" : "low");
+				el.appendChild(d);
+			});
+		});
+}
+function connect() {
+	ws = new WebSocket("ws://" + location.host + "/api/ws");
+	ws.onmessage = function (e) {
+		var m = JSON.parse(e.data);
+		if (m.state) showState(m.state);
+		addTrace(m.trace);
+	};
+	ws.onclose = function () { setTimeout(connect, 1000); };
+}
+connect();
+loadMemory();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckHTTPAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr	string
+		ok	bool
+	}{
+		{ "localhost:6502", true },
+		{ "127.0.0.1:0", true },
+		{ "[::1]:6502", true },
+		{ ":6502", false },
+		{ "0.0.0.0:6502", false },
+		{ "192.168.1.2:6502", false },
+		{ "example.com:6502", false },
+		{ "localhost", false },
+	} {
+		if err := check_http_addr(tt.addr); (err == nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.addr, err)
+		}
+	}
+}
+
+func TestWebUIHandler(t *testing.T) {
+	saved := append([]byte(nil), memory[0xC000:0xC002]...)
+	defer copy(memory[0xC000:], saved)
+	memory[0xC000] = 0x12
+	memory[0xC001] = 0x34
+
+	h := webui_handler()
+	tests := []struct {
+		method	string
+		url		string
+		host		string
+		origin	string
+		want		int
+	}{
+		{ "GET", "/api/memory?addr=$C000&len=2", "localhost:6502", "", http.StatusOK },
+		{ "GET", "/api/memory?addr=$C000&len=2", "127.0.0.1:6502", "http://127.0.0.1:6502", http.StatusOK },
+		{ "GET", "/api/memory?addr=$C000&len=2", "evil.example:6502", "", http.StatusForbidden },		// DNS rebinding
+		{ "GET", "/api/memory?addr=$C000&len=2", "localhost:6502", "http://evil.example", http.StatusForbidden },
+		{ "GET", "/api/memory?addr=$C000&len=2", "localhost:6502", "null", http.StatusForbidden },
+		{ "GET", "/api/memory?addr=NO_SUCH_LABEL", "localhost:6502", "", http.StatusBadRequest },
+		{ "POST", "/api/stop", "localhost:6502", "http://evil.example", http.StatusForbidden },
+		{ "POST", "/api/run", "localhost:6502", "http://localhost:7000", http.StatusForbidden },
+		{ "GET", "/api/ws", "localhost:6502", "http://evil.example", http.StatusForbidden },
+		{ "GET", "/api/break", "localhost:6502", "http://localhost:6502", http.StatusOK },
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s %s (Host %s, Origin %s): got %d, want %d", tt.method, tt.url, tt.host, tt.origin, w.Code, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/memory?addr=$C000&len=2", nil)
+	r.Host = "localhost:6502"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var got struct {
+		Addr		uint16	`json:"addr"`
+		Bytes	[]int	`json:"bytes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Addr != 0xC000 || len(got.Bytes) != 2 || got.Bytes[0] != 0x12 || got.Bytes[1] != 0x34 {
+		t.Errorf("got %+v", got)
+	}
+}